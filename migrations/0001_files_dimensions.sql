@@ -0,0 +1,4 @@
+-- Image width and height read from the decoded header
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `width` INT UNSIGNED NULL,
+    ADD COLUMN `height` INT UNSIGNED NULL;
@@ -0,0 +1,3 @@
+-- Object key of the thumbnail uploaded alongside an image
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `thumbnail_uri` VARCHAR(1024) NULL;
@@ -0,0 +1,5 @@
+-- Category and message of the last error a file hit, see errors.go for the
+-- categories
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `error_code` VARCHAR(32) NULL,
+    ADD COLUMN `last_error` VARCHAR(255) NULL;
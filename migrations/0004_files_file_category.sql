@@ -0,0 +1,3 @@
+-- Broad kind of file (image, video, audio or other) derived from its MIME type
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `file_category` VARCHAR(16) NULL;
@@ -0,0 +1,7 @@
+-- Row claiming for running several instances at once. worker_id holds the
+-- claiming worker's id and a per-run token. If `state` is an ENUM it also
+-- needs the 'processing' value.
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `worker_id` VARCHAR(255) NULL,
+    ADD COLUMN `claimed_at` DATETIME NULL,
+    ADD INDEX `files_state_claimed_at` (`state`, `claimed_at`);
@@ -0,0 +1,5 @@
+-- The source's ETag and Last-Modified headers for the stored object, sent back
+-- as If-None-Match and If-Modified-Since so an unchanged file isn't uploaded again
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `etag` VARCHAR(255) NULL,
+    ADD COLUMN `last_modified` VARCHAR(64) NULL;
@@ -0,0 +1,3 @@
+-- Whether a GIF has more than one frame, NULL for anything else
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `is_animated` TINYINT(1) NULL;
@@ -0,0 +1,16 @@
+-- One row per attempt at a file when attemptLog is enabled. gc deletes them
+-- along with their file, and those older than attemptLog.maxAge.
+CREATE TABLE rss_aggregator.file_attempts (
+    `pk_attempt_id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `fk_file_id` INT UNSIGNED NOT NULL,
+    `attempt` INT UNSIGNED NOT NULL,
+    `outcome` VARCHAR(16) NOT NULL,
+    `error_code` VARCHAR(32) NULL,
+    `last_error` VARCHAR(255) NULL,
+    `duration_ms` BIGINT NULL,
+    `bytes` BIGINT NOT NULL DEFAULT 0,
+    `created` DATETIME NOT NULL,
+    PRIMARY KEY (`pk_attempt_id`),
+    KEY `file_attempts_file_attempt` (`fk_file_id`, `attempt`),
+    KEY `file_attempts_created` (`created`)
+);
@@ -0,0 +1,4 @@
+-- Where a downloadOnly run kept a file, as those rows have no ingested_uri. If
+-- `state` is an ENUM it also needs the 'downloaded' value those rows are given.
+ALTER TABLE rss_aggregator.files
+    ADD COLUMN `local_path` VARCHAR(1024) NULL;
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// alertNotifier posts Slack-compatible messages to a webhook. Sending happens
+// in the background so a slow or broken webhook never holds up processing.
+type alertNotifier struct {
+	webhookUrl string
+	client     *http.Client
+	wg         sync.WaitGroup
+}
+
+func newAlertNotifier(webhookUrl string, client *http.Client) *alertNotifier {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &alertNotifier{
+		webhookUrl: webhookUrl,
+		client:     client,
+	}
+}
+
+func (n *alertNotifier) send(text string) error {
+	payload, err := json.Marshal(slackMessage{Text: text})
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.webhookUrl, "application/json", bytes.NewBuffer(payload))
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (n *alertNotifier) notify(text string) {
+	if n.webhookUrl == "" {
+		return
+	}
+
+	n.wg.Add(1)
+
+	go func() {
+		defer n.wg.Done()
+
+		err := n.send(text)
+
+		if err != nil {
+			fmt.Println("could not send alert", err)
+		}
+	}()
+}
+
+func (n *alertNotifier) notifyFailedImage(image AbtImage) {
+	n.notify(fmt.Sprintf(
+		"media cloner gave up on file %d (post %d) after %d attempts: %s",
+		image.FileId, image.PostId, image.Attempts+1, image.LastError,
+	))
+}
+
+func (n *alertNotifier) notifyFailureRate(summary *RunSummary, threshold float64) {
+	if threshold <= 0 {
+		return
+	}
+
+	rate := summary.failureRate()
+
+	if rate > threshold {
+		n.notify(fmt.Sprintf(
+			"media cloner failure rate was %.0f%% (%d of %d files) in the last run",
+			rate*100, summary.Failed, summary.Processed,
+		))
+	}
+}
+
+// wait blocks until any alerts still being sent have finished.
+func (n *alertNotifier) wait() {
+	n.wg.Wait()
+}
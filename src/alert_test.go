@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// alertRecorder is a webhook collecting the text of the alerts it receives.
+type alertRecorder struct {
+	mutex sync.Mutex
+	texts []string
+}
+
+func (a *alertRecorder) serve(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("alert posted as %q", r.Header.Get("Content-Type"))
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		message := slackMessage{}
+
+		err := json.Unmarshal(body, &message)
+
+		if err != nil {
+			t.Errorf("could not decode alert %q: %v", body, err)
+		}
+
+		a.mutex.Lock()
+		a.texts = append(a.texts, message.Text)
+		a.mutex.Unlock()
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestNotifyFailedImage(t *testing.T) {
+	recorder := &alertRecorder{}
+	notifier := newAlertNotifier(recorder.serve(t).URL, nil)
+
+	notifier.notifyFailedImage(AbtImage{FileId: 7, PostId: 3, Attempts: 2, LastError: "unexpected http status: 500"})
+	notifier.wait()
+
+	if len(recorder.texts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(recorder.texts))
+	}
+
+	want := "media cloner gave up on file 7 (post 3) after 3 attempts: unexpected http status: 500"
+
+	if recorder.texts[0] != want {
+		t.Errorf("got %q, want %q", recorder.texts[0], want)
+	}
+}
+
+func TestNotifyFailureRate(t *testing.T) {
+	tests := []struct {
+		processed  int
+		failed     int
+		threshold  float64
+		wantAlerts int
+	}{
+		{10, 6, 0.5, 1},
+		{10, 5, 0.5, 0},
+		{10, 9, 0, 0},
+		{0, 0, 0.5, 0},
+	}
+
+	for _, test := range tests {
+		recorder := &alertRecorder{}
+		notifier := newAlertNotifier(recorder.serve(t).URL, nil)
+		summary := newRunSummary()
+		summary.recordProcessed(test.processed)
+
+		for i := 0; i < test.failed; i++ {
+			summary.recordFailure("images.example.com", errors.New("unexpected http status: 500"))
+		}
+
+		notifier.notifyFailureRate(summary, test.threshold)
+		notifier.wait()
+
+		if len(recorder.texts) != test.wantAlerts {
+			t.Errorf("%d of %d failed with threshold %.1f: got %d alerts, want %d", test.failed, test.processed, test.threshold, len(recorder.texts), test.wantAlerts)
+			continue
+		}
+
+		if test.wantAlerts > 0 && !strings.Contains(recorder.texts[0], "60% (6 of 10 files)") {
+			t.Errorf("unexpected alert %q", recorder.texts[0])
+		}
+	}
+}
+
+func TestNotifyWithoutWebhookDoesNothing(t *testing.T) {
+	notifier := newAlertNotifier("", nil)
+	notifier.notifyFailedImage(AbtImage{FileId: 1})
+	notifier.wait()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	attemptOutcomeRetrieved    = "retrieved"
+	attemptOutcomeUnchanged    = "unchanged"
+	attemptOutcomeDownloaded   = "downloaded"
+	attemptOutcomeRejected     = "rejected"
+	attemptOutcomeFetchFailed  = "fetch_failed"
+	attemptOutcomeUploadFailed = "upload_failed"
+)
+
+// AttemptLogConfig turns on a row in file_attempts for every attempt at a
+// file, for looking into flaky sources over time. Only the latest Retain
+// attempts of each file are kept, or all of them when Retain is 0. Attempts
+// older than MaxAge are deleted by gc.
+type AttemptLogConfig struct {
+	Enabled bool     `json:"enabled"`
+	Retain  int      `json:"retain"`
+	MaxAge  Duration `json:"maxAge"`
+}
+
+type attemptLogger struct {
+	db     *sql.DB
+	retain int
+}
+
+// record inserts an attempt at a file. It must be called before the file's
+// attempts counter is incremented by its update. A nil logger, used when the
+// log is off, does nothing.
+func (l *attemptLogger) record(ctx context.Context, image AbtImage, outcome string) error {
+	if l == nil {
+		return nil
+	}
+
+	attempt := image.Attempts + 1
+	duration := sql.NullInt64{}
+
+	if !image.FetchedAt.IsZero() {
+		duration = sql.NullInt64{Int64: time.Since(image.FetchedAt).Milliseconds(), Valid: true}
+	}
+
+	_, err := l.db.ExecContext(
+		ctx,
+		"INSERT INTO `file_attempts` "+
+			"(`fk_file_id`, `attempt`, `outcome`, `error_code`, `last_error`, `duration_ms`, `bytes`, `created`) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		image.FileId,
+		attempt,
+		outcome,
+		sql.NullString{String: image.ErrorCode, Valid: image.ErrorCode != ""},
+		sql.NullString{String: image.LastError, Valid: image.LastError != ""},
+		duration,
+		image.FileSize,
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+	)
+
+	if err != nil || l.retain <= 0 || attempt <= int64(l.retain) {
+		return err
+	}
+
+	// Attempts are numbered in order, so everything older than the last
+	// Retain can go
+	_, err = l.db.ExecContext(
+		ctx,
+		"DELETE FROM `file_attempts` WHERE `fk_file_id` = ? AND `attempt` <= ?",
+		image.FileId,
+		attempt-int64(l.retain),
+	)
+
+	return err
+}
+
+// pruneAttempts deletes up to limit attempts logged before the given time and
+// returns how many went.
+func pruneAttempts(ctx context.Context, db *sql.DB, before time.Time, limit int) (int64, error) {
+	result, err := db.ExecContext(
+		ctx,
+		"DELETE FROM `file_attempts` WHERE `created` < ? LIMIT ?",
+		before.UTC().Format("2006-01-02 15:04:05"),
+		limit,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func countAttemptsBefore(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	var count int64
+
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM `file_attempts` WHERE `created` < ?",
+		before.UTC().Format("2006-01-02 15:04:05"),
+	).Scan(&count)
+
+	return count, err
+}
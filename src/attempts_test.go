@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAttemptLoggerRecordsAttempt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	image := AbtImage{FileId: 4, Attempts: 1, FileSize: 1234, FetchedAt: time.Now()}
+	setImageError(&image, errorCodeHttp5xx, errors.New("500 from source"))
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `file_attempts`")).
+		WithArgs(int64(4), int64(2), attemptOutcomeFetchFailed, errorCodeHttp5xx, "500 from source", sqlmock.AnyArg(), int64(1234), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	logger := &attemptLogger{db: db, retain: 5}
+
+	err = logger.record(context.Background(), image, attemptOutcomeFetchFailed)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttemptLoggerKeepsLatestAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `file_attempts`")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `file_attempts` WHERE `fk_file_id` = ? AND `attempt` <= ?")).
+		WithArgs(int64(4), int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	logger := &attemptLogger{db: db, retain: 3}
+
+	// The 6th attempt leaves attempts 4 to 6
+	err = logger.record(context.Background(), AbtImage{FileId: 4, Attempts: 5}, attemptOutcomeRetrieved)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNilAttemptLoggerRecordsNothing(t *testing.T) {
+	var logger *attemptLogger
+
+	err := logger.record(context.Background(), AbtImage{FileId: 4}, attemptOutcomeRetrieved)
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGcAttemptsDeletesInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := regexp.QuoteMeta("DELETE FROM `file_attempts` WHERE `created` < ? LIMIT ?")
+
+	mock.ExpectExec(query).WithArgs("2024-01-01 00:00:00", 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(query).WithArgs("2024-01-01 00:00:00", 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(query).WithArgs("2024-01-01 00:00:00", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = gcAttempts(context.Background(), db, before, 2, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGcAttemptsDryRunOnlyCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `file_attempts` WHERE `created` < ?")).
+		WithArgs("2024-01-01 00:00:00").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+
+	err = gcAttempts(context.Background(), db, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 100, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type auditedFile struct {
+	FileId      int64
+	IngestedUri string
+}
+
+func getRetrievedFilesFromDb(ctx context.Context, db *sql.DB, limit int) ([]auditedFile, error) {
+	var files []auditedFile
+
+	getRows, err := db.QueryContext(
+		ctx,
+		"SELECT pk_file_id, ingested_uri "+
+			"FROM rss_aggregator.files "+
+			"WHERE state = 'retrieved' "+
+			"AND ingested_uri IS NOT NULL "+
+			"ORDER BY created DESC "+
+			"LIMIT ?",
+		limit,
+	)
+
+	if err != nil {
+		return files, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		_ = getRows.Close()
+	}(getRows)
+
+	for getRows.Next() {
+		var file auditedFile
+
+		err = getRows.Scan(&file.FileId, &file.IngestedUri)
+
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, getRows.Err()
+}
+
+func objectExists(ctx context.Context, s3Client S3API, awsConfig AwsConfig, s3ObjectKey string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(awsConfig.RequestTimeout))
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	_, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(s3ObjectKey),
+	})
+
+	if err == nil {
+		return true, nil
+	}
+
+	var awsErr awserr.Error
+
+	if errors.As(err, &awsErr) && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func resetFileToPending(ctx context.Context, db *sql.DB, fileId int64) error {
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` SET `state` = 'pending', `ingested_uri` = NULL, `attempts` = 0, `modified` = ? WHERE `pk_file_id` = ?",
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		fileId,
+	)
+
+	return err
+}
+
+// auditMirrors checks a file's object is on each mirror, copying it over from
+// the primary when fix is set, and returns how many mirrors were missing it.
+func auditMirrors(ctx context.Context, s3Client S3API, config AppConfig, mirrors []uploadTarget, file auditedFile, fix bool) int {
+	missing := 0
+
+	for _, mirror := range mirrors {
+		exists, err := objectExists(ctx, mirror.client, mirror.awsConfig, file.IngestedUri)
+
+		if err != nil {
+			fmt.Println("could not check object for file", file.FileId, "on mirror", mirror.awsConfig.Name, err)
+			continue
+		}
+
+		if exists {
+			continue
+		}
+
+		missing++
+		fmt.Println("object missing for file", file.FileId, file.IngestedUri, "on mirror", mirror.awsConfig.Name)
+
+		if !fix {
+			continue
+		}
+
+		err = restoreMirrorObject(ctx, s3Client, config.Aws, mirror, file.IngestedUri, config.TempDir)
+
+		if err != nil {
+			fmt.Println("could not copy", file.IngestedUri, "to mirror", mirror.awsConfig.Name, err)
+			continue
+		}
+
+		fmt.Println("copied", file.IngestedUri, "to mirror", mirror.awsConfig.Name)
+	}
+
+	return missing
+}
+
+// runAudit checks that every retrieved file still has its object in the
+// bucket, and on each mirror, reporting the ones that are missing. With --fix
+// files missing from the bucket are reset to pending and processed straight
+// away, as the usual poll only picks up files created in the last two hours
+// and would never get to most of them. Mirrors missing an object get a copy of
+// the primary's.
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "reset files with a missing object back to pending")
+	limit := flags.Int("limit", 1000, "maximum number of retrieved files to check")
+	configPath := flags.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := makeDbConnection(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	s3Client, err := makeS3Client(config)
+
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := mirrorTargets(config.Aws)
+
+	if err != nil {
+		return err
+	}
+
+	if *fix {
+		err = prepareTempDir(config)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+
+	files, err := getRetrievedFilesFromDb(ctx, db, *limit)
+
+	if err != nil {
+		return err
+	}
+
+	missing := 0
+	missingFromMirrors := 0
+	var resetFileIds []int64
+
+	for _, file := range files {
+		exists, err := objectExists(ctx, s3Client, config.Aws, file.IngestedUri)
+
+		if err != nil {
+			fmt.Println("could not check object for file", file.FileId, err)
+			continue
+		}
+
+		// Processing a reset file again uploads it to the mirrors too, so
+		// they're only checked for files the primary still has
+		if exists {
+			missingFromMirrors += auditMirrors(ctx, s3Client, config, mirrors, file, *fix)
+			continue
+		}
+
+		missing++
+		fmt.Println("object missing for file", file.FileId, file.IngestedUri)
+
+		if *fix {
+			err = resetFileToPending(ctx, db, file.FileId)
+
+			if err != nil {
+				fmt.Println("could not reset file", file.FileId, err)
+				continue
+			}
+
+			fmt.Println("reset file", file.FileId, "to pending")
+			resetFileIds = append(resetFileIds, file.FileId)
+		}
+	}
+
+	fmt.Printf("audited %d files, %d missing from bucket, %d copies missing from mirrors\n", len(files), missing, missingFromMirrors)
+
+	for batchStart := 0; batchStart < len(resetFileIds); batchStart += config.BatchSize {
+		batchEnd := batchStart + config.BatchSize
+
+		if batchEnd > len(resetFileIds) {
+			batchEnd = len(resetFileIds)
+		}
+
+		err = start(*configPath, fileIdSource{fileIds: resetFileIds[batchStart:batchEnd]})
+
+		if err != nil {
+			return fmt.Errorf("could not process reset files: %w", err)
+		}
+	}
+
+	return nil
+}
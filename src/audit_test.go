@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// newTestS3Client is an S3 client sending its requests to handler, with path
+// style addressing so the bucket is the first part of the path.
+func newTestS3Client(t *testing.T, handler http.HandlerFunc) *s3.S3 {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	newSession, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s3.New(newSession)
+}
+
+func TestObjectExists(t *testing.T) {
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/media/present.jpg":
+			w.WriteHeader(http.StatusOK)
+		case "/bucket/media/missing.jpg":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	tests := []struct {
+		key        string
+		wantExists bool
+		wantErr    bool
+	}{
+		{"media/present.jpg", true, false},
+		{"media/missing.jpg", false, false},
+		{"media/forbidden.jpg", false, true},
+	}
+
+	for _, test := range tests {
+		exists, err := objectExists(context.Background(), s3Client, AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute)}, test.key)
+
+		if exists != test.wantExists || (err != nil) != test.wantErr {
+			t.Errorf("objectExists(%s) = %t, %v, want %t and error %t", test.key, exists, err, test.wantExists, test.wantErr)
+		}
+	}
+}
+
+func TestGetRetrievedFilesFromDb(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"pk_file_id", "ingested_uri"}).
+		AddRow(1, "/media/20240101/1-10.jpg").
+		AddRow(2, "/media/20240101/2-11.png")
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE state = 'retrieved'") + ".*" + regexp.QuoteMeta("LIMIT ?")).
+		WithArgs(50).
+		WillReturnRows(rows)
+
+	files, err := getRetrievedFilesFromDb(context.Background(), db, 50)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[1].FileId != 2 || files[1].IngestedUri != "/media/20240101/2-11.png" {
+		t.Errorf("unexpected files %+v", files)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResetFileToPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta("SET `state` = 'pending', `ingested_uri` = NULL, `attempts` = 0")).
+		WithArgs(sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = resetFileToPending(context.Background(), db, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// defaultCustomEndpointRegion is signed with when a custom S3-compatible
+// endpoint is used without a region. Most providers, DigitalOcean Spaces and
+// MinIO among them, accept it whatever region the bucket is in.
+const defaultCustomEndpointRegion = "us-east-1"
+
+// awsEndpointRegion picks the region out of a regional AWS endpoint such as
+// s3.eu-west-1.amazonaws.com or s3-eu-west-1.amazonaws.com.
+var awsEndpointRegion = regexp.MustCompile(`^s3[.-](?:dualstack\.)?([a-z0-9-]+)\.amazonaws\.com$`)
+
+// validateEndpoint checks the endpoint and region make sense together, filling
+// in a region for custom endpoints that don't need a particular one. Without
+// either the SDK finds the region itself, see newAwsSession. Settings that are
+// allowed but probably not what was meant are only warned about.
+func (c *AwsConfig) validateEndpoint() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+
+	// The SDK accepts endpoints with or without a scheme, defaulting to https
+	rawEndpoint := c.Endpoint
+
+	if !strings.Contains(rawEndpoint, "://") {
+		rawEndpoint = "https://" + rawEndpoint
+	}
+
+	endpoint, err := url.Parse(rawEndpoint)
+
+	if err != nil {
+		return fmt.Errorf("invalid aws.endpoint %q: %w", c.Endpoint, err)
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return fmt.Errorf("invalid aws.endpoint %q, expected an http or https URL", c.Endpoint)
+	}
+
+	if endpoint.Hostname() == "" || (endpoint.Path != "" && endpoint.Path != "/") || endpoint.RawQuery != "" {
+		return fmt.Errorf("invalid aws.endpoint %q, expected just a host and optional port", c.Endpoint)
+	}
+
+	if c.Region == "" {
+		fmt.Println("no aws.region set for endpoint", c.Endpoint, "signing requests for", defaultCustomEndpointRegion)
+		c.Region = defaultCustomEndpointRegion
+	}
+
+	match := awsEndpointRegion.FindStringSubmatch(strings.ToLower(endpoint.Hostname()))
+
+	if match != nil && match[1] != c.Region {
+		fmt.Println("warning: aws.endpoint", c.Endpoint, "is in", match[1], "but aws.region is", c.Region)
+	}
+
+	if c.UseAccelerate || c.UseDualStack {
+		fmt.Println("warning: aws.useAccelerate and aws.useDualStack are ignored with a custom aws.endpoint")
+	}
+
+	return nil
+}
+
+// newAwsSession creates a session in region, or when that's empty in the
+// region the SDK's default chain finds, from AWS_REGION or the shared config
+// file, as with credentials.
+func newAwsSession(awsConfig *aws.Config, region string) (*session.Session, error) {
+	if region != "" {
+		awsConfig.Region = aws.String(region)
+	}
+
+	newSession, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.StringValue(newSession.Config.Region) == "" {
+		return nil, errors.New("no aws.region set and none found in AWS_REGION or the shared AWS config")
+	}
+
+	return newSession, nil
+}
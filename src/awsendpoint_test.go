@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		endpoint   string
+		region     string
+		wantRegion string
+		wantErr    bool
+	}{
+		{"aws region", "", "eu-west-1", "eu-west-1", false},
+		{"neither, left to the sdk", "", "", "", false},
+		{"custom endpoint without region", "https://nyc3.digitaloceanspaces.com", "", defaultCustomEndpointRegion, false},
+		{"custom endpoint with region", "https://nyc3.digitaloceanspaces.com", "nyc3", "nyc3", false},
+		{"endpoint without scheme", "minio.internal:9000", "", defaultCustomEndpointRegion, false},
+		{"mismatched aws endpoint", "https://s3.eu-west-1.amazonaws.com", "us-east-1", "us-east-1", false},
+		{"unsupported scheme", "ftp://minio.internal", "", "", true},
+		{"endpoint with path", "https://minio.internal/bucket", "", "", true},
+		{"endpoint with query", "https://minio.internal/?x=1", "", "", true},
+		{"malformed endpoint", "https://[::1", "", "", true},
+	}
+
+	for _, test := range tests {
+		config := AwsConfig{Endpoint: test.endpoint, Region: test.region}
+		err := config.validateEndpoint()
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+
+		if err == nil && config.Region != test.wantRegion {
+			t.Errorf("%s: region is %q, want %q", test.name, config.Region, test.wantRegion)
+		}
+	}
+}
+
+func TestNewAwsSessionFallsBackToDefaultRegion(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_REGION", "eu-central-1")
+
+	newSession, err := newAwsSession(&aws.Config{}, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(newSession.Config.Region) != "eu-central-1" {
+		t.Errorf("got region %q, want the one from AWS_REGION", aws.StringValue(newSession.Config.Region))
+	}
+
+	newSession, err = newAwsSession(&aws.Config{}, "us-west-2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(newSession.Config.Region) != "us-west-2" {
+		t.Errorf("got region %q, want the configured one", aws.StringValue(newSession.Config.Region))
+	}
+
+	t.Setenv("AWS_REGION", "")
+
+	_, err = newAwsSession(&aws.Config{}, "")
+
+	if err == nil {
+		t.Error("session created without any region")
+	}
+}
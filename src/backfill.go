@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const backfillDateLayout = "2006-01-02"
+
+// backfillSource pages through the files created in a date range, whatever
+// their age, for re-ingesting them after a fix. Batches follow the file id so
+// files that stay in a backfilled state aren't picked up again. Stored files
+// are only fetched again if the source says they changed, unless refetch is
+// set.
+type backfillSource struct {
+	from       string
+	to         string
+	states     []string
+	refetch    bool
+	lastFileId int64
+	done       bool
+}
+
+func (s *backfillSource) usesDb() bool {
+	return true
+}
+
+func (s *backfillSource) loadImages(ctx context.Context, dbs dbPools, config AppConfig) ([]AbtImage, error) {
+	images, err := getBackfillImagesFromDb(ctx, dbs.read, s.from, s.to, s.states, s.lastFileId, config.BatchSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) < config.BatchSize {
+		s.done = true
+	}
+
+	if len(images) > 0 {
+		s.lastFileId = images[len(images)-1].FileId
+	}
+
+	if s.refetch {
+		dropValidators(images)
+	}
+
+	return images, nil
+}
+
+// backfillQuery selects the next batch of files created in [from, to) after a
+// file id, limited to the given states unless there are none.
+func backfillQuery(states []string) string {
+	query := "SELECT " + imageColumns +
+		"FROM rss_aggregator.files " +
+		"WHERE created >= ? " +
+		"AND created < ? " +
+		"AND pk_file_id > ? "
+
+	if len(states) > 0 {
+		query += "AND state IN (?" + strings.Repeat(", ?", len(states)-1) + ") "
+	}
+
+	return query + "ORDER BY pk_file_id LIMIT ?"
+}
+
+func getBackfillImagesFromDb(ctx context.Context, db *sql.DB, from string, to string, states []string, afterFileId int64, batchSize int) ([]AbtImage, error) {
+	args := []interface{}{from, to, afterFileId}
+
+	for _, state := range states {
+		args = append(args, state)
+	}
+
+	args = append(args, batchSize)
+
+	getRows, err := db.QueryContext(ctx, backfillQuery(states), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		_ = getRows.Close()
+	}(getRows)
+
+	return scanImageRows(getRows)
+}
+
+// parseBackfillStates splits the --states flag, where all means any state.
+func parseBackfillStates(value string) []string {
+	if value == "all" {
+		return nil
+	}
+
+	var states []string
+
+	for _, state := range strings.Split(value, ",") {
+		state = strings.TrimSpace(state)
+
+		if state != "" {
+			states = append(states, state)
+		}
+	}
+
+	return states
+}
+
+// overlapsClaims reports whether backfilling the given states, where none
+// means any, could pick up rows that instances claim.
+func overlapsClaims(states []string) bool {
+	if len(states) == 0 {
+		return true
+	}
+
+	for _, state := range states {
+		if state == "pending" || state == "processing" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runBackfill processes the files created between two dates in batches of
+// BatchSize through the normal pipeline, ignoring the usual two hour window.
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	fromFlag := flags.String("from", "", "first day to backfill, as YYYY-MM-DD")
+	toFlag := flags.String("to", "", "last day to backfill, as YYYY-MM-DD, defaults to today")
+	statesFlag := flags.String("states", "pending", "comma separated states of the files to backfill, or all for any state")
+	refetch := flags.Bool("refetch", false, "fetch stored files again in full even if the source says they haven't changed")
+	configPath := flags.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	if *fromFlag == "" {
+		return fmt.Errorf("--from is required")
+	}
+
+	from, err := time.Parse(backfillDateLayout, *fromFlag)
+
+	if err != nil {
+		return fmt.Errorf("invalid --from date %q, expected YYYY-MM-DD", *fromFlag)
+	}
+
+	to := time.Now()
+
+	if *toFlag != "" {
+		to, err = time.Parse(backfillDateLayout, *toFlag)
+
+		if err != nil {
+			return fmt.Errorf("invalid --to date %q, expected YYYY-MM-DD", *toFlag)
+		}
+	}
+
+	if to.Before(from) {
+		return fmt.Errorf("--to must not be before --from")
+	}
+
+	states := parseBackfillStates(*statesFlag)
+
+	if *statesFlag != "all" && len(states) == 0 {
+		return fmt.Errorf("--states needs at least one state, or all")
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		return err
+	}
+
+	// Running instances claim pending rows for themselves, which a backfill
+	// would process alongside them
+	if config.ClaimRows && overlapsClaims(states) {
+		return fmt.Errorf("--states must not include pending or processing files while claimRows is on")
+	}
+
+	err = prepareTempDir(config)
+
+	if err != nil {
+		return err
+	}
+
+	source := &backfillSource{
+		from:    from.Format(backfillDateLayout),
+		to:      to.AddDate(0, 0, 1).Format(backfillDateLayout),
+		states:  states,
+		refetch: *refetch,
+	}
+
+	for batch := 1; !source.done; batch++ {
+		fmt.Println("backfilling batch", batch)
+
+		err = start(*configPath, source)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("backfill finished")
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBackfillSourceKeepsValidatorsUnlessRefetching(t *testing.T) {
+	for _, refetch := range []bool{false, true} {
+		db, mock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The batches come from the read server, the primary isn't queried
+		primary, _, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows := sqlmock.NewRows(testImageColumns).
+			AddRow(1, 10, "https://example.com/a.jpg", "image", "retrieved", "2024-01-01 00:00:00", 1, "https://test.s3.amazonaws.com/a.jpg", `"v1"`, "Mon, 01 Jan 2024 00:00:00 GMT").
+			AddRow(2, 11, "https://example.com/b.jpg", "image", "failed", "2024-01-01 00:00:00", 3, nil, nil, nil)
+
+		mock.ExpectQuery(regexp.QuoteMeta("AND state IN (?, ?)")).
+			WithArgs("2024-01-01", "2024-01-02", int64(0), "retrieved", "failed", 2).
+			WillReturnRows(rows)
+
+		source := &backfillSource{from: "2024-01-01", to: "2024-01-02", states: []string{"retrieved", "failed"}, refetch: refetch}
+
+		images, err := source.loadImages(context.Background(), dbPools{read: db, write: primary}, AppConfig{BatchSize: 2})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(images) != 2 {
+			t.Fatalf("got %d images, want 2", len(images))
+		}
+
+		kept := images[0].ETag != "" && images[0].LastModified != ""
+
+		if kept == refetch {
+			t.Errorf("refetch %t: got etag %q and last modified %q", refetch, images[0].ETag, images[0].LastModified)
+		}
+
+		// Only the stored file has an object for a failed refresh to fall back on
+		if images[0].StoredS3Url != "https://test.s3.amazonaws.com/a.jpg" || images[1].StoredS3Url != "" {
+			t.Errorf("got stored objects %q and %q", images[0].StoredS3Url, images[1].StoredS3Url)
+		}
+
+		// A full batch may not be the last one
+		if source.done || source.lastFileId != 2 {
+			t.Errorf("source done %t after file %d, want not done after 2", source.done, source.lastFileId)
+		}
+
+		err = mock.ExpectationsWereMet()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		_ = db.Close()
+		_ = primary.Close()
+	}
+}
+
+func TestBackfillQuery(t *testing.T) {
+	if query := backfillQuery(nil); regexp.MustCompile(`state IN`).MatchString(query) {
+		t.Errorf("got %q, want no state filter for all states", query)
+	}
+
+	if query := backfillQuery([]string{"pending", "failed", "rejected"}); !regexp.MustCompile(`AND state IN \(\?, \?, \?\) ORDER BY pk_file_id LIMIT \?$`).MatchString(query) {
+		t.Errorf("got %q, want a placeholder for each state", query)
+	}
+}
+
+func TestParseBackfillStates(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"all", nil},
+		{"pending", []string{"pending"}},
+		{" pending, failed ,", []string{"pending", "failed"}},
+		{",", nil},
+	}
+
+	for _, test := range tests {
+		got := parseBackfillStates(test.value)
+
+		if len(got) != len(test.want) {
+			t.Errorf("parseBackfillStates(%q) = %v, want %v", test.value, got, test.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("parseBackfillStates(%q) = %v, want %v", test.value, got, test.want)
+			}
+		}
+	}
+}
+
+func TestOverlapsClaims(t *testing.T) {
+	tests := []struct {
+		states []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{"pending"}, true},
+		{[]string{"failed", "processing"}, true},
+		{[]string{"failed"}, false},
+		{[]string{"retrieved", "rejected"}, false},
+	}
+
+	for _, test := range tests {
+		got := overlapsClaims(test.states)
+
+		if got != test.want {
+			t.Errorf("overlapsClaims(%v) = %t, want %t", test.states, got, test.want)
+		}
+	}
+}
+
+func TestRunBackfillRejectsBadFlags(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"--from", "01/01/2024"},
+		{"--from", "2024-01-02", "--to", "2024-01-01"},
+		{"--from", "2024-01-01", "--states", ","},
+	}
+
+	for _, args := range tests {
+		// Checked before the config is read, so no config or db is needed
+		if err := runBackfill(args); err == nil {
+			t.Errorf("runBackfill(%v) should have failed", args)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CacheConfig struct {
+	Dir      string   `json:"dir"`
+	TTL      Duration `json:"ttl"`
+	MaxBytes int64    `json:"maxBytes"`
+}
+
+type cacheEntry struct {
+	Url          string `json:"url"`
+	MimeType     string `json:"mimeType"`
+	FileExt      string `json:"fileExt"`
+	FileCategory string `json:"fileCategory"`
+	FileSize     int64  `json:"fileSize"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
+
+// fileCache keeps recently downloaded files on disk so a URL that turns up
+// again in a later run doesn't have to be fetched again. Each file is stored
+// under the hash of its URL next to a .json file describing it. Entries expire
+// after the TTL, and the least recently used ones are evicted once the cache
+// grows past MaxBytes. The directory is read once when the cache is opened;
+// after that the entries are tracked in memory, most recently used first.
+type fileCache struct {
+	config      CacheConfig
+	stripParams []string
+	mutex       sync.Mutex
+	lru         *list.List
+	files       map[string]*list.Element
+	totalSize   int64
+}
+
+type cachedFile struct {
+	key      string
+	entry    cacheEntry
+	size     int64
+	storedAt time.Time
+}
+
+// newFileCache returns nil when no cache directory is configured, which
+// disables caching. URLs are looked up by their normalized form, with
+// stripParams removed.
+func newFileCache(config CacheConfig, stripParams []string) (*fileCache, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCache{
+		config:      config,
+		stripParams: stripParams,
+		lru:         list.New(),
+		files:       map[string]*list.Element{},
+	}
+
+	err = c.scan()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// scan picks up the entries left by earlier runs, ordered by when they were
+// last used, and removes anything expired or incomplete.
+func (c *fileCache) scan() error {
+	dirEntries, err := os.ReadDir(c.config.Dir)
+
+	if err != nil {
+		return err
+	}
+
+	type scannedFile struct {
+		file     *cachedFile
+		lastUsed time.Time
+	}
+
+	var scanned []scannedFile
+
+	for _, dirEntry := range dirEntries {
+		key := dirEntry.Name()
+
+		if strings.HasSuffix(key, ".json") {
+			continue
+		}
+
+		dataInfo, err := dirEntry.Info()
+
+		if err != nil {
+			continue
+		}
+
+		metaInfo, err := os.Stat(c.metaPath(key))
+
+		if err != nil {
+			// Uploads interrupted before their metadata was written
+			c.remove(key)
+			continue
+		}
+
+		encodedJson, err := os.ReadFile(c.metaPath(key))
+
+		if err != nil {
+			continue
+		}
+
+		var entry cacheEntry
+
+		err = json.Unmarshal(encodedJson, &entry)
+
+		if err != nil || cacheKey(entry.Url) != key || c.expired(dataInfo.ModTime()) {
+			c.remove(key)
+			continue
+		}
+
+		scanned = append(scanned, scannedFile{
+			file:     &cachedFile{key: key, entry: entry, size: dataInfo.Size(), storedAt: dataInfo.ModTime()},
+			lastUsed: metaInfo.ModTime(),
+		})
+	}
+
+	sort.Slice(scanned, func(i, j int) bool {
+		return scanned[i].lastUsed.After(scanned[j].lastUsed)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, s := range scanned {
+		c.files[s.file.key] = c.lru.PushBack(s.file)
+		c.totalSize += s.file.size
+	}
+
+	c.evict()
+
+	return nil
+}
+
+func (c *fileCache) expired(storedAt time.Time) bool {
+	return c.config.TTL > 0 && time.Since(storedAt) > time.Duration(c.config.TTL)
+}
+
+func cacheKey(normalizedUrl string) string {
+	sum := sha256.Sum256([]byte(normalizedUrl))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *fileCache) dataPath(key string) string {
+	return filepath.Join(c.config.Dir, key)
+}
+
+func (c *fileCache) metaPath(key string) string {
+	return filepath.Join(c.config.Dir, key+".json")
+}
+
+func copyFile(dst string, src string) (int64, error) {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+
+	out, err := os.Create(dst)
+
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(out, in)
+	closeErr := out.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+
+	return written, err
+}
+
+// lookup finds the unexpired entry for a URL and marks it as just used.
+func (c *fileCache) lookup(key string, normalizedUrl string) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.files[key]
+
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	file := element.Value.(*cachedFile)
+
+	if c.expired(file.storedAt) {
+		c.removeElement(element)
+		return cacheEntry{}, false
+	}
+
+	if file.entry.Url != normalizedUrl {
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(element)
+
+	return file.entry, true
+}
+
+// load copies a cached, unexpired copy of the image's URL to its local
+// filename in tempDir. It reports false when there is no usable entry.
+func (c *fileCache) load(image *AbtImage, tempDir string) bool {
+	normalizedUrl := normalizeUrl(image.ExternalUrl, c.stripParams)
+	key := cacheKey(normalizedUrl)
+	entry, ok := c.lookup(key, normalizedUrl)
+
+	if !ok {
+		return false
+	}
+
+	image.MimeType = entry.MimeType
+	image.FileExt = entry.FileExt
+	image.FileCategory = entry.FileCategory
+	image.ETag = entry.ETag
+	image.LastModified = entry.LastModified
+	err := setIngestedFilename(image, tempDir)
+
+	if err != nil {
+		fmt.Println("ignoring cached file for", image.ExternalUrl, err)
+		return false
+	}
+
+	image.FileSize, err = copyFile(image.LocalFilename, c.dataPath(key))
+
+	if err != nil {
+		fmt.Println("could not copy cached file for", image.ExternalUrl, err)
+		return false
+	}
+
+	// The TTL is counted from when the entry was stored, so the last use is
+	// kept on the metadata file for ordering the entries after a restart
+	now := time.Now()
+	_ = os.Chtimes(c.metaPath(key), now, now)
+
+	return true
+}
+
+// store adds a freshly downloaded image to the cache and evicts whatever no
+// longer fits. The file is copied in under a temporary name first, so the
+// lock is only held while it's renamed into place.
+func (c *fileCache) store(image AbtImage) error {
+	normalizedUrl := normalizeUrl(image.ExternalUrl, c.stripParams)
+	key := cacheKey(normalizedUrl)
+	entry := cacheEntry{
+		Url:          normalizedUrl,
+		MimeType:     image.MimeType,
+		FileExt:      image.FileExt,
+		FileCategory: image.FileCategory,
+		FileSize:     image.FileSize,
+		ETag:         image.ETag,
+		LastModified: image.LastModified,
+	}
+
+	encodedJson, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(c.config.Dir, "tmp-")
+
+	if err != nil {
+		return err
+	}
+
+	_ = tempFile.Close()
+	size, err := copyFile(tempFile.Name(), image.LocalFilename)
+
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.files[key]; ok {
+		c.removeElement(element)
+	}
+
+	err = os.Rename(tempFile.Name(), c.dataPath(key))
+
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+
+	err = os.WriteFile(c.metaPath(key), encodedJson, 0644)
+
+	if err != nil {
+		c.remove(key)
+		return err
+	}
+
+	c.files[key] = c.lru.PushFront(&cachedFile{key: key, entry: entry, size: size, storedAt: time.Now()})
+	c.totalSize += size
+	c.evict()
+
+	return nil
+}
+
+func (c *fileCache) remove(key string) {
+	_ = os.Remove(c.dataPath(key))
+	_ = os.Remove(c.metaPath(key))
+}
+
+func (c *fileCache) removeElement(element *list.Element) {
+	file := c.lru.Remove(element).(*cachedFile)
+	delete(c.files, file.key)
+	c.totalSize -= file.size
+	c.remove(file.key)
+}
+
+// evict removes the least recently used entries until the cache is within
+// MaxBytes. Expired entries are dropped when they're next looked up, or
+// earlier if they're the least recently used.
+func (c *fileCache) evict() {
+	if c.config.MaxBytes <= 0 {
+		return
+	}
+
+	for c.totalSize > c.config.MaxBytes && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// downloadedImage is an image as downloadImage leaves it, with testPng saved
+// in the working dir.
+func downloadedImage(t *testing.T, rawUrl string) AbtImage {
+	t.Helper()
+
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{FileId: nextTestFileId(), ExternalUrl: u, MimeType: "image/png", FileExt: ".png", FileCategory: "image"}
+	setIngestedFilename(&image, ".")
+
+	err = os.WriteFile(image.LocalFilename, testPng, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image.FileSize = int64(len(testPng))
+
+	return image
+}
+
+var testFileId int64
+
+// nextTestFileId keeps the local filenames of images in the same test apart.
+func nextTestFileId() int64 {
+	testFileId++
+	return testFileId
+}
+
+func newTestCache(t *testing.T, config CacheConfig) *fileCache {
+	t.Helper()
+
+	cache, err := newFileCache(config, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache
+}
+
+func cachedImage(t *testing.T, cache *fileCache, rawUrl string) (AbtImage, bool) {
+	t.Helper()
+
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{FileId: nextTestFileId(), ExternalUrl: u}
+	ok := cache.load(&image, ".")
+
+	return image, ok
+}
+
+func TestFileCacheHit(t *testing.T) {
+	chdirTemp(t)
+	cache := newTestCache(t, CacheConfig{Dir: t.TempDir()})
+
+	err := cache.store(downloadedImage(t, "https://example.com/a.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, ok := cachedImage(t, cache, "https://example.com/a.png")
+
+	if !ok {
+		t.Fatal("stored url wasn't found in the cache")
+	}
+
+	data, err := os.ReadFile(image.LocalFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(testPng) || image.MimeType != "image/png" || image.FileExt != ".png" || image.FileSize != int64(len(testPng)) {
+		t.Errorf("unexpected cached image %+v", image)
+	}
+
+	_, ok = cachedImage(t, cache, "https://example.com/b.png")
+
+	if ok {
+		t.Error("url that wasn't stored was found in the cache")
+	}
+}
+
+func TestFileCacheKeepsValidators(t *testing.T) {
+	chdirTemp(t)
+	cache := newTestCache(t, CacheConfig{Dir: t.TempDir()})
+
+	stored := downloadedImage(t, "https://example.com/a.png")
+	stored.ETag = `"v1"`
+	stored.LastModified = "Mon, 01 Jan 2024 00:00:00 GMT"
+
+	err := cache.store(stored)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Otherwise the row would lose them on a hit, and the next time the file
+	// comes up it would be fetched and uploaded again in full
+	image, ok := cachedImage(t, cache, "https://example.com/a.png")
+
+	if !ok || image.ETag != stored.ETag || image.LastModified != stored.LastModified {
+		t.Errorf("got validators %q, %q, want %q, %q", image.ETag, image.LastModified, stored.ETag, stored.LastModified)
+	}
+}
+
+func TestFileCacheExpires(t *testing.T) {
+	chdirTemp(t)
+
+	dir := t.TempDir()
+	cache := newTestCache(t, CacheConfig{Dir: dir, TTL: Duration(time.Millisecond)})
+
+	err := cache.store(downloadedImage(t, "https://example.com/a.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := cachedImage(t, cache, "https://example.com/a.png")
+
+	if ok {
+		t.Error("expired entry was used")
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 || cache.totalSize != 0 {
+		t.Errorf("expired entry left %d files and %d bytes behind", len(entries), cache.totalSize)
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	chdirTemp(t)
+
+	cache := newTestCache(t, CacheConfig{Dir: t.TempDir(), MaxBytes: int64(2 * len(testPng))})
+
+	for _, rawUrl := range []string{"https://example.com/a.png", "https://example.com/b.png"} {
+		err := cache.store(downloadedImage(t, rawUrl))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Using a makes b the least recently used
+	_, ok := cachedImage(t, cache, "https://example.com/a.png")
+
+	if !ok {
+		t.Fatal("a wasn't cached")
+	}
+
+	err := cache.store(downloadedImage(t, "https://example.com/c.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rawUrl, want := range map[string]bool{
+		"https://example.com/a.png": true,
+		"https://example.com/b.png": false,
+		"https://example.com/c.png": true,
+	} {
+		_, ok := cachedImage(t, cache, rawUrl)
+
+		if ok != want {
+			t.Errorf("%s cached = %t, want %t", rawUrl, ok, want)
+		}
+	}
+
+	if cache.totalSize != int64(2*len(testPng)) {
+		t.Errorf("cache holds %d bytes, want %d", cache.totalSize, 2*len(testPng))
+	}
+}
+
+func TestFileCacheReopens(t *testing.T) {
+	chdirTemp(t)
+
+	dir := t.TempDir()
+	cache := newTestCache(t, CacheConfig{Dir: dir})
+
+	err := cache.store(downloadedImage(t, "https://example.com/a.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy that was interrupted before being renamed into place
+	err = os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newTestCache(t, CacheConfig{Dir: dir})
+
+	if reopened.totalSize != int64(len(testPng)) || reopened.lru.Len() != 1 {
+		t.Errorf("reopened cache has %d entries and %d bytes, want 1 and %d", reopened.lru.Len(), reopened.totalSize, len(testPng))
+	}
+
+	_, ok := cachedImage(t, reopened, "https://example.com/a.png")
+
+	if !ok {
+		t.Error("entry wasn't found after reopening")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "tmp-123"))
+
+	if !os.IsNotExist(err) {
+		t.Error("interrupted copy wasn't removed")
+	}
+}
+
+func TestFetchStoreImageFromUrlChecksCachedCopy(t *testing.T) {
+	chdirTemp(t)
+
+	cache := newTestCache(t, CacheConfig{Dir: t.TempDir()})
+
+	err := cache.store(downloadedImage(t, "https://example.com/a.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse("https://example.com/a.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A size that's over the current limit is rejected rather than served
+	// from the cache
+	config := AppConfig{MaxFileSize: 16}
+	setConfigDefaults(&config)
+	image := AbtImage{FileId: 1, ExternalUrl: u}
+
+	err = fetchStoreImageFromUrl(context.Background(), nil, config, cache, &image)
+
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("got %v, want a file too large error", err)
+	}
+
+	if image.LocalFilename != "" {
+		_, statErr := os.Stat(image.LocalFilename)
+
+		if !os.IsNotExist(statErr) {
+			t.Error("rejected cached copy was left in the working dir")
+		}
+	}
+
+	// A host that's no longer allowed is refused before the cache is looked at
+	config = AppConfig{MaxFileSize: 1024, AllowedHosts: []string{"example.org"}}
+	setConfigDefaults(&config)
+	image = AbtImage{FileId: 2, ExternalUrl: u}
+
+	err = fetchStoreImageFromUrl(context.Background(), nil, config, cache, &image)
+
+	if err == nil || image.LocalFilename != "" {
+		t.Errorf("got %v with %q, want the url refused without loading the cached copy", err, image.LocalFilename)
+	}
+
+	// Within the limits the cached copy is used without a fetch
+	config = AppConfig{MaxFileSize: 1024}
+	setConfigDefaults(&config)
+	image = AbtImage{FileId: 3, ExternalUrl: u}
+
+	err = fetchStoreImageFromUrl(context.Background(), nil, config, cache, &image)
+
+	if err != nil || image.LocalFilename == "" {
+		t.Errorf("got %v with %q, want the cached copy", err, image.LocalFilename)
+	}
+}
+
+func TestFileCacheMatchesNormalizedUrl(t *testing.T) {
+	chdirTemp(t)
+
+	cache, err := newFileCache(CacheConfig{Dir: t.TempDir()}, defaultStripQueryParams)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.store(downloadedImage(t, "https://example.com/a.png?w=640"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := cachedImage(t, cache, "https://EXAMPLE.com/a.png?utm_source=rss&w=640#top")
+
+	if !ok {
+		t.Error("url differing only in tracking params, case and fragment missed the cache")
+	}
+
+	_, ok = cachedImage(t, cache, "https://example.com/a.png?w=320")
+
+	if ok {
+		t.Error("url with a different size param was served from the cache")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type hostCircuit struct {
+	failures    int
+	lastFailure time.Time
+	open        bool
+	openedAt    time.Time
+	halfOpen    bool
+}
+
+// circuitBreaker stops fetching from hosts that look to be down. After
+// CircuitThreshold failures in a row, each within CircuitCooldown of the last,
+// a host's circuit opens and its files are skipped until the cooldown passes.
+// A single fetch is then let through to probe the host: success closes the
+// circuit and failure keeps it open for another cooldown. State is kept for
+// the life of the service so an outage is remembered between runs.
+type circuitBreaker struct {
+	mutex sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+var hostCircuits = newCircuitBreaker()
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		hosts: make(map[string]*hostCircuit),
+	}
+}
+
+// allow reports whether a fetch from host may go ahead.
+func (b *circuitBreaker) allow(host string, cooldown time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	circuit, ok := b.hosts[strings.ToLower(host)]
+
+	if !ok || !circuit.open {
+		return true
+	}
+
+	if time.Since(circuit.openedAt) < cooldown {
+		return false
+	}
+
+	// Restarting the cooldown lets only this fetch through, and another probe
+	// after it if this one never reports back
+	circuit.openedAt = time.Now()
+	circuit.halfOpen = true
+	fmt.Println("circuit half open for", host, "probing with one fetch")
+
+	return true
+}
+
+func (b *circuitBreaker) recordSuccess(host string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	host = strings.ToLower(host)
+	circuit, ok := b.hosts[host]
+
+	if !ok {
+		return
+	}
+
+	if circuit.open {
+		fmt.Println("circuit closed for", host)
+	}
+
+	delete(b.hosts, host)
+}
+
+func (b *circuitBreaker) recordFailure(host string, threshold int, cooldown time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	host = strings.ToLower(host)
+	circuit, ok := b.hosts[host]
+
+	if !ok {
+		circuit = &hostCircuit{}
+		b.hosts[host] = circuit
+	}
+
+	now := time.Now()
+
+	if circuit.halfOpen {
+		circuit.halfOpen = false
+		circuit.openedAt = now
+		fmt.Println("circuit stays open for", host, "as the probe failed")
+		return
+	}
+
+	// Fetches that started before the circuit opened
+	if circuit.open {
+		return
+	}
+
+	if now.Sub(circuit.lastFailure) > cooldown {
+		circuit.failures = 0
+	}
+
+	circuit.failures++
+	circuit.lastFailure = now
+
+	if circuit.failures >= threshold {
+		circuit.open = true
+		circuit.openedAt = now
+		fmt.Println("circuit open for", host, "after", circuit.failures, "failures in a row, skipping it for", cooldown)
+	}
+}
+
+// isHostFailure reports whether a fetch error suggests the host itself is in
+// trouble, rather than the file. A 404, an unchanged file or a rejected type
+// shows the host is up, so only server errors, timeouts and failed
+// connections count.
+func isHostFailure(err error) bool {
+	var statusErr *httpStatusError
+	var netErr net.Error
+
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
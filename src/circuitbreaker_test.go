@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const testCooldown = 50 * time.Millisecond
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker := newCircuitBreaker()
+
+	breaker.recordFailure("example.com", 3, testCooldown)
+	breaker.recordFailure("example.com", 3, testCooldown)
+
+	if !breaker.allow("example.com", testCooldown) {
+		t.Fatal("circuit opened before the threshold")
+	}
+
+	breaker.recordFailure("EXAMPLE.com", 3, testCooldown)
+
+	if breaker.allow("example.com", testCooldown) {
+		t.Error("circuit still closed after 3 failures")
+	}
+
+	if !breaker.allow("example.org", testCooldown) {
+		t.Error("another host's fetches were stopped")
+	}
+}
+
+func TestCircuitBreakerForgetsOldFailures(t *testing.T) {
+	breaker := newCircuitBreaker()
+
+	breaker.recordFailure("example.com", 2, testCooldown)
+	time.Sleep(2 * testCooldown)
+	breaker.recordFailure("example.com", 2, testCooldown)
+
+	if !breaker.allow("example.com", testCooldown) {
+		t.Error("failures further apart than the cooldown opened the circuit")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	breaker := newCircuitBreaker()
+
+	breaker.recordFailure("example.com", 2, testCooldown)
+	breaker.recordSuccess("example.com")
+	breaker.recordFailure("example.com", 2, testCooldown)
+
+	if !breaker.allow("example.com", testCooldown) {
+		t.Error("failures either side of a success opened the circuit")
+	}
+}
+
+func TestCircuitBreakerProbesAfterCooldown(t *testing.T) {
+	breaker := newCircuitBreaker()
+	breaker.recordFailure("example.com", 1, testCooldown)
+
+	if breaker.allow("example.com", testCooldown) {
+		t.Fatal("circuit didn't open")
+	}
+
+	time.Sleep(testCooldown + 10*time.Millisecond)
+
+	// Half open, only one fetch goes through to probe the host
+	if !breaker.allow("example.com", testCooldown) {
+		t.Fatal("no probe let through after the cooldown")
+	}
+
+	if breaker.allow("example.com", testCooldown) {
+		t.Fatal("second fetch let through while probing")
+	}
+
+	// A failed probe keeps it open for another cooldown
+	breaker.recordFailure("example.com", 1, testCooldown)
+
+	if breaker.allow("example.com", testCooldown) {
+		t.Fatal("circuit closed after the probe failed")
+	}
+
+	time.Sleep(testCooldown + 10*time.Millisecond)
+
+	if !breaker.allow("example.com", testCooldown) {
+		t.Fatal("no probe let through after the second cooldown")
+	}
+
+	// A successful probe closes it
+	breaker.recordSuccess("example.com")
+
+	for i := 0; i < 3; i++ {
+		if !breaker.allow("example.com", testCooldown) {
+			t.Fatal("circuit still open after the probe succeeded")
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresFailuresWhileOpen(t *testing.T) {
+	breaker := newCircuitBreaker()
+	breaker.recordFailure("example.com", 1, testCooldown)
+
+	// Fetches that started before it opened keep failing
+	time.Sleep(testCooldown / 2)
+	breaker.recordFailure("example.com", 1, testCooldown)
+	time.Sleep(testCooldown/2 + 10*time.Millisecond)
+
+	if !breaker.allow("example.com", testCooldown) {
+		t.Error("late failures extended the cooldown")
+	}
+}
+
+func TestIsHostFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"500", &httpStatusError{StatusCode: 500}, true},
+		{"503 wrapped", &FetchError{Url: "https://example.com/a.jpg", Err: &httpStatusError{StatusCode: 503}}, true},
+		{"429", &httpStatusError{StatusCode: 429}, true},
+		{"404", &httpStatusError{StatusCode: 404}, false},
+		{"timeout", fmt.Errorf("fetching: %w", context.DeadlineExceeded), true},
+		{"disallowed type", &DisallowedMimeError{MimeType: "text/html"}, false},
+		{"too large", fmt.Errorf("%w: image/png (9999 bytes)", ErrFileTooLarge), false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"not modified", ErrNotModified, false},
+		{"invalid image", errors.New("could not strip exif"), false},
+	}
+
+	for _, test := range tests {
+		got := isHostFailure(test.err)
+
+		if got != test.want {
+			t.Errorf("%s: isHostFailure(%v) = %t, want %t", test.name, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func defaultWorkerId() string {
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// releaseStaleClaims puts rows back to pending when the instance that claimed
+// them hasn't finished within claimTimeout, e.g. because it crashed.
+func releaseStaleClaims(ctx context.Context, db *sql.DB, claimTimeout time.Duration) (int64, error) {
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `state` = 'pending', `worker_id` = NULL, `claimed_at` = NULL "+
+			"WHERE `state` = 'processing' "+
+			"AND `claimed_at` < now() - INTERVAL ? SECOND",
+		int64(claimTimeout.Seconds()),
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// claimToken identifies one run's claim. Rows an earlier run of the same
+// worker left processing carry a different token, so they aren't picked up
+// again and are left for releaseStaleClaims.
+func claimToken(workerId string) string {
+	return workerId + "/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// claimImages atomically marks up to limit pending rows as processing by this
+// run and returns them, so concurrent instances always get disjoint sets.
+func claimImages(ctx context.Context, db *sql.DB, workerId string, limit int) ([]AbtImage, error) {
+	token := claimToken(workerId)
+
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `state` = 'processing', `worker_id` = ?, `claimed_at` = now() "+
+			"WHERE `state` = 'pending' "+
+			"AND `created` >= now() - INTERVAL 2 hour "+
+			"ORDER BY `created` DESC "+
+			"LIMIT ?",
+		token,
+		limit,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	getRows, err := db.QueryContext(
+		ctx,
+		"SELECT "+imageColumns+
+			"FROM rss_aggregator.files "+
+			"WHERE state = 'processing' "+
+			"AND worker_id = ? "+
+			"ORDER BY created DESC "+
+			"LIMIT ?",
+		token,
+		limit,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		_ = getRows.Close()
+	}(getRows)
+
+	images, err := scanImageRows(getRows)
+
+	// Claimed rows go back to pending unless processing marks them retrieved
+	// or failed.
+	for i := range images {
+		images[i].State = "pending"
+	}
+
+	return images, err
+}
+
+// releaseClaim hands a claimed row that wasn't processed back to pending.
+func releaseClaim(ctx context.Context, db *sql.DB, fileId int64) error {
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `state` = 'pending', `worker_id` = NULL, `claimed_at` = NULL "+
+			"WHERE `pk_file_id` = ? "+
+			"AND `state` = 'processing'",
+		fileId,
+	)
+
+	return err
+}
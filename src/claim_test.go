@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClaimImagesOnlySelectsThisRunsClaim(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var token string
+
+	mock.ExpectExec(regexp.QuoteMeta("SET `state` = 'processing', `worker_id` = ?")).
+		WithArgs(tokenArg{&token, "worker-1/"}, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectQuery(regexp.QuoteMeta("AND worker_id = ? ")+".*"+regexp.QuoteMeta("LIMIT ?")).
+		WithArgs(tokenArg{&token, "worker-1/"}, 10).
+		WillReturnRows(sqlmock.NewRows(testImageColumns).
+			AddRow(5, 6, "https://example.com/a.jpg", nil, "processing", "2024-01-01 00:00:00", 0, nil, nil, nil))
+
+	images, err := claimImages(context.Background(), db, "worker-1", 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].FileId != 5 || images[0].State != "pending" {
+		t.Errorf("unexpected claimed images %+v", images)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClaimTokenDiffersPerRun(t *testing.T) {
+	first := claimToken("worker-1")
+	second := claimToken("worker-1")
+
+	if first == second || !strings.HasPrefix(first, "worker-1/") {
+		t.Errorf("tokens %q and %q should be distinct and start with the worker id", first, second)
+	}
+}
+
+// tokenArg matches the claim token, which is random, and checks the update
+// and select are given the same one.
+type tokenArg struct {
+	token  *string
+	prefix string
+}
+
+func (a tokenArg) Match(v driver.Value) bool {
+	value, ok := v.(string)
+
+	if !ok || !strings.HasPrefix(value, a.prefix) {
+		return false
+	}
+
+	if *a.token == "" {
+		*a.token = value
+	}
+
+	return *a.token == value
+}
+
+func TestReleaseStaleClaims(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta("SET `state` = 'pending', `worker_id` = NULL, `claimed_at` = NULL") + ".*" + regexp.QuoteMeta("INTERVAL ? SECOND")).
+		WithArgs(1800).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	released, err := releaseStaleClaims(context.Background(), db, 30*time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if released != 3 {
+		t.Errorf("released %d claims, want 3", released)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaCloner carries everything a run needs to process a batch of files. The
+// database, S3 and HTTP clients are passed in rather than created here so they
+// can be swapped out, e.g. for fakes.
+type mediaCloner struct {
+	config     AppConfig
+	db         *sql.DB
+	s3Client   S3API
+	httpClient *http.Client
+	solrClient *http.Client
+	limiter    *hostLimiter
+	circuits   *circuitBreaker
+	notifier   *alertNotifier
+	summary    *RunSummary
+	cache      *fileCache
+	publisher  Publisher
+	attempts   *attemptLogger
+	updater    *imageRefUpdater
+	mirrors    []uploadTarget
+
+	// resultCtx is used to record the outcome of each file. Unlike the context
+	// the pipeline runs under it has no deadline, so work that finished before
+	// RunTimeout is still saved.
+	resultCtx context.Context
+
+	// duplicates holds the rows of the batch whose URL is already being
+	// fetched for an earlier row, keyed by the normalized URL
+	duplicates map[string][]AbtImage
+
+	storedImagesMutex sync.Mutex
+	storedImages      []AbtImage
+
+	// fetchedBytes counts what this run has downloaded, against MaxBytesPerRun
+	fetchedBytesMutex sync.Mutex
+	fetchedBytes      int64
+}
+
+func newMediaCloner(config AppConfig, db *sql.DB, s3Client S3API, httpClient *http.Client, solrClient *http.Client) *mediaCloner {
+	return &mediaCloner{
+		config:     config,
+		db:         db,
+		s3Client:   s3Client,
+		httpClient: httpClient,
+		solrClient: solrClient,
+		limiter:    newHostLimiter(config.MaxPerHostConcurrency, config.PerHostRatePerSec),
+		circuits:   hostCircuits,
+		notifier:   newAlertNotifier(config.AlertWebhook, nil),
+		summary:    newRunSummary(),
+	}
+}
+
+// overBudget reports whether the run has downloaded MaxBytesPerRun, after
+// which no more files are fetched. Files already being fetched still finish,
+// so the budget can be overshot by up to FetchWorkers files.
+func (c *mediaCloner) overBudget() bool {
+	c.fetchedBytesMutex.Lock()
+	defer c.fetchedBytesMutex.Unlock()
+
+	return c.config.MaxBytesPerRun > 0 && c.fetchedBytes >= c.config.MaxBytesPerRun
+}
+
+func (c *mediaCloner) addFetchedBytes(fileSize int64) {
+	c.fetchedBytesMutex.Lock()
+	defer c.fetchedBytesMutex.Unlock()
+
+	if fileSize > 0 {
+		c.fetchedBytes += fileSize
+	}
+}
+
+func (c *mediaCloner) fetchImage(ctx context.Context, image *AbtImage) bool {
+	if ctx.Err() != nil || c.overBudget() {
+		c.leavePending(image)
+		return false
+	}
+
+	host := image.ExternalUrl.Hostname()
+
+	if c.config.CircuitThreshold > 0 && !c.circuits.allow(host, time.Duration(c.config.CircuitCooldown)) {
+		fmt.Println("circuit open for", host, "skipping", image.ExternalUrl)
+		c.leavePending(image)
+		return false
+	}
+
+	timedOut := false
+	release, err := c.limiter.acquire(ctx, host)
+
+	if err == nil {
+		span := startStageSpan(ctx, *image, "fetch")
+		imageCtx, cancel := c.imageContext(ctx)
+		err = fetchStoreImageFromUrl(imageCtx, c.httpClient, c.config, c.cache, image)
+		timedOut = err != nil && imageCtx.Err() != nil
+		cancel()
+		release()
+		span.End()
+
+		// The run ending says nothing about the host
+		if ctx.Err() == nil {
+			c.recordHostResult(host, err)
+		}
+	}
+
+	if timedOut || (err != nil && ctx.Err() != nil) {
+		fmt.Println("timed out while fetching", image.ExternalUrl, err)
+		c.leavePending(image)
+		return false
+	}
+
+	if errors.Is(err, ErrNotModified) {
+		fmt.Println(image.ExternalUrl, "is unchanged, keeping", image.S3Url)
+		c.recordUnchanged(image)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			duplicate.S3Url = image.S3Url
+			duplicate.FetchedAt = image.FetchedAt
+			c.recordUnchanged(&duplicate)
+		}
+
+		return false
+	}
+
+	if errors.Is(err, ErrDisallowedMime) {
+		fmt.Println("rejected image", image.ExternalUrl, err)
+		c.recordRejected(image, errorCodeDisallowed, err)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			c.recordRejected(&duplicate, errorCodeDisallowed, err)
+		}
+
+		return false
+	}
+
+	if err != nil {
+		fmt.Println("could not fetch image", image.ExternalUrl, err)
+		c.recordFetchFailure(image, err)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			c.recordFetchFailure(&duplicate, err)
+		}
+
+		return false
+	}
+
+	fmt.Println("stored image to local from", image.ExternalUrl, "as", image.LocalFilename)
+	c.addFetchedBytes(image.FileSize)
+
+	c.storedImagesMutex.Lock()
+	c.storedImages = append(c.storedImages, *image)
+	c.storedImagesMutex.Unlock()
+
+	if image.FileCategory != "image" {
+		return true
+	}
+
+	if c.config.StripExif {
+		err = stripExif(image)
+
+		// The same bytes would fail again, so there's no point retrying
+		if err != nil {
+			fmt.Println("could not strip exif data from", image.LocalFilename, err)
+			c.recordInvalidFile(image, err)
+
+			for _, duplicate := range c.duplicates[image.ExternalUrl.String()] {
+				c.recordInvalidFile(&duplicate, err)
+			}
+
+			return false
+		}
+	}
+
+	if c.config.Recompress.Enabled {
+		c.recompress(image)
+	}
+
+	if resolvedMimeType(*image) == "image/gif" {
+		err = setAnimated(image)
+
+		if err != nil {
+			fmt.Println("could not decode gif", image.LocalFilename, "treating it as static", err)
+		}
+	}
+
+	err = setImageDimensions(image)
+
+	if err != nil {
+		fmt.Println("could not read dimensions of", image.LocalFilename, err)
+		return true
+	}
+
+	err = checkMinDimensions(image, c.config.MinWidth, c.config.MinHeight)
+
+	if err != nil {
+		fmt.Println("rejected image", image.ExternalUrl, err)
+		c.recordRejected(image, errorCodeTooSmall, err)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			copyStoredFile(&duplicate, *image)
+			c.recordRejected(&duplicate, errorCodeTooSmall, err)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func (c *mediaCloner) uploadImage(ctx context.Context, image *AbtImage) {
+	var err error
+
+	ctx, cancel := c.imageContext(ctx)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	span := startStageSpan(ctx, *image, "upload")
+	image.S3Url, err = uploadImageToCloud(ctx, c.s3Client, c.config.Aws, image)
+	span.End()
+
+	if err != nil && ctx.Err() != nil {
+		fmt.Println("timed out while uploading", image.ExternalUrl, err)
+		image.S3Url = ""
+		c.leavePending(image)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("could not upload", image.ExternalUrl, "for this reason:", err)
+		c.recordUploadFailure(image, err)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			c.recordUploadFailure(&duplicate, err)
+		}
+
+		return
+	}
+
+	fmt.Println("uploaded image to s3 account. URI is", image.S3Url)
+
+	c.uploadToMirrors(ctx, *image)
+
+	if c.config.Thumbnails.Enabled && image.FileCategory == "image" && !(image.IsAnimated && c.config.Thumbnails.SkipAnimated) {
+		err = storeThumbnail(ctx, c.s3Client, c.config, image)
+
+		if err != nil {
+			fmt.Println("could not create thumbnail for", image.LocalFilename, err)
+		} else {
+			fmt.Println("uploaded thumbnail to s3 account. URI is", image.ThumbS3Url)
+		}
+	}
+
+	c.recordRetrieved(image)
+
+	for _, duplicate := range c.duplicatesOf(*image) {
+		copyStoredFile(&duplicate, *image)
+		c.recordRetrieved(&duplicate)
+	}
+}
+
+// recordHostResult feeds the outcome of a fetch to the host's circuit.
+func (c *mediaCloner) recordHostResult(host string, err error) {
+	if c.config.CircuitThreshold <= 0 {
+		return
+	}
+
+	if err != nil && isHostFailure(err) {
+		c.circuits.recordFailure(host, c.config.CircuitThreshold, time.Duration(c.config.CircuitCooldown))
+	} else {
+		c.circuits.recordSuccess(host)
+	}
+}
+
+// imageContext bounds a single stage of work on a file by PerImageTimeout, so
+// one stuck file can't hold up a worker for the rest of the run. Fetching and
+// uploading are bounded separately, leaving out the time spent queued between
+// them.
+func (c *mediaCloner) imageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.config.PerImageTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(c.config.PerImageTimeout))
+}
+
+func (c *mediaCloner) duplicatesOf(image AbtImage) []AbtImage {
+	return c.duplicates[normalizeUrl(image.ExternalUrl, c.config.StripQueryParams)]
+}
+
+// leavePending leaves a file, and any rows sharing its URL, for the next run
+// once the run or the file has timed out, or the run used up its byte budget.
+// Claimed rows are handed back so any instance can pick them up.
+func (c *mediaCloner) leavePending(image *AbtImage) {
+	images := append([]AbtImage{*image}, c.duplicatesOf(*image)...)
+
+	for _, pending := range images {
+		c.summary.recordSkip()
+
+		if !c.config.ClaimRows || c.db == nil {
+			continue
+		}
+
+		err := releaseClaim(c.resultCtx, c.db, pending.FileId)
+
+		if err != nil {
+			fmt.Println("could not release claim on file", pending.FileId, err)
+		}
+	}
+}
+
+func (c *mediaCloner) recordFetchFailure(image *AbtImage, err error) {
+	if image.StoredS3Url != "" {
+		c.recordRefreshFailure(image, fetchErrorCode(err), err)
+		return
+	}
+
+	setImageError(image, fetchErrorCode(err), err)
+	c.summary.recordFailure(image.ExternalUrl.Hostname(), err)
+
+	maxAttempts := maxAttemptsForHost(c.config, image.ExternalUrl.Hostname())
+
+	c.logAttempt(*image, attemptOutcomeFetchFailed)
+
+	if image.Attempts >= int64(maxAttempts) || isPermanentFetchError(err) {
+		image.State = "failed"
+		c.notifier.notifyFailedImage(*image)
+
+		err := c.updater.update(c.resultCtx, *image)
+
+		if err != nil {
+			fmt.Println("could not update db with file's failed state", err)
+		}
+	} else {
+		err := c.updater.update(c.resultCtx, *image)
+
+		if err != nil {
+			fmt.Println("could not increment file retrieval attempt", err)
+		}
+	}
+}
+
+// recordInvalidFile fails a file whose downloaded bytes can't be processed.
+func (c *mediaCloner) recordInvalidFile(image *AbtImage, err error) {
+	image.State = "failed"
+	c.summary.recordFailure(image.ExternalUrl.Hostname(), err)
+
+	err = c.updater.update(c.resultCtx, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's failed state", err)
+	}
+}
+
+// recordRejected marks a file that was fetched fine but isn't worth keeping, so
+// it is neither uploaded nor retried.
+func (c *mediaCloner) recordRejected(image *AbtImage, code string, err error) {
+	if image.StoredS3Url != "" {
+		c.recordRefreshFailure(image, code, err)
+		return
+	}
+
+	setImageError(image, code, err)
+	image.State = "rejected"
+	c.summary.recordSkip()
+	c.logAttempt(*image, attemptOutcomeRejected)
+
+	err = c.updater.update(c.resultCtx, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's rejected state", err)
+	}
+}
+
+func (c *mediaCloner) recordUploadFailure(image *AbtImage, err error) {
+	if image.StoredS3Url != "" {
+		c.recordRefreshFailure(image, errorCodeUploadError, err)
+		return
+	}
+
+	image.S3Url = ""
+	setImageError(image, errorCodeUploadError, err)
+	c.summary.recordFailure(image.ExternalUrl.Hostname(), err)
+	c.logAttempt(*image, attemptOutcomeUploadFailed)
+
+	err = c.updater.update(c.resultCtx, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's upload error", err)
+	}
+}
+
+// recordRefreshFailure records why a file that was already stored couldn't be
+// stored again, e.g. by a backfill. The row keeps its state, object and
+// attempts, as the object it points at is still good.
+func (c *mediaCloner) recordRefreshFailure(image *AbtImage, code string, err error) {
+	image.S3Url = image.StoredS3Url
+	setImageError(image, code, err)
+	c.summary.recordFailure(image.ExternalUrl.Hostname(), err)
+
+	err = c.updater.markRefreshFailed(c.resultCtx, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's refresh error", err)
+	}
+}
+
+// recordUnchanged marks a previously stored file retrieved again, keeping its
+// existing object.
+func (c *mediaCloner) recordUnchanged(image *AbtImage) {
+	image.State = "retrieved"
+	c.summary.recordSuccess(image.ExternalUrl.Hostname(), 0)
+
+	if c.db == nil {
+		return
+	}
+
+	c.logAttempt(*image, attemptOutcomeUnchanged)
+
+	err := markImageUnchangedInDb(c.resultCtx, c.db, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's retrieved state", err)
+	}
+
+	if c.config.Solr.BaseUrl != "" {
+		updateSolrWithImageRef(c.resultCtx, c.solrClient, *image, c.config.Solr)
+	}
+}
+
+func (c *mediaCloner) recordRetrieved(image *AbtImage) {
+	image.State = "retrieved"
+	c.summary.recordSuccess(image.ExternalUrl.Hostname(), image.FileSize)
+	c.logAttempt(*image, attemptOutcomeRetrieved)
+
+	span := startStageSpan(c.resultCtx, *image, "db_update")
+	err := c.updater.queue(c.resultCtx, *image, c.announceRetrieved)
+	span.End()
+
+	if err != nil {
+		fmt.Println("could not update db with file's retrieved state", err)
+	}
+}
+
+// announceRetrieved points the post's Solr document at a stored file and
+// publishes its event, once its row has been committed.
+func (c *mediaCloner) announceRetrieved(image AbtImage) {
+	// Runs that don't write to the db have no real post to point the index at
+	if c.config.Solr.BaseUrl != "" && c.db != nil {
+		span := startStageSpan(c.resultCtx, image, "solr_update")
+		updateSolrWithImageRef(c.resultCtx, c.solrClient, image, c.config.Solr)
+		span.End()
+	}
+
+	// Like the index, consumers of the event would look up a post that a run
+	// without a db never wrote
+	if c.publisher != nil && c.db != nil {
+		c.publishRetrieved(image)
+	}
+}
+
+func (c *mediaCloner) logAttempt(image AbtImage, outcome string) {
+	err := c.attempts.record(c.resultCtx, image, outcome)
+
+	if err != nil {
+		fmt.Println("could not log attempt at file", image.FileId, err)
+	}
+}
+
+func (c *mediaCloner) publishRetrieved(image AbtImage) {
+	ctx, cancel := context.WithTimeout(c.resultCtx, eventPublishTimeout)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	span := startStageSpan(ctx, image, "publish_event")
+	err := c.publisher.Publish(ctx, newFileRetrievedEvent(image))
+	span.End()
+
+	if err != nil {
+		fmt.Println("could not publish event for file", image.FileId, err)
+	}
+}
+
+// recompress shrinks the downloaded file where it's worthwhile. Failing to
+// is not an error, the original is uploaded instead.
+func (c *mediaCloner) recompress(image *AbtImage) {
+	sizeBefore := image.FileSize
+	previousFilename, err := recompressImage(image, c.config.Recompress)
+
+	if err != nil {
+		fmt.Println("could not recompress", image.LocalFilename, err)
+		return
+	}
+
+	if previousFilename != "" {
+		c.storedImagesMutex.Lock()
+
+		for i := range c.storedImages {
+			if c.storedImages[i].LocalFilename == previousFilename {
+				c.storedImages[i].LocalFilename = image.LocalFilename
+			}
+		}
+
+		c.storedImagesMutex.Unlock()
+	}
+
+	if image.FileSize != sizeBefore {
+		fmt.Println("recompressed", image.LocalFilename, "from", sizeBefore, "to", image.FileSize, "bytes")
+	}
+}
+
+// recordLeak counts a local file that couldn't be cleaned up.
+func (c *mediaCloner) recordLeak(image AbtImage) {
+	var size int64
+	info, err := os.Stat(image.LocalFilename)
+
+	if err == nil {
+		size = info.Size()
+	}
+
+	c.summary.recordLeak(size)
+	recordLeakedFile(size)
+}
+
+// removeStoredImages deletes the local copies of the run's files, or moves
+// them to the mirror dir when KeepLocalCopies is set. A file that can't be
+// mirrored is left in place rather than losing the copy.
+func (c *mediaCloner) removeStoredImages() {
+	for _, image := range c.storedImages {
+		if c.config.KeepLocalCopies {
+			mirrorFilename, err := mirrorLocalImage(image, c.config.LocalMirrorDir)
+
+			if err != nil {
+				fmt.Println("could not move", image.LocalFilename, "to the mirror dir", err)
+				c.recordLeak(image)
+				continue
+			}
+
+			fmt.Println("moved local copy of file", image.LocalFilename, "to", mirrorFilename)
+			continue
+		}
+
+		err := deleteLocalImage(image)
+
+		if err != nil {
+			fmt.Println("could not delete", image.LocalFilename, err)
+			c.recordLeak(image)
+			continue
+		}
+
+		fmt.Println("removed local copy of file", image.LocalFilename)
+	}
+}
+
+// shuffleImages puts a batch in random order, so files from one slow host
+// that happen to be next to each other don't all hold up the start of a run.
+func shuffleImages(images []AbtImage, rng *rand.Rand) {
+	rng.Shuffle(len(images), func(i, j int) {
+		images[i], images[j] = images[j], images[i]
+	})
+}
+
+// sortByHostPriority moves files from hosts with a higher priority to the
+// front of the batch, so time-sensitive sources aren't stuck behind a backlog.
+// Hosts without one have priority 0, and files keep their order otherwise:
+// newest first, or shuffled with ShuffleBatch. priorities is keyed by
+// lowercased host, as setConfigDefaults leaves it.
+func sortByHostPriority(images []AbtImage, priorities map[string]int) {
+	sort.SliceStable(images, func(i, j int) bool {
+		return priorities[strings.ToLower(images[i].ExternalUrl.Hostname())] > priorities[strings.ToLower(images[j].ExternalUrl.Hostname())]
+	})
+}
+
+// processImages runs a batch through the fetch/upload pipeline, removes the
+// local copies and reports the run summary. Rows sharing an external URL are
+// fetched once and each given the result. Files still outstanding when
+// RunTimeout passes, once MaxBytesPerRun has been downloaded, or when the
+// shutdown grace period runs out, are left pending for the next run.
+func (c *mediaCloner) processImages(ctx context.Context, images []AbtImage) {
+	c.summary.recordProcessed(len(images))
+	c.resultCtx = ctx
+
+	if c.config.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.config.RunTimeout))
+
+		defer func(cancel context.CancelFunc) {
+			cancel()
+		}(cancel)
+	}
+
+	ctx, cancelDrain := shutdown.bound(ctx)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancelDrain)
+
+	unique, duplicates := groupDuplicateUrls(images, c.config.StripQueryParams)
+	c.duplicates = duplicates
+
+	if c.config.ShuffleBatch {
+		shuffleImages(unique, rand.New(rand.NewSource(time.Now().UnixNano())))
+	}
+
+	if len(c.config.HostPriorities) > 0 {
+		sortByHostPriority(unique, c.config.HostPriorities)
+	}
+
+	runPipeline(
+		unique,
+		c.config.FetchWorkers,
+		c.config.UploadWorkers,
+		func(image *AbtImage) bool {
+			image.span = startImageSpan(ctx, *image)
+			fetched := c.fetchImage(ctx, image)
+
+			if !fetched {
+				endImageSpan(*image)
+			}
+
+			return fetched
+		},
+		func(image *AbtImage) {
+			if c.config.DownloadOnly {
+				c.storeLocalOnly(image)
+			} else {
+				c.uploadImage(ctx, image)
+			}
+
+			endImageSpan(*image)
+		},
+	)
+
+	err := c.updater.flush(c.resultCtx)
+
+	if err != nil {
+		fmt.Println("could not update db with the last batch of retrieved files", err)
+	}
+
+	c.removeStoredImages()
+
+	reportRunSummary(c.summary, c.config.SummaryWebhook)
+	c.notifier.notifyFailureRate(c.summary, c.config.AlertFailureRate)
+	c.notifier.wait()
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testPng is a 1x1 transparent PNG.
+var testPng = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\xff\xff?\x00\x05\xfe\x02\xfe\xa7\x35\x81\x84\x00\x00\x00\x00IEND\xaeB`\x82")
+
+// fakeBucket keeps objects put to it in memory, and serves and deletes them.
+// Keys containing failKey are refused.
+type fakeBucket struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	failKey string
+	puts    int
+	deletes int
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		f.delete(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		f.get(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.puts++
+
+	if f.failKey != "" && strings.Contains(r.URL.Path, f.failKey) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code><Message>access denied</Message></Error>"))
+		return
+	}
+
+	f.objects[r.URL.Path] = data
+}
+
+func (f *fakeBucket) get(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	data, ok := f.objects[r.URL.Path]
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("content-type", "image/png")
+	_, _ = w.Write(data)
+}
+
+func (f *fakeBucket) delete(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.deletes++
+
+	if f.failKey != "" && strings.Contains(r.URL.Path, f.failKey) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code><Message>access denied</Message></Error>"))
+		return
+	}
+
+	delete(f.objects, r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fakeSolr records the documents posted to it.
+type fakeSolr struct {
+	mutex sync.Mutex
+	docs  []map[string]interface{}
+}
+
+func (f *fakeSolr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var docs []map[string]interface{}
+
+	err := json.NewDecoder(r.Body).Decode(&docs)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	f.docs = append(f.docs, docs...)
+	f.mutex.Unlock()
+}
+
+func (f *fakeSolr) postIds() map[int64]bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ids := map[int64]bool{}
+
+	for _, doc := range f.docs {
+		if id, ok := doc["id"].(float64); ok {
+			ids[int64(id)] = true
+		}
+	}
+
+	return ids
+}
+
+// nonEmptyString matches any string argument other than "".
+type nonEmptyString struct{}
+
+func (nonEmptyString) Match(v driver.Value) bool {
+	value, ok := v.(string)
+	return ok && value != ""
+}
+
+// expectFileUpdate expects the files update for one file, checking what was
+// stored, the error category and the state.
+func expectFileUpdate(mock sqlmock.Sqlmock, fileId int64, ingestedUri interface{}, errorCode interface{}, state string) {
+	a := sqlmock.AnyArg()
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `files` SET `mime_type` = ?")).
+		WithArgs(a, a, a, ingestedUri, a, a, a, a, a, a, errorCode, a, state, a, fileId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+type testCloner struct {
+	cloner *mediaCloner
+	mock   sqlmock.Sqlmock
+	bucket *fakeBucket
+	solr   *fakeSolr
+}
+
+// newTestCloner sets up a cloner against sqlmock, an in-memory bucket, a fake
+// Solr and a source answering by path.
+func newTestCloner(t *testing.T, configure func(*AppConfig)) *testCloner {
+	t.Helper()
+
+	chdirTemp(t)
+
+	solr := &fakeSolr{}
+	solrServer := httptest.NewServer(solr)
+	t.Cleanup(solrServer.Close)
+
+	bucket := &fakeBucket{objects: map[string][]byte{}}
+
+	config := AppConfig{
+		Solr:        SolrConfig{BaseUrl: solrServer.URL},
+		Aws:         AwsConfig{Bucket: "bucket", Folder: "media"},
+		MaxAttempts: 3,
+	}
+
+	if configure != nil {
+		configure(&config)
+	}
+
+	httpClient := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/missing"):
+			http.NotFound(w, r)
+		case strings.HasPrefix(r.URL.Path, "/broken"):
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case strings.HasPrefix(r.URL.Path, "/gone"):
+			http.Error(w, "gone", http.StatusGone)
+		case strings.HasPrefix(r.URL.Path, "/unavailable"):
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		case strings.HasPrefix(r.URL.Path, "/throttled"):
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case strings.HasPrefix(r.URL.Path, "/corrupt"):
+			w.Header().Set("content-type", "image/jpeg")
+			_, _ = w.Write([]byte("\xff\xd8\xff\xe0 not really a jpeg"))
+		case strings.HasPrefix(r.URL.Path, "/slow"):
+			// Hangs until the client gives up
+			<-r.Context().Done()
+		case strings.HasPrefix(r.URL.Path, "/truncated"):
+			// Promise more than is sent, as when the connection drops
+			w.Header().Set("content-type", "image/png")
+			w.Header().Set("content-length", strconv.Itoa(len(testPng)+100))
+			_, _ = w.Write(testPng)
+		case strings.HasPrefix(r.URL.Path, "/photo"):
+			w.Header().Set("content-type", "image/png")
+			_ = png.Encode(w, image.NewGray(image.Rect(0, 0, 3, 2)))
+		case strings.HasPrefix(r.URL.Path, "/unchanged") && r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		case strings.HasPrefix(r.URL.Path, "/page"):
+			w.Header().Set("content-type", "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+		default:
+			w.Header().Set("content-type", "image/png")
+			_, _ = w.Write(testPng)
+		}
+	})
+
+	err := config.Validate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files` SET `mime_type` = ?"))
+
+	updater, err := newImageRefUpdater(context.Background(), db, config.MaxDbWriters, config.DbBatchSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloner := newMediaCloner(config, db, newTestS3Client(t, bucket.ServeHTTP), httpClient, solrServer.Client())
+	cloner.updater = updater
+
+	return &testCloner{cloner: cloner, mock: mock, bucket: bucket, solr: solr}
+}
+
+func (tc *testCloner) image(t *testing.T, fileId int64, postId int64, path string, attempts int64) AbtImage {
+	return AbtImage{
+		FileId:      fileId,
+		PostId:      postId,
+		ExternalUrl: testUrl(t, "http://images.example.com"+path),
+		State:       "pending",
+		Attempts:    attempts,
+	}
+}
+
+func TestProcessImagesStoresPendingFile(t *testing.T) {
+	tc := newTestCloner(t, nil)
+
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 1, 100, "/a.png", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(tc.bucket.objects) != 1 {
+		t.Fatalf("got %d objects in the bucket, want 1", len(tc.bucket.objects))
+	}
+
+	for key, data := range tc.bucket.objects {
+		if !strings.HasPrefix(key, "/bucket/media/") || !strings.HasSuffix(key, ".png") {
+			t.Errorf("unexpected object key %s", key)
+		}
+
+		if string(data) != string(testPng) {
+			t.Errorf("object %s doesn't hold the source file", key)
+		}
+	}
+
+	if !tc.solr.postIds()[100] {
+		t.Error("solr wasn't updated for post 100")
+	}
+
+	if tc.cloner.summary.Succeeded != 1 {
+		t.Errorf("summary has %d succeeded, want 1", tc.cloner.summary.Succeeded)
+	}
+}
+
+func TestProcessImagesRecordsFailures(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	tc.bucket.failKey = ".4.400"
+
+	// A 404 is given up on straight away
+	expectFileUpdate(tc.mock, 2, "", errorCodeHttp4xx, "failed")
+	// A 500 stays pending for another attempt
+	expectFileUpdate(tc.mock, 3, "", errorCodeHttp5xx, "pending")
+	// The upload being refused leaves it pending without an object
+	expectFileUpdate(tc.mock, 4, "", errorCodeUploadError, "pending")
+	// A 500 once the attempts are used up fails the file
+	expectFileUpdate(tc.mock, 5, "", errorCodeHttp5xx, "failed")
+	// A type that isn't configured is retried like any other fetch error
+	expectFileUpdate(tc.mock, 6, "", errorCodeInvalidMime, "pending")
+	// So is a download cut short of its Content-Length
+	expectFileUpdate(tc.mock, 14, "", errorCodeShortRead, "pending")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 2, 200, "/missing.png", 0),
+		tc.image(t, 3, 300, "/broken.png", 0),
+		tc.image(t, 4, 400, "/a.png", 0),
+		tc.image(t, 5, 500, "/broken-again.png", 3),
+		tc.image(t, 6, 600, "/page", 0),
+		tc.image(t, 14, 1400, "/truncated.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(tc.bucket.objects) != 0 {
+		t.Errorf("got %d objects in the bucket, want none", len(tc.bucket.objects))
+	}
+
+	if len(tc.solr.postIds()) != 0 {
+		t.Errorf("solr was updated for %v, want no updates", tc.solr.postIds())
+	}
+
+	if tc.cloner.summary.Failed != 6 {
+		t.Errorf("summary has %d failed, want 6", tc.cloner.summary.Failed)
+	}
+}
+
+func TestProcessImagesSharesFetchBetweenDuplicateUrls(t *testing.T) {
+	tc := newTestCloner(t, nil)
+
+	expectFileUpdate(tc.mock, 7, nonEmptyString{}, nil, "retrieved")
+	expectFileUpdate(tc.mock, 8, nonEmptyString{}, nil, "retrieved")
+	// Failures are shared too, each row getting its own update
+	expectFileUpdate(tc.mock, 10, "", errorCodeHttp4xx, "failed")
+	expectFileUpdate(tc.mock, 11, "", errorCodeHttp4xx, "failed")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 7, 700, "/same.png", 0),
+		tc.image(t, 8, 800, "/same.png", 0),
+		tc.image(t, 10, 1000, "/missing.png", 0),
+		tc.image(t, 11, 1100, "/missing.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 1 {
+		t.Errorf("got %d uploads, want 1", tc.bucket.puts)
+	}
+
+	ids := tc.solr.postIds()
+
+	if !ids[700] || !ids[800] {
+		t.Errorf("solr updated for %v, want posts 700 and 800", ids)
+	}
+
+	if tc.cloner.summary.Succeeded != 2 || tc.cloner.summary.Failed != 2 {
+		t.Errorf("summary has %d succeeded and %d failed, want 2 of each", tc.cloner.summary.Succeeded, tc.cloner.summary.Failed)
+	}
+}
+
+func TestProcessImagesRejectsImagesBelowMinDimensions(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.MinWidth = 2
+		config.MinHeight = 2
+	})
+
+	// testPng is a 1x1 tracking pixel
+	expectFileUpdate(tc.mock, 12, "", errorCodeTooSmall, "rejected")
+	expectFileUpdate(tc.mock, 13, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 12, 1200, "/pixel.png", 0),
+		tc.image(t, 13, 1300, "/photo.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 1 {
+		t.Errorf("got %d uploads, want only the photo", tc.bucket.puts)
+	}
+
+	if tc.solr.postIds()[1200] {
+		t.Error("solr was updated for the rejected pixel")
+	}
+
+	if tc.cloner.summary.Skipped != 1 || tc.cloner.summary.Succeeded != 1 {
+		t.Errorf("summary has %d skipped and %d succeeded, want 1 of each", tc.cloner.summary.Skipped, tc.cloner.summary.Succeeded)
+	}
+}
+
+func TestProcessImagesRejectsDisallowedMimeTypes(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.AllowedMimeTypes = []string{"image/jpeg"}
+	})
+
+	expectFileUpdate(tc.mock, 14, "", errorCodeDisallowed, "rejected")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 14, 1400, "/a.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 0 {
+		t.Errorf("got %d uploads, want none", tc.bucket.puts)
+	}
+
+	if tc.cloner.summary.Skipped != 1 || tc.cloner.summary.Failed != 0 {
+		t.Errorf("summary has %d skipped and %d failed, want 1 skipped", tc.cloner.summary.Skipped, tc.cloner.summary.Failed)
+	}
+}
+
+func TestProcessImagesStopsFetchingOverByteBudget(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.FetchWorkers = 1
+		config.MaxBytesPerRun = int64(len(testPng))
+	})
+
+	// Only the first file fits in the budget, the others are left pending
+	// without touching their rows
+	expectFileUpdate(tc.mock, 15, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 15, 1500, "/a.png", 0),
+		tc.image(t, 16, 1600, "/b.png", 0),
+		tc.image(t, 17, 1700, "/c.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 1 {
+		t.Errorf("got %d uploads, want 1", tc.bucket.puts)
+	}
+
+	if tc.cloner.summary.Succeeded != 1 || tc.cloner.summary.Skipped != 2 {
+		t.Errorf("summary has %d succeeded and %d skipped, want 1 and 2", tc.cloner.summary.Succeeded, tc.cloner.summary.Skipped)
+	}
+}
+
+func TestProcessImagesFailsClientErrorsStraightAway(t *testing.T) {
+	tc := newTestCloner(t, nil)
+
+	// A 404 or 410 won't ever succeed, so it doesn't wait for MaxAttempts
+	expectFileUpdate(tc.mock, 18, "", errorCodeHttp4xx, "failed")
+	expectFileUpdate(tc.mock, 19, "", errorCodeHttp4xx, "failed")
+	// A 503 or 429 may well succeed later, so it's retried until the attempts
+	// are used up
+	expectFileUpdate(tc.mock, 20, "", errorCodeHttp5xx, "pending")
+	expectFileUpdate(tc.mock, 21, "", errorCodeHttp4xx, "pending")
+	expectFileUpdate(tc.mock, 22, "", errorCodeHttp5xx, "failed")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 18, 1800, "/missing.png", 0),
+		tc.image(t, 19, 1900, "/gone.png", 0),
+		tc.image(t, 20, 2000, "/unavailable.png", 0),
+		tc.image(t, 21, 2100, "/throttled.png", 1),
+		tc.image(t, 22, 2200, "/unavailable-again.png", 3),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// countingTransport counts the requests made through it and fails them all.
+type countingTransport struct {
+	mutex    sync.Mutex
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.mutex.Lock()
+	c.requests++
+	c.mutex.Unlock()
+
+	return nil, errors.New("unexpected request to " + r.URL.String())
+}
+
+func TestProcessImagesSkipsSolrWithoutUrl(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.Solr = SolrConfig{}
+	})
+
+	solrTransport := &countingTransport{}
+	tc.cloner.solrClient = &http.Client{Transport: solrTransport}
+
+	expectFileUpdate(tc.mock, 15, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 15, 1500, "/a.png", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if solrTransport.requests != 0 {
+		t.Errorf("made %d solr requests, want none", solrTransport.requests)
+	}
+}
+
+func TestProcessImagesRunTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		claimRows   bool
+		wantUpdated []int64
+		wantPending []int64
+	}{
+		// Unclaimed rows are already pending, so nothing is written for them
+		{"unclaimed", false, []int64{16}, nil},
+		// Claimed rows are handed back so they don't wait out the claim timeout
+		{"claimed", true, []int64{16}, []int64{17, 18}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tc := newTestCloner(t, func(config *AppConfig) {
+				config.RunTimeout = Duration(300 * time.Millisecond)
+				config.FetchWorkers = 1
+				config.ClaimRows = test.claimRows
+			})
+
+			for _, fileId := range test.wantUpdated {
+				expectFileUpdate(tc.mock, fileId, nonEmptyString{}, nil, "retrieved")
+			}
+
+			for _, fileId := range test.wantPending {
+				tc.mock.ExpectExec(regexp.QuoteMeta("SET `state` = 'pending', `worker_id` = NULL")).
+					WithArgs(fileId).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			started := time.Now()
+
+			tc.cloner.processImages(context.Background(), []AbtImage{
+				tc.image(t, 16, 1600, "/a.png", 0),
+				tc.image(t, 17, 1700, "/slow.png", 0),
+				tc.image(t, 18, 1800, "/b.png", 0),
+			})
+
+			if time.Since(started) > 5*time.Second {
+				t.Errorf("run took %v, want it stopped by the timeout", time.Since(started))
+			}
+
+			// Finished work is saved even though the run ran out of time
+			err := tc.mock.ExpectationsWereMet()
+
+			if err != nil {
+				t.Error(err)
+			}
+
+			if tc.cloner.summary.Succeeded != 1 || tc.cloner.summary.Skipped != 2 || tc.cloner.summary.Failed != 0 {
+				t.Errorf("got %d succeeded, %d skipped and %d failed, want 1, 2 and 0", tc.cloner.summary.Succeeded, tc.cloner.summary.Skipped, tc.cloner.summary.Failed)
+			}
+		})
+	}
+}
+
+func TestShuffleImages(t *testing.T) {
+	var images []AbtImage
+
+	for fileId := int64(1); fileId <= 20; fileId++ {
+		images = append(images, AbtImage{FileId: fileId})
+	}
+
+	shuffled := append([]AbtImage(nil), images...)
+	shuffleImages(shuffled, rand.New(rand.NewSource(1)))
+
+	seen := map[int64]bool{}
+	moved := 0
+
+	for i, image := range shuffled {
+		seen[image.FileId] = true
+
+		if image.FileId != images[i].FileId {
+			moved++
+		}
+	}
+
+	if len(seen) != len(images) {
+		t.Fatalf("got %d distinct files after shuffling, want all %d", len(seen), len(images))
+	}
+
+	if moved == 0 {
+		t.Error("shuffling left every file where it was")
+	}
+
+	// The order only depends on the generator it is given
+	again := append([]AbtImage(nil), images...)
+	shuffleImages(again, rand.New(rand.NewSource(1)))
+
+	for i := range again {
+		if again[i].FileId != shuffled[i].FileId {
+			t.Fatalf("got a different order from the same seed at %d", i)
+		}
+	}
+}
+
+func TestSortByHostPriority(t *testing.T) {
+	config := AppConfig{HostPriorities: map[string]int{"News.Example.com": 10, "slow.example.com": -1}}
+	setConfigDefaults(&config)
+
+	hosts := map[int64]string{
+		1: "images.example.com",
+		2: "slow.example.com",
+		3: "NEWS.example.com",
+		4: "images.example.com",
+		5: "news.example.com",
+		6: "other.example.com",
+		7: "slow.example.com",
+	}
+
+	var images []AbtImage
+
+	for fileId := int64(1); fileId <= 7; fileId++ {
+		images = append(images, AbtImage{FileId: fileId, ExternalUrl: testUrl(t, "http://"+hosts[fileId]+"/a.png")})
+	}
+
+	sortByHostPriority(images, config.HostPriorities)
+
+	// Files of equal priority keep the order they came in
+	want := []int64{3, 5, 1, 4, 6, 2, 7}
+
+	for i, image := range images {
+		if image.FileId != want[i] {
+			t.Fatalf("got file %d at %d, want %d", image.FileId, i, want[i])
+		}
+	}
+}
+
+func TestProcessImagesPerImageTimeout(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.PerImageTimeout = Duration(200 * time.Millisecond)
+		config.FetchWorkers = 1
+	})
+
+	expectFileUpdate(tc.mock, 19, nonEmptyString{}, nil, "retrieved")
+	expectFileUpdate(tc.mock, 21, nonEmptyString{}, nil, "retrieved")
+
+	started := time.Now()
+
+	// The stuck file is given up on and the worker goes on to the next one,
+	// which the run still has time for
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 19, 1900, "/a.png", 0),
+		tc.image(t, 20, 2000, "/slow.png", 0),
+		tc.image(t, 21, 2100, "/b.png", 0),
+	})
+
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("run took %v, want the stuck file given up on", time.Since(started))
+	}
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.cloner.summary.Succeeded != 2 || tc.cloner.summary.Skipped != 1 || tc.cloner.summary.Failed != 0 {
+		t.Errorf("got %d succeeded, %d skipped and %d failed, want 2, 1 and 0", tc.cloner.summary.Succeeded, tc.cloner.summary.Skipped, tc.cloner.summary.Failed)
+	}
+}
+
+func TestProcessImagesFailsJpegThatCantBeStripped(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.StripExif = true
+	})
+
+	expectFileUpdate(tc.mock, 9, "", nil, "failed")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 9, 900, "/corrupt.jpg", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 0 {
+		t.Errorf("got %d uploads, want none", tc.bucket.puts)
+	}
+}
+
+func TestProcessImagesKeepsUnchangedObject(t *testing.T) {
+	tc := newTestCloner(t, nil)
+
+	image := tc.image(t, 10, 1000, "/unchanged.png", 1)
+	image.State = "retrieved"
+	image.S3Url = "https://test.s3.amazonaws.com/media/stored.png"
+	image.ETag = `"v1"`
+
+	tc.mock.ExpectExec(regexp.QuoteMeta("UPDATE `files` SET `ingested_uri` = ?")).
+		WithArgs(image.S3Url, sqlmock.AnyArg(), int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tc.cloner.processImages(context.Background(), []AbtImage{image})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 0 {
+		t.Errorf("got %d uploads, want the stored object kept", tc.bucket.puts)
+	}
+
+	if !tc.solr.postIds()[1000] {
+		t.Error("solr wasn't updated for post 1000")
+	}
+}
+
+func TestProcessImagesKeepsStoredObjectWhenRefreshFails(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	tc.bucket.failKey = ".12."
+
+	stored := func(fileId int64, path string) AbtImage {
+		image := tc.image(t, fileId, fileId*100, path, 3)
+		image.State = "retrieved"
+		image.S3Url = "https://test.s3.amazonaws.com/media/stored.png"
+		image.StoredS3Url = image.S3Url
+		return image
+	}
+
+	// Only the error is recorded, whether the fetch or the upload failed
+	for _, refresh := range []struct {
+		fileId    int64
+		errorCode string
+	}{
+		{11, errorCodeHttp4xx},
+		{12, errorCodeUploadError},
+	} {
+		tc.mock.ExpectExec(regexp.QuoteMeta("UPDATE `files` SET `error_code` = ?, `last_error` = ?, `modified` = ? WHERE `pk_file_id` = ?")).
+			WithArgs(refresh.errorCode, nonEmptyString{}, sqlmock.AnyArg(), refresh.fileId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		stored(11, "/missing.png"),
+		stored(12, "/a.png"),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(tc.solr.postIds()) != 0 {
+		t.Errorf("solr was updated for %v, want no updates", tc.solr.postIds())
+	}
+}
+
+func TestProcessImagesDownloadOnlyKeepsLocalCopy(t *testing.T) {
+	mirrorDir := t.TempDir()
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.DownloadOnly = true
+		config.LocalMirrorDir = mirrorDir
+	})
+
+	var localPath string
+
+	tc.mock.ExpectExec(regexp.QuoteMeta("UPDATE `files` SET `mime_type` = ?, `file_category` = ?, `file_size` = ?, `ingested_uri` = NULL")).
+		WithArgs("image/png", "image", int64(len(testPng)), localPathArg{&localPath}, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(13)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 13, 1300, "/a.png", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.bucket.puts != 0 {
+		t.Errorf("got %d uploads, want none", tc.bucket.puts)
+	}
+
+	if !strings.HasPrefix(localPath, mirrorDir) {
+		t.Fatalf("recorded local path %q isn't in %s", localPath, mirrorDir)
+	}
+
+	data, err := os.ReadFile(localPath)
+
+	if err != nil || string(data) != string(testPng) {
+		t.Errorf("local copy at %s doesn't hold the source file: %v", localPath, err)
+	}
+
+	if len(tc.solr.postIds()) != 0 {
+		t.Errorf("solr was updated for %v, want no updates", tc.solr.postIds())
+	}
+}
+
+// localPathArg matches any string argument, keeping it for checking.
+type localPathArg struct {
+	value *string
+}
+
+func (a localPathArg) Match(v driver.Value) bool {
+	value, ok := v.(string)
+	*a.value = value
+
+	return ok && value != ""
+}
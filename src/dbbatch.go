@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// queuedUpdate is a stored file waiting for its batch to be committed, and
+// what to do once it has been.
+type queuedUpdate struct {
+	image    AbtImage
+	onCommit func(AbtImage)
+}
+
+// queue records a file that was stored successfully. With a DbBatchSize above
+// 1 the update is held back and committed along with the next DbBatchSize-1
+// in a single transaction, or by flush at the end of the run. Failures are
+// written with update straight away instead, so they're counted towards a
+// retry even if the run dies before the batch is committed.
+//
+// onCommit is called once the file's row has been committed, so nothing is
+// told about a file the db doesn't have yet. It isn't called for a file
+// marked as a duplicate, or whose update failed.
+func (u *imageRefUpdater) queue(ctx context.Context, image AbtImage, onCommit func(AbtImage)) error {
+	// Runs that don't write their results to the db have nothing to wait for
+	if u == nil {
+		onCommit(image)
+		return nil
+	}
+
+	if u.batchSize <= 1 {
+		stored, err := u.write(ctx, image)
+
+		if stored {
+			onCommit(image)
+		}
+
+		return err
+	}
+
+	u.batchMutex.Lock()
+	u.batch = append(u.batch, queuedUpdate{image: image, onCommit: onCommit})
+
+	if len(u.batch) < u.batchSize {
+		u.batchMutex.Unlock()
+		return nil
+	}
+
+	updates := u.batch
+	u.batch = nil
+	u.batchMutex.Unlock()
+
+	return u.commit(ctx, updates)
+}
+
+// flush commits any updates still queued.
+func (u *imageRefUpdater) flush(ctx context.Context) error {
+	if u == nil {
+		return nil
+	}
+
+	u.batchMutex.Lock()
+	updates := u.batch
+	u.batch = nil
+	u.batchMutex.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	return u.commit(ctx, updates)
+}
+
+// commit writes a batch of updates in one transaction. Should that fail, the
+// files are updated one at a time so one bad row can't lose the others.
+func (u *imageRefUpdater) commit(ctx context.Context, updates []queuedUpdate) error {
+	u.writers <- struct{}{}
+	stored, err := u.commitTx(ctx, updates)
+	<-u.writers
+
+	if err == nil {
+		for _, update := range stored {
+			update.onCommit(update.image)
+		}
+
+		return nil
+	}
+
+	fmt.Println("could not commit batch of", len(updates), "file updates, updating them one at a time", err)
+
+	var lastErr error
+
+	for _, update := range updates {
+		stored, err := u.write(ctx, update.image)
+
+		if err != nil {
+			fmt.Println("could not update file", update.image.FileId, err)
+			lastErr = err
+		}
+
+		if stored {
+			update.onCommit(update.image)
+		}
+	}
+
+	return lastErr
+}
+
+// commitTx writes a batch in one transaction and returns the updates that were
+// stored as given, leaving out any marked as duplicates.
+func (u *imageRefUpdater) commitTx(ctx context.Context, updates []queuedUpdate) ([]queuedUpdate, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := tx.StmtContext(ctx, u.stmt)
+	var stored []queuedUpdate
+
+	for _, update := range updates {
+		_, err = stmt.ExecContext(ctx, updateArgs(update.image)...)
+
+		// MySQL only undoes the failed statement, so the rest of the batch
+		// can still be committed
+		if isDuplicateKeyError(err) {
+			fmt.Println("file", update.image.FileId, "duplicates one already stored, marking it rejected:", err)
+			err = markDuplicate(ctx, tx, update.image, err)
+		} else if err == nil {
+			stored = append(stored, update)
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return stored, tx.Commit()
+}
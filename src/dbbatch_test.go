@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+var updateFileQuery = regexp.QuoteMeta("UPDATE `files` SET `mime_type` = ?")
+
+func newTestUpdater(t *testing.T, batchSize int) (*imageRefUpdater, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	mock.ExpectPrepare(updateFileQuery)
+
+	updater, err := newImageRefUpdater(context.Background(), db, 2, batchSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return updater, mock
+}
+
+// committedIds collects the files onCommit was called for.
+type committedIds []int64
+
+func (c *committedIds) onCommit(image AbtImage) {
+	*c = append(*c, image.FileId)
+}
+
+func retrievedImage(fileId int64) AbtImage {
+	return AbtImage{FileId: fileId, MimeType: "image/png", S3Url: "/media/a.png", State: "retrieved"}
+}
+
+func TestQueueWritesEachFileWithoutBatching(t *testing.T) {
+	updater, mock := newTestUpdater(t, 1)
+	var committed committedIds
+
+	for fileId := int64(1); fileId <= 3; fileId++ {
+		mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := updater.queue(context.Background(), retrievedImage(fileId), committed.onCommit)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(committed) != int(fileId) {
+			t.Fatalf("file %d wasn't committed straight away", fileId)
+		}
+	}
+
+	err := mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueCommitsBatchInOneTransaction(t *testing.T) {
+	updater, mock := newTestUpdater(t, 3)
+	var committed committedIds
+
+	// Three files cost one transaction rather than a round trip each, and a
+	// fourth waits for flush
+	mock.ExpectBegin()
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	for fileId := int64(1); fileId <= 4; fileId++ {
+		err := updater.queue(context.Background(), retrievedImage(fileId), committed.onCommit)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fileId < 3 && len(committed) != 0 {
+			t.Fatalf("file committed before its batch: %v", committed)
+		}
+	}
+
+	if len(committed) != 3 {
+		t.Fatalf("got %v committed after the batch, want files 1 to 3", committed)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := updater.flush(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(committed) != 4 || committed[3] != 4 {
+		t.Errorf("got %v committed after flushing, want file 4 too", committed)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueSkipsDuplicatesInBatch(t *testing.T) {
+	updater, mock := newTestUpdater(t, 2)
+	var committed committedIds
+
+	mock.ExpectBegin()
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateFileQuery).WillReturnError(&mysql.MySQLError{Number: mysqlErrDupEntry, Message: "Duplicate entry"})
+	mock.ExpectExec(regexp.QuoteMeta("SET `error_code` = ?, `last_error` = ?, `state` = 'rejected'")).
+		WithArgs(errorCodeDuplicate, sqlmock.AnyArg(), sqlmock.AnyArg(), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	for fileId := int64(1); fileId <= 2; fileId++ {
+		err := updater.queue(context.Background(), retrievedImage(fileId), committed.onCommit)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(committed) != 1 || committed[0] != 1 {
+		t.Errorf("got %v committed, want only file 1", committed)
+	}
+
+	err := mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueFallsBackToSingleUpdates(t *testing.T) {
+	updater, mock := newTestUpdater(t, 2)
+	var committed committedIds
+
+	mock.ExpectBegin().WillReturnError(errors.New("too many connections"))
+	mock.ExpectExec(updateFileQuery).WillReturnError(errors.New("lock wait timeout"))
+	mock.ExpectExec(updateFileQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := updater.queue(context.Background(), retrievedImage(1), committed.onCommit)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updater.queue(context.Background(), retrievedImage(2), committed.onCommit)
+
+	if err == nil {
+		t.Error("failed update wasn't reported")
+	}
+
+	// Only the file whose row was written is announced
+	if len(committed) != 1 || committed[0] != 2 {
+		t.Errorf("got %v committed, want only file 2", committed)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProcessImagesUpdatesSolrAfterBatchCommits(t *testing.T) {
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.DbBatchSize = 10
+	})
+
+	tc.mock.ExpectBegin()
+	expectFileUpdate(tc.mock, 21, nonEmptyString{}, nil, "retrieved")
+	expectFileUpdate(tc.mock, 22, nonEmptyString{}, nil, "retrieved")
+	tc.mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+	// The batch is retried a row at a time and only one row makes it
+	expectFileUpdate(tc.mock, 21, nonEmptyString{}, nil, "retrieved")
+	tc.mock.ExpectExec(updateFileQuery).WithArgs(
+		sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(22),
+	).WillReturnError(errors.New("connection lost"))
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 21, 2100, "/a.png", 0),
+		tc.image(t, 22, 2200, "/b.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	ids := tc.solr.postIds()
+
+	if !ids[2100] || ids[2200] {
+		t.Errorf("solr updated for %v, want only post 2100", ids)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+// groupDuplicateUrls splits a batch into the first image for each distinct
+// external URL, in their original order, and the later images that share one
+// of those URLs keyed by the normalized URL. Only the first image needs to be
+// fetched and uploaded; the rest reuse its result.
+func groupDuplicateUrls(images []AbtImage, stripParams []string) ([]AbtImage, map[string][]AbtImage) {
+	var unique []AbtImage
+	duplicates := make(map[string][]AbtImage)
+	seen := make(map[string]bool)
+
+	for _, image := range images {
+		externalUrl := normalizeUrl(image.ExternalUrl, stripParams)
+
+		if seen[externalUrl] {
+			duplicates[externalUrl] = append(duplicates[externalUrl], image)
+			continue
+		}
+
+		seen[externalUrl] = true
+		unique = append(unique, image)
+	}
+
+	return unique, duplicates
+}
+
+// copyStoredFile gives a duplicate row the file that was stored for the image
+// it shares a URL with.
+func copyStoredFile(duplicate *AbtImage, image AbtImage) {
+	duplicate.MimeType = image.MimeType
+	duplicate.FileCategory = image.FileCategory
+	duplicate.FileSize = image.FileSize
+	duplicate.FileExt = image.FileExt
+	duplicate.LocalFilename = image.LocalFilename
+	duplicate.S3Url = image.S3Url
+	duplicate.LocalPath = image.LocalPath
+	duplicate.ThumbS3Url = image.ThumbS3Url
+	duplicate.Width = image.Width
+	duplicate.Height = image.Height
+	duplicate.IsAnimated = image.IsAnimated
+	duplicate.FetchedAt = image.FetchedAt
+}
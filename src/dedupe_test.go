@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGroupDuplicateUrls(t *testing.T) {
+	images := []AbtImage{
+		{FileId: 1, ExternalUrl: testUrl(t, "http://images.example.com/a.png")},
+		{FileId: 2, ExternalUrl: testUrl(t, "http://images.example.com/b.png")},
+		{FileId: 3, ExternalUrl: testUrl(t, "http://images.example.com/a.png")},
+		{FileId: 4, ExternalUrl: testUrl(t, "http://IMAGES.example.com/a.png?utm_source=rss#top")},
+	}
+
+	unique, duplicates := groupDuplicateUrls(images, defaultStripQueryParams)
+
+	if len(unique) != 2 || unique[0].FileId != 1 || unique[1].FileId != 2 {
+		t.Errorf("got unique files %+v, want 1 and 2 in order", unique)
+	}
+
+	shared := duplicates["http://images.example.com/a.png"]
+
+	if len(duplicates) != 1 || len(shared) != 2 || shared[0].FileId != 3 || shared[1].FileId != 4 {
+		t.Errorf("got duplicates %+v, want 3 and 4 under a.png", duplicates)
+	}
+}
+
+func TestCopyStoredFileKeepsRowIdentity(t *testing.T) {
+	duplicate := AbtImage{FileId: 2, PostId: 20, Attempts: 1}
+	image := AbtImage{FileId: 1, PostId: 10, MimeType: "image/png", FileSize: 68, S3Url: "/media/1.png", Width: 1, Height: 1}
+
+	copyStoredFile(&duplicate, image)
+
+	if duplicate.FileId != 2 || duplicate.PostId != 20 || duplicate.Attempts != 1 {
+		t.Errorf("duplicate lost its own row details: %+v", duplicate)
+	}
+
+	if duplicate.S3Url != "/media/1.png" || duplicate.MimeType != "image/png" || duplicate.FileSize != 68 || duplicate.Width != 1 {
+		t.Errorf("duplicate didn't get the stored file: %+v", duplicate)
+	}
+}
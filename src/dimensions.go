@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+)
+
+// setImageDimensions reads just the image header of the downloaded file to
+// populate Width and Height. The dimensions stay unset when the format can't be
+// decoded.
+func setImageDimensions(abtImage *AbtImage) error {
+	file, err := os.Open(abtImage.LocalFilename)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	imgConfig, _, err := image.DecodeConfig(file)
+
+	if err != nil {
+		return err
+	}
+
+	abtImage.Width = int64(imgConfig.Width)
+	abtImage.Height = int64(imgConfig.Height)
+
+	return nil
+}
+
+// setAnimated flags GIFs with more than one frame. Every frame is decoded, so
+// it's only worth calling for GIFs.
+func setAnimated(abtImage *AbtImage) error {
+	file, err := os.Open(abtImage.LocalFilename)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	animation, err := gif.DecodeAll(file)
+
+	if err != nil {
+		return err
+	}
+
+	abtImage.IsAnimated = len(animation.Image) > 1
+
+	return nil
+}
+
+// checkMinDimensions returns an error describing why the image is too small to
+// keep. Images whose dimensions couldn't be read are let through.
+func checkMinDimensions(abtImage *AbtImage, minWidth int64, minHeight int64) error {
+	if abtImage.Width == 0 || abtImage.Height == 0 {
+		return nil
+	}
+
+	if abtImage.Width < minWidth || abtImage.Height < minHeight {
+		return fmt.Errorf("image is %dx%d, below the minimum of %dx%d", abtImage.Width, abtImage.Height, minWidth, minHeight)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestImage(t *testing.T, name string, encode func(w io.Writer, img image.Image) error) string {
+	t.Helper()
+
+	img := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.Black, color.White})
+	filename := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encode(file, img)
+	closeErr := file.Close()
+
+	if err != nil || closeErr != nil {
+		t.Fatal(err, closeErr)
+	}
+
+	return filename
+}
+
+func TestSetImageDimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(w io.Writer, img image.Image) error
+	}{
+		{"test.jpg", func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) }},
+		{"test.png", png.Encode},
+		{"test.gif", func(w io.Writer, img image.Image) error { return gif.Encode(w, img, nil) }},
+	}
+
+	for _, test := range tests {
+		image := AbtImage{LocalFilename: writeTestImage(t, test.name, test.encode)}
+
+		err := setImageDimensions(&image)
+
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		if image.Width != 3 || image.Height != 2 {
+			t.Errorf("%s: got %dx%d, want 3x2", test.name, image.Width, image.Height)
+		}
+	}
+}
+
+func TestSetImageDimensionsLeavesUnknownFormatsUnset(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.mp4")
+
+	err := os.WriteFile(filename, []byte("not an image"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{LocalFilename: filename}
+
+	if setImageDimensions(&image) == nil {
+		t.Error("expected an error for a file that isn't an image")
+	}
+
+	if image.Width != 0 || image.Height != 0 {
+		t.Errorf("got %dx%d, want the dimensions left unset", image.Width, image.Height)
+	}
+}
+
+func TestCheckMinDimensions(t *testing.T) {
+	tests := []struct {
+		width   int64
+		height  int64
+		wantErr bool
+	}{
+		{1, 1, true},
+		{16, 400, true},
+		{400, 16, true},
+		{32, 32, false},
+		{640, 480, false},
+		// Unknown dimensions aren't held against the image
+		{0, 0, false},
+	}
+
+	for _, test := range tests {
+		image := AbtImage{Width: test.width, Height: test.height}
+
+		err := checkMinDimensions(&image, 32, 32)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%dx%d: got %v, want error %t", test.width, test.height, err, test.wantErr)
+		}
+	}
+
+	image := AbtImage{Width: 1, Height: 1}
+
+	if err := checkMinDimensions(&image, 0, 0); err != nil {
+		t.Errorf("expected no minimum when unset, got %v", err)
+	}
+}
+
+// writeTestGif saves a 2x1 GIF with the given number of frames.
+func writeTestGif(t *testing.T, frames int) string {
+	t.Helper()
+
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 2, 1), palette)
+		frame.SetColorIndex(i%2, 0, 1)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.gif")
+	file, err := os.Create(filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gif.EncodeAll(file, animation)
+	closeErr := file.Close()
+
+	if err != nil || closeErr != nil {
+		t.Fatal(err, closeErr)
+	}
+
+	return filename
+}
+
+func TestSetAnimated(t *testing.T) {
+	tests := []struct {
+		frames int
+		want   bool
+	}{
+		{1, false},
+		{2, true},
+		{5, true},
+	}
+
+	for _, test := range tests {
+		image := AbtImage{LocalFilename: writeTestGif(t, test.frames)}
+
+		err := setAnimated(&image)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.IsAnimated != test.want {
+			t.Errorf("%d frames: animated %t, want %t", test.frames, image.IsAnimated, test.want)
+		}
+
+		err = setImageDimensions(&image)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.Width != 2 || image.Height != 1 {
+			t.Errorf("%d frames: got %dx%d, want 2x1", test.frames, image.Width, image.Height)
+		}
+	}
+}
+
+func TestSetAnimatedLeavesBrokenGifStatic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "broken.gif")
+
+	err := os.WriteFile(filename, []byte("GIF89a\x02\x00\x01\x00truncated"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{LocalFilename: filename}
+
+	err = setAnimated(&image)
+
+	if err == nil || image.IsAnimated {
+		t.Errorf("got %v with animated %t, want an error and a static image", err, image.IsAnimated)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialDownloadFilename is where a file is downloaded to before it's
+// complete. It only depends on the file id so an interrupted download can be
+// resumed on a later attempt.
+func partialDownloadFilename(tempDir string, fileId int64) string {
+	return filepath.Join(tempDir, fmt.Sprintf("%d.part", fileId))
+}
+
+func partialDownloadSize(partialFilename string) int64 {
+	info, err := os.Stat(partialFilename)
+
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// parseContentRange reads the first byte position and complete length from a
+// Content-Range header such as "bytes 100-999/1000".
+func parseContentRange(contentRange string) (int64, int64, error) {
+	var start, end, total int64
+
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start > end || end >= total {
+		return 0, 0, errors.New("invalid content range: " + contentRange)
+	}
+
+	return start, total, nil
+}
+
+// decodeResponseBody undoes any Content-Encoding the transport hasn't already
+// handled. Some hosts gzip images even though we ask for the identity encoding.
+// The returned bool reports whether the body is being decoded, in which case
+// Content-Length no longer describes the bytes read.
+func decodeResponseBody(resp *http.Response) (io.Reader, bool, error) {
+	if resp.Uncompressed {
+		return resp.Body, false, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("content-encoding"))) {
+	case "", "identity":
+		return resp.Body, false, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(resp.Body)
+
+		return reader, true, err
+	case "deflate":
+		// "deflate" should be zlib wrapped, but plenty of servers send raw deflate
+		buffered := bufio.NewReader(resp.Body)
+		header, err := buffered.Peek(2)
+
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			reader, err := zlib.NewReader(buffered)
+
+			return reader, true, err
+		}
+
+		return flate.NewReader(buffered), true, nil
+	default:
+		return nil, false, fmt.Errorf("unsupported content encoding: %s", resp.Header.Get("content-encoding"))
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantStart int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"bytes 100-999/1000", 100, 1000, false},
+		{"bytes 0-0/1", 0, 1, false},
+		{"bytes 500-100/1000", 0, 0, true},
+		{"bytes 100-1000/1000", 0, 0, true},
+		{"bytes */1000", 0, 0, true},
+		{"", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		start, total, err := parseContentRange(test.header)
+
+		if (err != nil) != test.wantErr || start != test.wantStart || total != test.wantTotal {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v", test.header, start, total, err)
+		}
+	}
+}
+
+// newRangeClient is a client whose requests are all answered with testPng,
+// honouring Range requests when ranges is set.
+func newRangeClient(t *testing.T, config *AppConfig, ranges bool, gotRange *string) *http.Client {
+	return newProxiedClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		*gotRange = r.Header.Get("range")
+		w.Header().Set("content-type", "image/png")
+
+		if !ranges || *gotRange == "" {
+			_, _ = w.Write(testPng)
+			return
+		}
+
+		var start int
+
+		_, err := fmt.Sscanf(*gotRange, "bytes=%d-", &start)
+
+		if err != nil || start >= len(testPng) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, len(testPng)-1, len(testPng)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(testPng[start:])
+	})
+}
+
+func writePartialDownload(t *testing.T, fileId int64, data []byte) string {
+	t.Helper()
+
+	partialFilename := partialDownloadFilename(".", fileId)
+
+	err := os.WriteFile(partialFilename, data, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return partialFilename
+}
+
+func TestFetchStoreImageFromUrlResumesPartialDownload(t *testing.T) {
+	chdirTemp(t)
+
+	var gotRange string
+	config := AppConfig{}
+	client := newRangeClient(t, &config, true, &gotRange)
+
+	partialFilename := writePartialDownload(t, 1, testPng[:20])
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotRange != "bytes=20-" {
+		t.Errorf("requested range %q, want bytes=20-", gotRange)
+	}
+
+	data, err := os.ReadFile(image.LocalFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(testPng) || image.FileSize != int64(len(testPng)) {
+		t.Errorf("resumed file is %d bytes with size %d, want %d", len(data), image.FileSize, len(testPng))
+	}
+
+	if _, err := os.Stat(partialFilename); !os.IsNotExist(err) {
+		t.Errorf("partial download %s should have been renamed", partialFilename)
+	}
+}
+
+func TestFetchStoreImageFromUrlFetchesInFullWhenRangeIgnored(t *testing.T) {
+	chdirTemp(t)
+
+	var gotRange string
+	config := AppConfig{}
+	client := newRangeClient(t, &config, false, &gotRange)
+
+	writePartialDownload(t, 1, []byte("stale bytes"))
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotRange == "" {
+		t.Error("expected a range request for the partial download")
+	}
+
+	data, err := os.ReadFile(image.LocalFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole file replaces what was downloaded before rather than being
+	// appended to it
+	if string(data) != string(testPng) {
+		t.Errorf("got %d bytes, want the %d of the full file", len(data), len(testPng))
+	}
+}
+
+func TestFetchStoreImageFromUrlRestartsWhenRangeNotSatisfiable(t *testing.T) {
+	chdirTemp(t)
+
+	var gotRange string
+	config := AppConfig{}
+	client := newRangeClient(t, &config, true, &gotRange)
+
+	partialFilename := writePartialDownload(t, 1, append(append([]byte{}, testPng...), "extra"...))
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if err == nil {
+		t.Fatal("expected an error when the range can't be satisfied")
+	}
+
+	if _, err := os.Stat(partialFilename); !os.IsNotExist(err) {
+		t.Error("the partial download should be removed so the next attempt starts over")
+	}
+}
+
+func TestFetchStoreImageFromUrlDecodesContentEncoding(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		"deflate": func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		},
+		"raw-deflate": func(w io.Writer) io.WriteCloser {
+			writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return writer
+		},
+	}
+
+	for name, newEncoder := range encoders {
+		chdirTemp(t)
+
+		var encoded bytes.Buffer
+		encoder := newEncoder(&encoded)
+		_, _ = encoder.Write(testPng)
+		_ = encoder.Close()
+
+		var acceptEncoding string
+		config := AppConfig{}
+		client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("accept-encoding")
+			w.Header().Set("content-type", "image/png")
+			w.Header().Set("content-encoding", strings.TrimPrefix(name, "raw-"))
+			_, _ = w.Write(encoded.Bytes())
+		})
+
+		image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if acceptEncoding != "identity" {
+			t.Errorf("%s: sent accept-encoding %q, want identity", name, acceptEncoding)
+		}
+
+		data, err := os.ReadFile(image.LocalFilename)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != string(testPng) || image.FileSize != int64(len(testPng)) {
+			t.Errorf("%s: stored %d bytes with size %d, want the %d decoded bytes", name, len(data), image.FileSize, len(testPng))
+		}
+	}
+}
+
+func TestFetchStoreImageFromUrlRejectsUnknownContentEncoding(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{}
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "image/png")
+		w.Header().Set("content-encoding", "br")
+		_, _ = w.Write(testPng)
+	})
+
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if err == nil || !strings.Contains(err.Error(), "unsupported content encoding") {
+		t.Errorf("got %v, want an unsupported encoding error", err)
+	}
+
+	if image.LocalFilename != "" {
+		t.Errorf("expected nothing to be stored, got %s", image.LocalFilename)
+	}
+}
+
+func TestFetchStoreImageFromUrlRejectsShortRead(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{}
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "image/png")
+		w.Header().Set("content-length", fmt.Sprint(len(testPng)+100))
+		_, _ = w.Write(testPng)
+	})
+
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if fetchErrorCode(err) != errorCodeShortRead {
+		t.Errorf("got %v (%s), want a short read", err, fetchErrorCode(err))
+	}
+
+	if isPermanentFetchError(err) {
+		t.Error("a short read should be retried")
+	}
+
+	if image.LocalFilename != "" {
+		t.Errorf("expected nothing to be stored, got %s", image.LocalFilename)
+	}
+}
+
+func TestFetchStoreImageFromUrlRejectsUndersizedFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		minFileSize int64
+		body        []byte
+		wantErr     bool
+	}{
+		{"empty", 0, nil, true},
+		{"under the minimum", 100, testPng[:50], true},
+		{"at the minimum", int64(len(testPng)), testPng, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chdirTemp(t)
+
+			config := AppConfig{MinFileSize: test.minFileSize}
+			client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-type", "image/png")
+				_, _ = w.Write(test.body)
+			})
+
+			image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+			err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+			if !test.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrFileTooSmall) || fetchErrorCode(err) != errorCodeEmptyFile {
+				t.Fatalf("got %v (%s), want the file rejected as too small", err, fetchErrorCode(err))
+			}
+
+			// Retried, as the source may send the whole file next time
+			if isPermanentFetchError(err) {
+				t.Error("an undersized file should be retried")
+			}
+
+			if _, statErr := os.Stat(partialDownloadFilename(config.TempDir, image.FileId)); !os.IsNotExist(statErr) {
+				t.Error("the partial download should have been removed")
+			}
+		})
+	}
+}
+
+func TestFetchStoreImageFromUrlStoresCopiedSize(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{}
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		// Streamed without a Content-Length
+		w.Header().Set("content-type", "image/png")
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(testPng)
+	})
+
+	image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.png")}
+
+	err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.FileSize != int64(len(testPng)) {
+		t.Errorf("got file size %d, want the %d bytes copied", image.FileSize, len(testPng))
+	}
+}
+
+func TestFetchStoreImageFromUrlConditionalFetch(t *testing.T) {
+	chdirTemp(t)
+
+	var gotIfNoneMatch, gotIfModifiedSince string
+	config := AppConfig{}
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		gotIfNoneMatch = r.Header.Get("if-none-match")
+		gotIfModifiedSince = r.Header.Get("if-modified-since")
+
+		if gotIfNoneMatch == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("content-type", "image/png")
+		w.Header().Set("etag", `"v2"`)
+		w.Header().Set("last-modified", "Tue, 02 Jan 2024 00:00:00 GMT")
+		_, _ = w.Write(testPng)
+	})
+
+	lastModified := "Mon, 01 Jan 2024 00:00:00 GMT"
+
+	tests := []struct {
+		name          string
+		s3Url         string
+		etag          string
+		wantCondition bool
+		wantErr       error
+	}{
+		{"unchanged", "/media/a.png", `"v1"`, true, ErrNotModified},
+		{"changed", "/media/a.png", `"v0"`, true, nil},
+		// Without a stored object there's nothing to keep, so it's always fetched
+		{"never stored", "", `"v1"`, false, nil},
+	}
+
+	for i, test := range tests {
+		image := AbtImage{
+			FileId:       int64(i + 1),
+			PostId:       2,
+			ExternalUrl:  testUrl(t, "http://images.example.com/a.png"),
+			S3Url:        test.s3Url,
+			ETag:         test.etag,
+			LastModified: lastModified,
+		}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+
+		if sent := gotIfNoneMatch != ""; sent != test.wantCondition {
+			t.Errorf("%s: sent if-none-match %q", test.name, gotIfNoneMatch)
+		}
+
+		if test.wantCondition && gotIfModifiedSince != lastModified {
+			t.Errorf("%s: sent if-modified-since %q, want %q", test.name, gotIfModifiedSince, lastModified)
+		}
+
+		// A fresh download records the source's new validators
+		if test.wantErr == nil && (image.ETag != `"v2"` || image.LastModified != "Tue, 02 Jan 2024 00:00:00 GMT") {
+			t.Errorf("%s: got validators %q, %q", test.name, image.ETag, image.LastModified)
+		}
+	}
+}
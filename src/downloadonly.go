@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// storeLocalOnly keeps a downloaded file in LocalMirrorDir instead of
+// uploading it, for DownloadOnly runs building a local archive. The file's
+// row records where it was kept and is left without an ingested_uri.
+func (c *mediaCloner) storeLocalOnly(image *AbtImage) {
+	localPath, err := mirrorLocalImage(*image, c.config.LocalMirrorDir)
+
+	if err != nil {
+		fmt.Println("could not move", image.LocalFilename, "to", c.config.LocalMirrorDir, err)
+		c.recordUploadFailure(image, err)
+
+		for _, duplicate := range c.duplicatesOf(*image) {
+			c.recordUploadFailure(&duplicate, err)
+		}
+
+		return
+	}
+
+	fmt.Println("kept", image.ExternalUrl, "at", localPath)
+	c.forgetStoredImage(image.LocalFilename)
+	image.LocalPath = localPath
+	c.recordDownloaded(image)
+
+	for _, duplicate := range c.duplicatesOf(*image) {
+		copyStoredFile(&duplicate, *image)
+		c.recordDownloaded(&duplicate)
+	}
+}
+
+// forgetStoredImage drops a file that has been moved out of the temp dir, so
+// it isn't removed at the end of the run.
+func (c *mediaCloner) forgetStoredImage(localFilename string) {
+	c.storedImagesMutex.Lock()
+	defer c.storedImagesMutex.Unlock()
+
+	storedImages := c.storedImages[:0]
+
+	for _, storedImage := range c.storedImages {
+		if storedImage.LocalFilename != localFilename {
+			storedImages = append(storedImages, storedImage)
+		}
+	}
+
+	c.storedImages = storedImages
+}
+
+func (c *mediaCloner) recordDownloaded(image *AbtImage) {
+	image.State = "downloaded"
+	c.summary.recordSuccess(image.ExternalUrl.Hostname(), image.FileSize)
+	c.logAttempt(*image, attemptOutcomeDownloaded)
+
+	err := c.updater.markDownloaded(c.resultCtx, *image)
+
+	if err != nil {
+		fmt.Println("could not update db with file's downloaded state", err)
+	}
+}
+
+// markDownloaded records a file kept locally by a DownloadOnly run. It has no
+// object in the bucket, so ingested_uri is cleared and the row gets its own
+// state rather than retrieved, keeping it out of audits and solr.
+func (u *imageRefUpdater) markDownloaded(ctx context.Context, image AbtImage) error {
+	if u == nil {
+		return nil
+	}
+
+	u.writers <- struct{}{}
+
+	defer func() {
+		<-u.writers
+	}()
+
+	_, err := u.db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `mime_type` = ?, `file_category` = ?, `file_size` = ?, `ingested_uri` = NULL, `thumbnail_uri` = NULL, `local_path` = ?, `width` = ?, `height` = ?, `is_animated` = ?, `error_code` = NULL, `last_error` = NULL, `state` = 'downloaded', `modified` = ?, attempts = attempts + 1 "+
+			"WHERE `pk_file_id` = ?",
+		image.MimeType,
+		sql.NullString{String: image.FileCategory, Valid: image.FileCategory != ""},
+		image.FileSize,
+		image.LocalPath,
+		sql.NullInt64{Int64: image.Width, Valid: image.Width > 0},
+		sql.NullInt64{Int64: image.Height, Valid: image.Height > 0},
+		sql.NullBool{Bool: image.IsAnimated, Valid: resolvedMimeType(image) == "image/gif"},
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		image.FileId,
+	)
+
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	errorCodeFetchTimeout = "fetch_timeout"
+	errorCodeFetchError   = "fetch_error"
+	errorCodeHttp4xx      = "http_4xx"
+	errorCodeHttp5xx      = "http_5xx"
+	errorCodeInvalidMime  = "invalid_mime"
+	errorCodeUploadError  = "upload_error"
+	errorCodeTooSmall     = "too_small"
+	errorCodeShortRead    = "short_read"
+	errorCodeDisallowed   = "disallowed_mime"
+	errorCodeEmptyFile    = "empty_file"
+	errorCodeDuplicate    = "duplicate"
+)
+
+const maxLastErrorLength = 255
+
+// mysqlErrDupEntry is the error number MySQL returns when a write would break a
+// unique key
+const mysqlErrDupEntry = 1062
+
+// Sentinels for telling the stages' errors apart with errors.Is
+var (
+	ErrFetch           = errors.New("fetch failed")
+	ErrUnsupportedMime = errors.New("unsupported mime type")
+	ErrDisallowedMime  = errors.New("mime type not allowed")
+	ErrFileTooLarge    = errors.New("file too large")
+	ErrShortRead       = errors.New("download incomplete")
+	ErrFileTooSmall    = errors.New("file too small")
+	ErrUpload          = errors.New("upload failed")
+	ErrETagMismatch    = errors.New("uploaded object doesn't match the local file")
+	ErrNotModified     = errors.New("not modified since the last fetch")
+)
+
+// FetchError is returned when a file couldn't be downloaded. Err holds the
+// underlying cause, such as an *httpStatusError or *UnsupportedMimeError, and
+// is what's reported as the message since callers already log the URL.
+type FetchError struct {
+	Url string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FetchError) Is(target error) bool {
+	return target == ErrFetch
+}
+
+type UnsupportedMimeError struct {
+	MimeType string
+}
+
+func (e *UnsupportedMimeError) Error() string {
+	return fmt.Sprintf("unsupported mime type %q", e.MimeType)
+}
+
+func (e *UnsupportedMimeError) Is(target error) bool {
+	return target == ErrUnsupportedMime
+}
+
+// DisallowedMimeError is returned for files whose type isn't on the
+// AllowedMimeTypes allowlist. They're rejected rather than failed as fetching
+// them again won't change anything.
+type DisallowedMimeError struct {
+	MimeType string
+}
+
+func (e *DisallowedMimeError) Error() string {
+	return fmt.Sprintf("mime type %q is not allowed", e.MimeType)
+}
+
+func (e *DisallowedMimeError) Is(target error) bool {
+	return target == ErrDisallowedMime
+}
+
+// UploadError is returned when a file couldn't be stored in the bucket. Err
+// holds the AWS error.
+type UploadError struct {
+	Key string
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UploadError) Is(target error) bool {
+	return target == ErrUpload
+}
+
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status: %d", e.StatusCode)
+}
+
+// isPermanentFetchError reports whether retrying the fetch is pointless, which
+// is the case for client errors such as 404 or 410. Request timeouts (408) and
+// rate limiting (429) are client errors too but are worth retrying, as are
+// server errors and network failures.
+func isPermanentFetchError(err error) bool {
+	var statusErr *httpStatusError
+
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == http.StatusRequestTimeout || statusErr.StatusCode == http.StatusTooManyRequests {
+			return false
+		}
+
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+	}
+
+	return false
+}
+
+// fetchErrorCode maps an error returned by fetchStoreImageFromUrl onto one of
+// the error categories stored alongside the file.
+func fetchErrorCode(err error) string {
+	var netErr net.Error
+	var statusErr *httpStatusError
+
+	if errors.Is(err, ErrUnsupportedMime) || errors.Is(err, ErrFileTooLarge) {
+		return errorCodeInvalidMime
+	}
+
+	// The http client reports a body cut short of its Content-Length as an
+	// unexpected EOF
+	if errors.Is(err, ErrShortRead) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorCodeShortRead
+	}
+
+	if errors.Is(err, ErrFileTooSmall) {
+		return errorCodeEmptyFile
+	}
+
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode >= 500 {
+			return errorCodeHttp5xx
+		}
+
+		return errorCodeHttp4xx
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorCodeFetchTimeout
+	}
+
+	return errorCodeFetchError
+}
+
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDupEntry
+}
+
+func setImageError(image *AbtImage, errorCode string, err error) {
+	lastError := err.Error()
+
+	if len(lastError) > maxLastErrorLength {
+		lastError = lastError[:maxLastErrorLength]
+	}
+
+	image.ErrorCode = errorCode
+	image.LastError = lastError
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFetchErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&httpStatusError{StatusCode: 404}, errorCodeHttp4xx},
+		{&httpStatusError{StatusCode: 429}, errorCodeHttp4xx},
+		{&httpStatusError{StatusCode: 500}, errorCodeHttp5xx},
+		{&httpStatusError{StatusCode: 503}, errorCodeHttp5xx},
+		{&UnsupportedMimeError{MimeType: "text/html"}, errorCodeInvalidMime},
+		{fmt.Errorf("%w: video/mp4 (more than 64 bytes)", ErrFileTooLarge), errorCodeInvalidMime},
+		{&FetchError{Url: "http://images.example.com/a.png", Err: &httpStatusError{StatusCode: 404}}, errorCodeHttp4xx},
+		{fmt.Errorf("%w: got 0 bytes, expected at least 1", ErrFileTooSmall), errorCodeEmptyFile},
+		{context.DeadlineExceeded, errorCodeFetchTimeout},
+		{fmt.Errorf("get: %w", timeoutError{}), errorCodeFetchTimeout},
+		{errors.New("connection refused"), errorCodeFetchError},
+	}
+
+	for _, test := range tests {
+		got := fetchErrorCode(test.err)
+
+		if got != test.want {
+			t.Errorf("fetchErrorCode(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestStageErrorsAs(t *testing.T) {
+	fetchErr := error(&FetchError{Url: "http://images.example.com/a.html", Err: &UnsupportedMimeError{MimeType: "text/html"}})
+
+	var asFetch *FetchError
+	var asMime *UnsupportedMimeError
+
+	if !errors.As(fetchErr, &asFetch) || asFetch.Url != "http://images.example.com/a.html" {
+		t.Errorf("expected %v to be a *FetchError", fetchErr)
+	}
+
+	if !errors.As(fetchErr, &asMime) || asMime.MimeType != "text/html" {
+		t.Errorf("expected the cause of %v to be an *UnsupportedMimeError", fetchErr)
+	}
+
+	if !errors.Is(fetchErr, ErrFetch) || !errors.Is(fetchErr, ErrUnsupportedMime) || errors.Is(fetchErr, ErrUpload) {
+		t.Errorf("%v matched the wrong sentinels", fetchErr)
+	}
+
+	uploadErr := fmt.Errorf("storing file: %w", &UploadError{Key: "/media/1.png", Err: errors.New("access denied")})
+
+	var asUpload *UploadError
+
+	if !errors.As(uploadErr, &asUpload) || asUpload.Key != "/media/1.png" {
+		t.Errorf("expected %v to wrap an *UploadError", uploadErr)
+	}
+
+	if !errors.Is(uploadErr, ErrUpload) || errors.Is(uploadErr, ErrFetch) {
+		t.Errorf("%v matched the wrong sentinels", uploadErr)
+	}
+}
+
+func TestIsPermanentFetchError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&httpStatusError{StatusCode: 404}, true},
+		{&httpStatusError{StatusCode: 410}, true},
+		{fmt.Errorf("get: %w", &httpStatusError{StatusCode: 403}), true},
+		{&httpStatusError{StatusCode: 408}, false},
+		{&httpStatusError{StatusCode: 429}, false},
+		{&httpStatusError{StatusCode: 500}, false},
+		{&httpStatusError{StatusCode: 503}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		got := isPermanentFetchError(test.err)
+
+		if got != test.want {
+			t.Errorf("isPermanentFetchError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestSetImageErrorTruncatesMessage(t *testing.T) {
+	image := AbtImage{}
+	setImageError(&image, errorCodeFetchError, errors.New(strings.Repeat("x", 400)))
+
+	if image.ErrorCode != errorCodeFetchError {
+		t.Errorf("error code %q, want %q", image.ErrorCode, errorCodeFetchError)
+	}
+
+	if len(image.LastError) != maxLastErrorLength {
+		t.Errorf("last error is %d characters, want %d", len(image.LastError), maxLastErrorLength)
+	}
+}
+
+func TestUpdateImageRefInDbRecordsError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	image := AbtImage{FileId: 7, State: "failed"}
+	setImageError(&image, errorCodeFetchTimeout, context.DeadlineExceeded)
+
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files`")).
+		ExpectExec().
+		WithArgs("", nil, 0, "", nil, nil, nil, nil, nil, nil, errorCodeFetchTimeout, "context deadline exceeded", "failed", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	updater, err := newImageRefUpdater(context.Background(), db, 1, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updater.update(context.Background(), image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: mysqlErrDupEntry, Message: "Duplicate entry"}, true},
+		{fmt.Errorf("update: %w", &mysql.MySQLError{Number: mysqlErrDupEntry}), true},
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, false},
+		{errors.New("Duplicate entry"), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isDuplicateKeyError(test.err); got != test.want {
+			t.Errorf("isDuplicateKeyError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestImageRefUpdaterRejectsDuplicates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files` SET `mime_type` = ?")).
+		ExpectExec().
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrDupEntry, Message: "Duplicate entry '/media/1.png' for key 'ingested_uri'"})
+
+	mock.ExpectExec(regexp.QuoteMeta("SET `error_code` = ?, `last_error` = ?, `state` = 'rejected'")).
+		WithArgs(errorCodeDuplicate, nonEmptyString{}, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	updater, err := newImageRefUpdater(context.Background(), db, 1, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recorded as rejected instead, so the update itself succeeds
+	err = updater.update(context.Background(), AbtImage{FileId: 7, State: "retrieved", S3Url: "/media/1.png"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
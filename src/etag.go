@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func fileMD5(file *os.File) (string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return "", err
+	}
+
+	hash := md5.New()
+
+	_, err = io.Copy(hash, file)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkUploadETag compares the ETag S3 returned for an upload with the MD5 of
+// the file sent. ETags are only an MD5 for single part uploads without KMS
+// encryption, so anything else passes unchecked. Multipart ETags end in
+// -<number of parts>.
+func checkUploadETag(awsConfig AwsConfig, etag *string, localMD5 string) error {
+	if etag == nil || awsConfig.SSE == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+
+	remoteMD5 := strings.Trim(*etag, `"`)
+
+	if strings.Contains(remoteMD5, "-") {
+		return nil
+	}
+
+	if !strings.EqualFold(remoteMD5, localMD5) {
+		return fmt.Errorf("%w: stored %s, sent %s", ErrETagMismatch, remoteMD5, localMD5)
+	}
+
+	return nil
+}
+
+// deleteCorruptObject removes an object that didn't match what was sent, so a
+// damaged copy is never served.
+func deleteCorruptObject(ctx context.Context, s3Client S3API, awsConfig AwsConfig, s3ObjectKey string) {
+	err := deleteObject(ctx, s3Client, awsConfig, s3ObjectKey)
+
+	if err != nil {
+		fmt.Println("could not delete corrupt object", s3ObjectKey, err)
+		return
+	}
+
+	fmt.Println("deleted corrupt object", s3ObjectKey)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// md5 of "data"
+const testDataMD5 = "8d777f385d3dfec8815d20f7496026dc"
+
+func TestCheckUploadETag(t *testing.T) {
+	tests := []struct {
+		name      string
+		awsConfig AwsConfig
+		etag      *string
+		wantErr   bool
+	}{
+		{"match", AwsConfig{}, aws.String(`"` + testDataMD5 + `"`), false},
+		{"match in upper case", AwsConfig{}, aws.String(`"8D777F385D3DFEC8815D20F7496026DC"`), false},
+		{"mismatch", AwsConfig{}, aws.String(`"0123456789abcdef0123456789abcdef"`), true},
+		{"no etag", AwsConfig{}, nil, false},
+		{"multipart", AwsConfig{}, aws.String(`"0123456789abcdef0123456789abcdef-3"`), false},
+		{"kms", AwsConfig{SSE: s3.ServerSideEncryptionAwsKms}, aws.String(`"0123456789abcdef0123456789abcdef"`), false},
+	}
+
+	for _, test := range tests {
+		err := checkUploadETag(test.awsConfig, test.etag, testDataMD5)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want error %t", test.name, err, test.wantErr)
+		}
+
+		if err != nil && !errors.Is(err, ErrETagMismatch) {
+			t.Errorf("%s: got %v, want ErrETagMismatch", test.name, err)
+		}
+	}
+}
+
+func TestPutFileToCloudRetriesETagMismatch(t *testing.T) {
+	baseDelay := uploadRetryBaseDelay
+	uploadRetryBaseDelay = time.Millisecond
+
+	t.Cleanup(func() {
+		uploadRetryBaseDelay = baseDelay
+	})
+
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		corruptPuts int
+		wantPuts    int
+		wantDeletes int
+		wantErr     bool
+	}{
+		{"intact", 0, 1, 0, false},
+		// A damaged upload is overwritten by the retry
+		{"corrupt once", 1, 2, 0, false},
+		// Once the retries are used up the damaged object is removed
+		{"always corrupt", 3, 3, 1, true},
+	}
+
+	for _, test := range tests {
+		puts, deletes := 0, 0
+
+		s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPut:
+				puts++
+				etag := testDataMD5
+
+				if puts <= test.corruptPuts {
+					etag = "0123456789abcdef0123456789abcdef"
+				}
+
+				w.Header().Set("ETag", `"`+etag+`"`)
+			case http.MethodDelete:
+				deletes++
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+
+		awsConfig := AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute), MaxUploadRetries: 2}
+
+		err = putFileToCloud(context.Background(), s3Client, awsConfig, "media/1.png", localFilename, putOptions{ContentType: "image/png"})
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want error %t", test.name, err, test.wantErr)
+		}
+
+		if test.wantErr && !errors.Is(err, ErrETagMismatch) {
+			t.Errorf("%s: got %v, want ErrETagMismatch", test.name, err)
+		}
+
+		if puts != test.wantPuts || deletes != test.wantDeletes {
+			t.Errorf("%s: got %d puts and %d deletes, want %d and %d", test.name, puts, deletes, test.wantPuts, test.wantDeletes)
+		}
+	}
+}
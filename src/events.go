@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	eventSinkSqs     = "sqs"
+	eventSinkWebhook = "webhook"
+
+	eventTypeFileRetrieved = "file.retrieved"
+	eventPublishTimeout    = 10 * time.Second
+)
+
+// EventsConfig says where an event is sent each time a file is stored, so
+// other services can react without polling the files table. Sink is sqs or
+// webhook, and no events are sent when it's empty. Region defaults to the
+// aws region.
+type EventsConfig struct {
+	Sink       string `json:"sink"`
+	QueueUrl   string `json:"queueUrl"`
+	Region     string `json:"region"`
+	WebhookUrl string `json:"webhookUrl"`
+}
+
+func (c EventsConfig) validate() error {
+	switch c.Sink {
+	case "":
+		return nil
+	case eventSinkSqs:
+		if c.QueueUrl == "" {
+			return errors.New("events.queueUrl is required for the sqs sink")
+		}
+	case eventSinkWebhook:
+		if c.WebhookUrl == "" {
+			return errors.New("events.webhookUrl is required for the webhook sink")
+		}
+	default:
+		return fmt.Errorf("unknown events.sink %q, expected %s or %s", c.Sink, eventSinkSqs, eventSinkWebhook)
+	}
+
+	return nil
+}
+
+type fileEvent struct {
+	Type        string `json:"type"`
+	FileId      int64  `json:"fileId"`
+	PostId      int64  `json:"postId"`
+	Url         string `json:"url"`
+	ExternalUrl string `json:"externalUrl"`
+	MimeType    string `json:"mimeType"`
+	FileSize    int64  `json:"fileSize"`
+	Time        string `json:"time"`
+}
+
+func newFileRetrievedEvent(image AbtImage) fileEvent {
+	return fileEvent{
+		Type:        eventTypeFileRetrieved,
+		FileId:      image.FileId,
+		PostId:      image.PostId,
+		Url:         image.S3Url,
+		ExternalUrl: image.ExternalUrl.String(),
+		MimeType:    resolvedMimeType(image),
+		FileSize:    image.FileSize,
+		Time:        time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// Publisher sends events about processed files to a queue or service.
+type Publisher interface {
+	Publish(ctx context.Context, event fileEvent) error
+}
+
+// SQSAPI is the subset of the SQS client used to publish events. *sqs.SQS
+// satisfies it.
+type SQSAPI interface {
+	SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+}
+
+type sqsPublisher struct {
+	client   SQSAPI
+	queueUrl string
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, event fileEvent) error {
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = p.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueUrl),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"type": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(event.Type),
+			},
+		},
+	})
+
+	return err
+}
+
+type webhookPublisher struct {
+	client     *http.Client
+	webhookUrl string
+}
+
+func (p *webhookPublisher) Publish(ctx context.Context, event fileEvent) error {
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.webhookUrl, bytes.NewBuffer(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("events webhook responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// newPublisher creates the publisher for the configured sink, or returns nil
+// when events are turned off. SQS uses the same credentials as S3.
+func newPublisher(config AppConfig) (Publisher, error) {
+	switch config.Events.Sink {
+	case eventSinkSqs:
+		region := config.Events.Region
+
+		if region == "" {
+			region = config.Aws.Region
+		}
+
+		sqsConfig := &aws.Config{}
+
+		if !useDefaultCredentials(config.Aws) {
+			sqsConfig.Credentials = credentials.NewStaticCredentials(config.Aws.Key, config.Aws.Secret, "")
+		}
+
+		newSession, err := newAwsSession(sqsConfig, region)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &sqsPublisher{client: sqs.New(newSession), queueUrl: config.Events.QueueUrl}, nil
+	case eventSinkWebhook:
+		return &webhookPublisher{
+			client:     &http.Client{Timeout: eventPublishTimeout},
+			webhookUrl: config.Events.WebhookUrl,
+		}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	events []fileEvent
+	err    error
+}
+
+func (p *fakePublisher) Publish(_ context.Context, event fileEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.events = append(p.events, event)
+
+	return p.err
+}
+
+func (p *fakePublisher) published() []fileEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]fileEvent(nil), p.events...)
+}
+
+type fakeSqs struct {
+	input *sqs.SendMessageInput
+}
+
+func (f *fakeSqs) SendMessageWithContext(_ aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.input = input
+
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestProcessImagesPublishesRetrievedFiles(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	publisher := &fakePublisher{}
+	tc.cloner.publisher = publisher
+
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+	expectFileUpdate(tc.mock, 2, "", errorCodeHttp4xx, "failed")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 1, 100, "/a.png", 0),
+		tc.image(t, 2, 200, "/missing.png", 0),
+	})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	events := publisher.published()
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want one for the retrieved file", len(events))
+	}
+
+	event := events[0]
+
+	if event.Type != eventTypeFileRetrieved || event.FileId != 1 || event.PostId != 100 {
+		t.Errorf("got event %+v, want file.retrieved for file 1 of post 100", event)
+	}
+
+	if event.Url == "" || event.MimeType != "image/png" || event.FileSize != int64(len(testPng)) {
+		t.Errorf("event %+v is missing details of the stored file", event)
+	}
+}
+
+func TestProcessImagesKeepsGoingWhenPublishFails(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	tc.cloner.publisher = &fakePublisher{err: errors.New("queue unavailable")}
+
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 1, 100, "/a.png", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.cloner.summary.Succeeded != 1 {
+		t.Errorf("summary has %d succeeded, want 1", tc.cloner.summary.Succeeded)
+	}
+}
+
+func TestProcessImagesSkipsEventsWithoutDb(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	publisher := &fakePublisher{}
+	tc.cloner.publisher = publisher
+	tc.cloner.db = nil
+	tc.cloner.updater = nil
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 1, 100, "/a.png", 0)})
+
+	if tc.bucket.puts != 1 {
+		t.Errorf("got %d uploads, want 1", tc.bucket.puts)
+	}
+
+	if events := publisher.published(); len(events) != 0 {
+		t.Errorf("got %d events for a run without a db, want none", len(events))
+	}
+}
+
+func TestSqsPublisherSendsEvent(t *testing.T) {
+	client := &fakeSqs{}
+	publisher := &sqsPublisher{client: client, queueUrl: "https://sqs.example.com/queue"}
+
+	err := publisher.Publish(context.Background(), fileEvent{Type: eventTypeFileRetrieved, FileId: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(client.input.QueueUrl) != "https://sqs.example.com/queue" {
+		t.Errorf("sent to %s", aws.StringValue(client.input.QueueUrl))
+	}
+
+	if got := aws.StringValue(client.input.MessageAttributes["type"].StringValue); got != eventTypeFileRetrieved {
+		t.Errorf("got type attribute %q, want %s", got, eventTypeFileRetrieved)
+	}
+
+	var event fileEvent
+
+	err = json.Unmarshal([]byte(aws.StringValue(client.input.MessageBody)), &event)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.FileId != 1 {
+		t.Errorf("got file %d in the body, want 1", event.FileId)
+	}
+}
+
+func TestWebhookPublisherPostsEvent(t *testing.T) {
+	var got fileEvent
+	status := http.StatusNoContent
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	publisher := &webhookPublisher{client: server.Client(), webhookUrl: server.URL}
+
+	err := publisher.Publish(context.Background(), fileEvent{Type: eventTypeFileRetrieved, FileId: 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.FileId != 3 {
+		t.Errorf("got file %d posted, want 3", got.FileId)
+	}
+
+	status = http.StatusBadGateway
+
+	if publisher.Publish(context.Background(), fileEvent{FileId: 4}) == nil {
+		t.Error("expected an error for a non-2xx response")
+	}
+}
+
+func TestEventsConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  EventsConfig
+		wantErr bool
+	}{
+		{EventsConfig{}, false},
+		{EventsConfig{Sink: eventSinkSqs, QueueUrl: "https://sqs.example.com/queue"}, false},
+		{EventsConfig{Sink: eventSinkSqs}, true},
+		{EventsConfig{Sink: eventSinkWebhook, WebhookUrl: "https://hooks.example.com"}, false},
+		{EventsConfig{Sink: eventSinkWebhook}, true},
+		{EventsConfig{Sink: "kafka"}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.config.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%+v: got %v, want error %t", test.config, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const reencodeJpegQuality = 95
+
+func readExifOrientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+// applyOrientation returns img transformed so that it displays upright without
+// the EXIF orientation tag. See the EXIF spec for the meaning of values 1-8.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation == 1 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	outWidth, outHeight := width, height
+
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+
+			dst.Set(dx, dy, src.At(x, y))
+		}
+	}
+
+	return dst
+}
+
+// stripExif re-encodes a downloaded JPEG without any metadata, baking the EXIF
+// orientation into the pixels first. Other file types are left untouched.
+func stripExif(abtImage *AbtImage) error {
+	if abtImage.MimeType != "image/jpeg" && abtImage.FileExt != ".jpg" && abtImage.FileExt != ".jpeg" {
+		return nil
+	}
+
+	data, err := os.ReadFile(abtImage.LocalFilename)
+
+	if err != nil {
+		return err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	img = applyOrientation(img, readExifOrientation(data))
+
+	var out bytes.Buffer
+
+	err = jpeg.Encode(&out, img, &jpeg.Options{Quality: reencodeJpegQuality})
+
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(abtImage.LocalFilename, out.Bytes(), 0644)
+
+	if err != nil {
+		return err
+	}
+
+	abtImage.FileSize = int64(out.Len())
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exifJpeg encodes a 4x2 JPEG, red on the left and blue on the right, with an
+// EXIF block holding a camera make and the given orientation.
+func exifJpeg(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if x < 2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+
+	var encoded bytes.Buffer
+
+	err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A little-endian TIFF header and one IFD with Make and Orientation
+	var tiff bytes.Buffer
+	tiff.WriteString("II")
+	binary.Write(&tiff, binary.LittleEndian, uint16(42))
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	binary.Write(&tiff, binary.LittleEndian, uint16(2))
+
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x010f))
+	binary.Write(&tiff, binary.LittleEndian, uint16(2))
+	binary.Write(&tiff, binary.LittleEndian, uint32(4))
+	tiff.WriteString("ACM\x00")
+
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x0112))
+	binary.Write(&tiff, binary.LittleEndian, uint16(3))
+	binary.Write(&tiff, binary.LittleEndian, uint32(1))
+	binary.Write(&tiff, binary.LittleEndian, orientation)
+	binary.Write(&tiff, binary.LittleEndian, uint16(0))
+
+	binary.Write(&tiff, binary.LittleEndian, uint32(0))
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+
+	return out.Bytes()
+}
+
+func TestReadExifOrientation(t *testing.T) {
+	if orientation := readExifOrientation(exifJpeg(t, 6)); orientation != 6 {
+		t.Errorf("got orientation %d, want 6", orientation)
+	}
+
+	if orientation := readExifOrientation([]byte("not a jpeg")); orientation != 1 {
+		t.Errorf("got orientation %d for a file without exif, want 1", orientation)
+	}
+}
+
+func TestStripExifKeepsOrientation(t *testing.T) {
+	localFilename := filepath.Join(t.TempDir(), "1.jpg")
+
+	err := os.WriteFile(localFilename, exifJpeg(t, 6), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{LocalFilename: localFilename, MimeType: "image/jpeg", FileExt: ".jpg"}
+
+	err = stripExif(&image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte("Exif")) || bytes.Contains(data, []byte("ACM")) {
+		t.Error("expected the exif block to be stripped")
+	}
+
+	if image.FileSize != int64(len(data)) {
+		t.Errorf("got file size %d, want %d", image.FileSize, len(data))
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Orientation 6 is a quarter turn clockwise, so the red left half ends up
+	// on top
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 4 {
+		t.Fatalf("got %dx%d, want 2x4", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	top, _, _, _ := img.At(0, 0).RGBA()
+	bottom, _, _, _ := img.At(0, 3).RGBA()
+
+	if top < 0x8000 || bottom > 0x8000 {
+		t.Errorf("expected red on top and blue at the bottom, got red %x and %x", top, bottom)
+	}
+}
+
+func TestStripExifLeavesOtherFiles(t *testing.T) {
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("png data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{LocalFilename: localFilename, MimeType: "image/png", FileExt: ".png"}
+
+	err = stripExif(&image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil || string(data) != "png data" {
+		t.Errorf("expected the png to be left alone, got %q %v", data, err)
+	}
+}
+
+func TestStripExifRejectsCorruptJpegs(t *testing.T) {
+	localFilename := filepath.Join(t.TempDir(), "1.jpg")
+
+	err := os.WriteFile(localFilename, []byte("not a jpeg"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{LocalFilename: localFilename, MimeType: "image/jpeg", FileExt: ".jpg"}
+
+	if stripExif(&image) == nil {
+		t.Error("expected an error for a corrupt jpeg")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// safeExtPattern is what an extension must look like to be used in a local
+// filename or object key: a dot and a few letters or digits.
+var safeExtPattern = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// sanitizeExt returns ext lowercased with anything after a query, fragment or
+// parameter separator cut off, or "" if what's left isn't a plain extension.
+// So ".JPG?v=2" becomes ".jpg" and ".jpg/../../x" is dropped altogether.
+func sanitizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+
+	if i := strings.IndexAny(ext, "?#;&"); i >= 0 {
+		ext = ext[:i]
+	}
+
+	if !safeExtPattern.MatchString(ext) {
+		return ""
+	}
+
+	return ext
+}
+
+// urlFileExt is the extension of the last element of the URL's path, leaving
+// out the query string and fragment.
+func urlFileExt(u *url.URL) string {
+	return sanitizeExt(path.Ext(u.Path))
+}
+
+// validateLocalFilename checks the name given to a downloaded file before it's
+// created, so it can't point outside the temp dir or carry characters that
+// don't belong in a filename or object key.
+func validateLocalFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("invalid local filename %q", filename)
+	}
+
+	for _, r := range filename {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return fmt.Errorf("invalid local filename %q", filename)
+		}
+	}
+
+	return nil
+}
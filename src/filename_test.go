@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeExt(t *testing.T) {
+	tests := []struct {
+		ext  string
+		want string
+	}{
+		{".jpg", ".jpg"},
+		{".JPG", ".jpg"},
+		{" .png ", ".png"},
+		{".jpg?v=2", ".jpg"},
+		{".jpg#frag", ".jpg"},
+		{".jpg;jsessionid=1", ".jpg"},
+		{".jpg&x=1", ".jpg"},
+		{".jpg?x=../../etc/passwd", ".jpg"},
+		{".jpg/../../x", ""},
+		{".jpg\\..\\x", ""},
+		{"./../../etc/passwd", ""},
+		{"..", ""},
+		{".", ""},
+		{"", ""},
+		{"jpg", ""},
+		{".jp g", ""},
+		{".jpg\x00.sh", ""},
+		{".jpg\n", ".jpg"},
+		{".j\npg", ""},
+		{".averyveryverylongextension", ""},
+		{".jpé", ""},
+		{".%2e%2e", ""},
+	}
+
+	for _, test := range tests {
+		got := sanitizeExt(test.ext)
+
+		if got != test.want {
+			t.Errorf("sanitizeExt(%q) = %q, want %q", test.ext, got, test.want)
+		}
+	}
+}
+
+func TestUrlFileExt(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/a/b.JPEG", ".jpeg"},
+		{"https://example.com/a/b.png?x=../../y.sh", ".png"},
+		{"https://example.com/a/b.png#../../y", ".png"},
+		{"https://example.com/a/b", ""},
+		{"https://example.com/a.d/b", ""},
+		{"https://example.com/a/b.png%2F..%2F..%2Fx", ""},
+		{"https://example.com/a/b.png%00", ""},
+		{"https://example.com/a/b.p%20ng", ""},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := urlFileExt(u)
+
+		if got != test.want {
+			t.Errorf("urlFileExt(%s) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestValidateLocalFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		wantErr  bool
+	}{
+		{"1700000000.1.2.abc.jpg", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../x.jpg", true},
+		{"a/b.jpg", true},
+		{"a\\b.jpg", true},
+		{"a\x00.jpg", true},
+		{"a\n.jpg", true},
+	}
+
+	for _, test := range tests {
+		err := validateLocalFilename(test.filename)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateLocalFilename(%q) = %v, want error %t", test.filename, err, test.wantErr)
+		}
+	}
+}
+
+func TestSetIngestedFilenameStaysInTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+
+	for _, ext := range []string{".jpg", ".PNG?x=1", ".jpg/../../../etc/cron.d/x", "/../../x", ".sh\x00"} {
+		image := AbtImage{FileId: 1, PostId: 2, FileExt: ext, MimeType: "image/jpeg"}
+
+		err := setIngestedFilename(&image, tempDir)
+
+		if sanitizeExt(ext) == "" {
+			if !errors.Is(err, ErrUnsupportedMime) || image.LocalFilename != "" {
+				t.Errorf("extension %q gave %q and %v, want it refused", ext, image.LocalFilename, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Dir(image.LocalFilename) != tempDir || !strings.HasSuffix(image.LocalFilename, sanitizeExt(ext)) {
+			t.Errorf("extension %q gave %s", ext, image.LocalFilename)
+		}
+	}
+}
+
+func TestValidateRejectsUnsafeMediaTypeExt(t *testing.T) {
+	config := AppConfig{MediaTypes: map[string]MediaType{"image/x-evil": {Ext: ".jpg/../../x", Category: "image"}}}
+	setConfigDefaults(&config)
+
+	err := config.Validate()
+
+	if err == nil || !strings.Contains(err.Error(), "image/x-evil") {
+		t.Errorf("got %v, want the unsafe extension rejected", err)
+	}
+}
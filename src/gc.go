@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type orphanedFile struct {
+	FileId       int64
+	IngestedUri  sql.NullString
+	ThumbnailUri sql.NullString
+	// InUse is set when a file of a post that still exists points at the same
+	// object, as rows sharing a URL are given the same one
+	InUse bool
+}
+
+// getOrphanedFilesFromDb finds files whose post has been deleted.
+func getOrphanedFilesFromDb(ctx context.Context, db *sql.DB, limit int) ([]orphanedFile, error) {
+	var files []orphanedFile
+
+	getRows, err := db.QueryContext(
+		ctx,
+		"SELECT f.pk_file_id, f.ingested_uri, f.thumbnail_uri, "+
+			"EXISTS ("+
+			"SELECT 1 FROM rss_aggregator.files shared "+
+			"JOIN rss_aggregator.posts live ON live.pk_post_id = shared.fk_post_id "+
+			"WHERE shared.ingested_uri = f.ingested_uri"+
+			") AS in_use "+
+			"FROM rss_aggregator.files f "+
+			"LEFT JOIN rss_aggregator.posts p ON p.pk_post_id = f.fk_post_id "+
+			"WHERE p.pk_post_id IS NULL "+
+			"ORDER BY f.pk_file_id "+
+			"LIMIT ?",
+		limit,
+	)
+
+	if err != nil {
+		return files, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		_ = getRows.Close()
+	}(getRows)
+
+	for getRows.Next() {
+		var file orphanedFile
+
+		err = getRows.Scan(&file.FileId, &file.IngestedUri, &file.ThumbnailUri, &file.InUse)
+
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, getRows.Err()
+}
+
+func deleteObject(ctx context.Context, s3Client S3API, awsConfig AwsConfig, s3ObjectKey string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(awsConfig.RequestTimeout))
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	_, err := s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(s3ObjectKey),
+	})
+
+	return err
+}
+
+// deleteFileFromDb deletes a file's row, and its logged attempts first when
+// there may be any.
+func deleteFileFromDb(ctx context.Context, db *sql.DB, fileId int64, withAttempts bool) error {
+	if withAttempts {
+		_, err := db.ExecContext(ctx, "DELETE FROM `file_attempts` WHERE `fk_file_id` = ?", fileId)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.ExecContext(ctx, "DELETE FROM `files` WHERE `pk_file_id` = ?", fileId)
+
+	return err
+}
+
+// orphanedObjectKeys are the objects of a file that can be deleted: its image
+// and thumbnail, unless a live post's file shares them.
+func orphanedObjectKeys(file orphanedFile) []string {
+	var keys []string
+
+	if file.InUse || !file.IngestedUri.Valid || file.IngestedUri.String == "" {
+		return keys
+	}
+
+	keys = append(keys, file.IngestedUri.String)
+
+	if file.ThumbnailUri.Valid && file.ThumbnailUri.String != "" {
+		keys = append(keys, file.ThumbnailUri.String)
+	}
+
+	return keys
+}
+
+// deleteFromMirrors deletes a file's object from each mirror, reporting
+// whether any of them failed.
+func deleteFromMirrors(ctx context.Context, mirrors []uploadTarget, s3ObjectKey string, fileId int64) bool {
+	failed := false
+
+	for _, mirror := range mirrors {
+		err := deleteObject(ctx, mirror.client, mirror.awsConfig, s3ObjectKey)
+
+		if err != nil {
+			fmt.Println("could not delete object", s3ObjectKey, "of file", fileId, "from mirror", mirror.awsConfig.Name, err)
+			failed = true
+		}
+	}
+
+	return failed
+}
+
+// deleteOrphanedFiles deletes the objects and rows of up to limit files whose
+// post no longer exists, along with their copies on any mirrors. With dryRun
+// it only lists what would be deleted.
+func deleteOrphanedFiles(ctx context.Context, db *sql.DB, s3Client S3API, mirrors []uploadTarget, config AppConfig, limit int, dryRun bool) error {
+	files, err := getOrphanedFilesFromDb(ctx, db, limit)
+
+	if err != nil {
+		return err
+	}
+
+	deletedFiles := 0
+	deletedObjects := 0
+
+	for _, file := range files {
+		keys := orphanedObjectKeys(file)
+
+		if dryRun {
+			fmt.Println("would delete file", file.FileId, "and objects", keys)
+			continue
+		}
+
+		failed := false
+
+		for _, key := range keys {
+			err = deleteObject(ctx, s3Client, config.Aws, key)
+
+			if err != nil {
+				fmt.Println("could not delete object", key, "of file", file.FileId, err)
+				failed = true
+				break
+			}
+
+			deletedObjects++
+		}
+
+		// Mirrors only hold the image, not its thumbnail
+		if !failed && len(keys) > 0 {
+			failed = deleteFromMirrors(ctx, mirrors, keys[0], file.FileId)
+		}
+
+		// Keep the row so the objects are tried again next time
+		if failed {
+			continue
+		}
+
+		err = deleteFileFromDb(ctx, db, file.FileId, config.AttemptLog.Enabled || config.AttemptLog.MaxAge > 0)
+
+		if err != nil {
+			fmt.Println("could not delete file", file.FileId, err)
+			continue
+		}
+
+		deletedFiles++
+		fmt.Println("deleted file", file.FileId, "and objects", keys)
+	}
+
+	if dryRun {
+		fmt.Printf("found %d orphaned files\n", len(files))
+	} else {
+		fmt.Printf("deleted %d of %d orphaned files and %d objects\n", deletedFiles, len(files), deletedObjects)
+	}
+
+	return nil
+}
+
+// runGc deletes the objects and rows of files whose post no longer exists,
+// including their copies on any mirrors. With --dry-run it only lists what would be deleted.
+func runGc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list what would be deleted without deleting anything")
+	limit := flags.Int("limit", 1000, "maximum number of orphaned files to delete")
+	configPath := flags.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := makeDbConnection(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	s3Client, err := makeS3Client(config)
+
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := mirrorTargets(config.Aws)
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	err = deleteOrphanedFiles(ctx, db, s3Client, mirrors, config, *limit, *dryRun)
+
+	if err != nil {
+		return err
+	}
+
+	if config.AttemptLog.MaxAge > 0 {
+		return gcAttempts(ctx, db, time.Now().Add(-time.Duration(config.AttemptLog.MaxAge)), *limit, *dryRun)
+	}
+
+	return nil
+}
+
+// gcAttempts deletes the attempts logged before the given time, limit at a
+// time so the table isn't locked for long.
+func gcAttempts(ctx context.Context, db *sql.DB, before time.Time, limit int, dryRun bool) error {
+	if dryRun {
+		count, err := countAttemptsBefore(ctx, db, before)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("would delete", count, "attempts logged before", before.UTC().Format(time.RFC3339))
+
+		return nil
+	}
+
+	var total int64
+
+	for {
+		deleted, err := pruneAttempts(ctx, db, before, limit)
+
+		if err != nil {
+			return err
+		}
+
+		total += deleted
+
+		if deleted == 0 || deleted < int64(limit) {
+			break
+		}
+	}
+
+	fmt.Println("deleted", total, "attempts logged before", before.UTC().Format(time.RFC3339))
+
+	return nil
+}
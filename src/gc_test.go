@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOrphanedObjectKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		file orphanedFile
+		want []string
+	}{
+		{
+			"image and thumbnail",
+			orphanedFile{IngestedUri: sql.NullString{String: "media/1.png", Valid: true}, ThumbnailUri: sql.NullString{String: "media/1.thumb.jpg", Valid: true}},
+			[]string{"media/1.png", "media/1.thumb.jpg"},
+		},
+		{
+			"image only",
+			orphanedFile{IngestedUri: sql.NullString{String: "media/2.png", Valid: true}},
+			[]string{"media/2.png"},
+		},
+		// A live post's file points at the same object
+		{
+			"shared",
+			orphanedFile{IngestedUri: sql.NullString{String: "media/3.png", Valid: true}, InUse: true},
+			nil,
+		},
+		{"never stored", orphanedFile{}, nil},
+	}
+
+	for _, test := range tests {
+		if got := orphanedObjectKeys(test.file); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func expectOrphanedFiles(mock sqlmock.Sqlmock, limit int) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT f.pk_file_id, f.ingested_uri, f.thumbnail_uri")).
+		WithArgs(limit).
+		WillReturnRows(sqlmock.NewRows([]string{"pk_file_id", "ingested_uri", "thumbnail_uri", "in_use"}).
+			AddRow(1, "media/1.png", "media/1.thumb.jpg", false).
+			AddRow(2, "media/2.png", nil, true).
+			AddRow(3, nil, nil, false).
+			AddRow(4, "media/stuck.png", nil, false))
+}
+
+func newGcBucket() *fakeBucket {
+	return &fakeBucket{
+		failKey: "stuck",
+		objects: map[string][]byte{
+			"/bucket/media/1.png":       testPng,
+			"/bucket/media/1.thumb.jpg": testPng,
+			"/bucket/media/2.png":       testPng,
+			"/bucket/media/stuck.png":   testPng,
+		},
+	}
+}
+
+func TestDeleteOrphanedFiles(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := newGcBucket()
+	config := AppConfig{Aws: AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute)}}
+
+	expectOrphanedFiles(mock, 10)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `files` WHERE `pk_file_id` = ?")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `files` WHERE `pk_file_id` = ?")).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `files` WHERE `pk_file_id` = ?")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = deleteOrphanedFiles(context.Background(), db, newTestS3Client(t, bucket.ServeHTTP), nil, config, 10, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// File 4's row is kept, as its object couldn't be deleted
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	want := map[string][]byte{
+		"/bucket/media/2.png":     testPng,
+		"/bucket/media/stuck.png": testPng,
+	}
+
+	if !reflect.DeepEqual(bucket.objects, want) {
+		t.Errorf("left %d objects in the bucket, want the shared one and the one that failed", len(bucket.objects))
+	}
+}
+
+func TestDeleteOrphanedFilesDryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := newGcBucket()
+	config := AppConfig{Aws: AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute)}}
+
+	expectOrphanedFiles(mock, 10)
+
+	err = deleteOrphanedFiles(context.Background(), db, newTestS3Client(t, bucket.ServeHTTP), nil, config, 10, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any delete would have been an unexpected call
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bucket.deletes != 0 || len(bucket.objects) != 4 {
+		t.Errorf("dry run sent %d deletes and left %d objects, want none deleted", bucket.deletes, len(bucket.objects))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HostAuthConfig holds the credentials sent to one source host, either HTTP
+// basic auth or a bearer token. The password and token can be read from files
+// like the other secrets.
+type HostAuthConfig struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"passwordFile"`
+	Token        string `json:"token"`
+	TokenFile    string `json:"tokenFile"`
+}
+
+// applyHostAuth adds the credentials configured for the request's host, if
+// any. The http client drops the Authorization header when redirected to
+// another domain, so they aren't passed on to third parties.
+func applyHostAuth(req *http.Request, hostAuth map[string]HostAuthConfig) {
+	auth, ok := hostAuth[strings.ToLower(req.URL.Hostname())]
+
+	if !ok {
+		return
+	}
+
+	if auth.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	} else if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
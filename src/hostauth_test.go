@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFetchStoreImageFromUrlSendsHostAuth(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{
+		HostAuth: map[string]HostAuthConfig{
+			"Private.Example.com": {Username: "cloner", Password: "hunter2"},
+			"api.example.com":     {Token: "abc123", Username: "ignored"},
+		},
+	}
+
+	gotAuth := map[string]string{}
+
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		gotAuth[r.URL.Hostname()] = r.Header.Get("authorization")
+		w.Header().Set("content-type", "image/png")
+		_, _ = w.Write(testPng)
+	})
+
+	tests := []struct {
+		url      string
+		wantAuth string
+	}{
+		// Hosts match whatever case they're configured or linked in
+		{"http://private.example.com/a.png", "Basic Y2xvbmVyOmh1bnRlcjI="},
+		{"http://PRIVATE.example.com/b.png", "Basic Y2xvbmVyOmh1bnRlcjI="},
+		{"http://api.example.com/c.png", "Bearer abc123"},
+		{"http://images.example.com/d.png", ""},
+	}
+
+	for i, test := range tests {
+		image := AbtImage{FileId: int64(i + 1), PostId: 1, ExternalUrl: testUrl(t, test.url)}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		host := image.ExternalUrl.Hostname()
+
+		if gotAuth[host] != test.wantAuth {
+			t.Errorf("%s sent authorization %q, want %q", test.url, gotAuth[host], test.wantAuth)
+		}
+	}
+}
+
+func TestResolveSecretFilesReadsHostAuthFiles(t *testing.T) {
+	config := AppConfig{
+		HostAuth: map[string]HostAuthConfig{
+			"private.example.com": {Username: "cloner", PasswordFile: writeSecretFile(t, "password", "hunter2\n")},
+			"api.example.com":     {Token: "inline", TokenFile: writeSecretFile(t, "token", "abc123\n")},
+		},
+	}
+
+	err := resolveSecretFiles(&config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config.HostAuth["private.example.com"].Password; got != "hunter2" {
+		t.Errorf("got password %q, want hunter2", got)
+	}
+
+	if got := config.HostAuth["api.example.com"].Token; got != "abc123" {
+		t.Errorf("got token %q, want abc123", got)
+	}
+}
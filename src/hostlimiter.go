@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type hostLimit struct {
+	slots   chan struct{}
+	limiter *rate.Limiter
+}
+
+// hostLimiter caps how many fetches run at once against a single host and
+// optionally how many are started per second. A zero value for either setting
+// means no limit.
+type hostLimiter struct {
+	mutex          sync.Mutex
+	maxConcurrency int
+	ratePerSec     float64
+	hosts          map[string]*hostLimit
+}
+
+func newHostLimiter(maxConcurrency int, ratePerSec float64) *hostLimiter {
+	return &hostLimiter{
+		maxConcurrency: maxConcurrency,
+		ratePerSec:     ratePerSec,
+		hosts:          make(map[string]*hostLimit),
+	}
+}
+
+func (l *hostLimiter) limitFor(host string) *hostLimit {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	host = strings.ToLower(host)
+	limit, ok := l.hosts[host]
+
+	if !ok {
+		limit = &hostLimit{}
+
+		if l.maxConcurrency > 0 {
+			limit.slots = make(chan struct{}, l.maxConcurrency)
+		}
+
+		if l.ratePerSec > 0 {
+			limit.limiter = rate.NewLimiter(rate.Limit(l.ratePerSec), 1)
+		}
+
+		l.hosts[host] = limit
+	}
+
+	return limit
+}
+
+// acquire blocks until a fetch against host may start. The returned function
+// must be called once the fetch has finished.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	limit := l.limitFor(host)
+	release := func() {}
+
+	if limit.slots != nil {
+		select {
+		case limit.slots <- struct{}{}:
+			release = func() {
+				<-limit.slots
+			}
+		case <-ctx.Done():
+			return release, ctx.Err()
+		}
+	}
+
+	if limit.limiter != nil {
+		err := limit.limiter.Wait(ctx)
+
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+	}
+
+	return release, nil
+}
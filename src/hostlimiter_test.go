@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterSerializesSameHost(t *testing.T) {
+	limiter := newHostLimiter(1, 0)
+	ctx := context.Background()
+
+	release, err := limiter.acquire(ctx, "a.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another host isn't held up by the first one's fetch
+	releaseOther, err := limiter.acquire(ctx, "b.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseOther()
+
+	acquired := make(chan struct{})
+
+	go func() {
+		releaseSecond, err := limiter.acquire(ctx, "A.example.com")
+
+		if err == nil {
+			releaseSecond()
+		}
+
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("a second fetch against the same host started while the first was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the second fetch didn't start once the first finished")
+	}
+}
+
+func TestHostLimiterStopsWaitingWhenCanceled(t *testing.T) {
+	limiter := newHostLimiter(1, 0)
+
+	release, err := limiter.acquire(context.Background(), "example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = limiter.acquire(ctx, "example.com")
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the wait to time out", err)
+	}
+}
+
+func TestHostLimiterRate(t *testing.T) {
+	limiter := newHostLimiter(0, 20)
+	started := time.Now()
+
+	for i := 0; i < 3; i++ {
+		release, err := limiter.acquire(context.Background(), "example.com")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		release()
+	}
+
+	// The first fetch starts straight away and the next two 50ms apart
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("3 fetches at 20 a second took %v, want at least 100ms", elapsed)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// makeHttpClient builds the client shared by all image fetches in a run, so
+// connections to the same host are kept alive and reused. Requests
+// go through HttpProxy when it is set, otherwise through whatever
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY specify.
+func makeHttpClient(config AppConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+
+	// Connecting gets less time than the whole request, so hosts that are down
+	// fail fast without cutting short slow downloads from ones that are up
+	proxyDialer := &net.Dialer{
+		Timeout:   time.Duration(config.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	sourceDialer := &net.Dialer{
+		Timeout:   time.Duration(config.DialTimeout),
+		KeepAlive: 30 * time.Second,
+		Control:   publicAddressControl,
+	}
+
+	proxyHosts := proxyHostnames(config.HttpProxy)
+
+	// A configured proxy is allowed to be on the private network, the sources
+	// it's asked to fetch from are still checked by validateSourceUrl
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+
+		if err == nil && proxyHosts[strings.ToLower(host)] {
+			return proxyDialer.DialContext(ctx, network, address)
+		}
+
+		return sourceDialer.DialContext(ctx, network, address)
+	}
+
+	if config.HttpProxy != "" {
+		proxyUrl, err := url.Parse(config.HttpProxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			return validateSourceUrl(req.URL, config.AllowedHosts)
+		},
+	}
+
+	return client, nil
+}
+
+// publicAddressControl refuses connections to loopback, private and
+// link-local addresses. It's given the address after DNS resolution, so a host
+// can't pass a check with one answer and then be connected to at another, and
+// it covers redirects too.
+func publicAddressControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || !isPublicIp(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+
+	return nil
+}
+
+// proxyHostnames are the hosts of the proxies requests may be sent through,
+// from HttpProxy and the usual environment variables.
+func proxyHostnames(httpProxy string) map[string]bool {
+	hosts := map[string]bool{}
+	proxies := []string{httpProxy}
+
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		proxies = append(proxies, os.Getenv(name))
+	}
+
+	for _, proxy := range proxies {
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+
+		proxyUrl, err := url.Parse(proxy)
+
+		if err == nil && proxyUrl.Hostname() != "" {
+			hosts[strings.ToLower(proxyUrl.Hostname())] = true
+		}
+	}
+
+	return hosts
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublicAddressControl(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.1.2.3:80", true},
+		{"192.168.0.10:8080", true},
+		{"169.254.169.254:80", true},
+		{"[fe80::1]:80", true},
+		{"0.0.0.0:80", true},
+	}
+
+	for _, test := range tests {
+		err := publicAddressControl("tcp", test.address, nil)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("publicAddressControl(%s) = %v, want error %t", test.address, err, test.wantErr)
+		}
+	}
+}
+
+// A hostname that passes validateSourceUrl is still refused once it turns out
+// to point at a private address, which is what stops DNS rebinding
+func TestHttpClientRefusesLoopbackAfterResolving(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client, err := makeHttpClient(AppConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverUrl, err := url.Parse(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get("http://localhost:" + serverUrl.Port() + "/")
+
+	if err == nil {
+		t.Fatal("expected the connection to localhost to be refused")
+	}
+}
+
+func TestHttpClientRefusesRedirectToPrivateAddress(t *testing.T) {
+	client, err := makeHttpClient(AppConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://10.0.0.1/secret", nil)
+
+	err = client.CheckRedirect(req, []*http.Request{httptest.NewRequest("GET", "https://example.com/", nil)})
+
+	if err == nil {
+		t.Fatal("expected a redirect to a private address to be refused")
+	}
+}
+
+func TestProxyHostnames(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("http_proxy", "")
+	t.Setenv("HTTPS_PROXY", "proxy.internal:3128")
+	t.Setenv("https_proxy", "")
+
+	hosts := proxyHostnames("http://Squid.local:8080")
+
+	if !hosts["squid.local"] || !hosts["proxy.internal"] || len(hosts) != 2 {
+		t.Errorf("unexpected proxy hosts %v", hosts)
+	}
+}
+
+// The proxy is on loopback, which only sources are refused, and sees the
+// full URL of the image it's asked to fetch
+func TestHttpClientFetchesThroughProxy(t *testing.T) {
+	var proxiedUrl string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedUrl = r.URL.String()
+		_, _ = io.WriteString(w, "image data")
+	}))
+	defer proxy.Close()
+
+	client, err := makeHttpClient(AppConfig{HttpProxy: proxy.URL})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("http://images.example.com/a.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proxiedUrl != "http://images.example.com/a.png" || string(body) != "image data" {
+		t.Errorf("proxy got %q and returned %q", proxiedUrl, body)
+	}
+}
+
+func TestHttpClientUsesDialTimeout(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "image data")
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		dialTimeout time.Duration
+		wantTimeout bool
+	}{
+		{0, false},
+		{time.Second, false},
+		// Too short for any connection, even to a local proxy
+		{time.Nanosecond, true},
+	}
+
+	for _, test := range tests {
+		config := AppConfig{HttpProxy: proxy.URL, DialTimeout: Duration(test.dialTimeout)}
+		setConfigDefaults(&config)
+
+		client, err := makeHttpClient(config)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get("http://images.example.com/a.png")
+
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+
+		var netErr net.Error
+		timedOut := errors.As(err, &netErr) && netErr.Timeout()
+
+		if timedOut != test.wantTimeout {
+			t.Errorf("dial timeout %v: got %v, want a timeout %t", test.dialTimeout, err, test.wantTimeout)
+		}
+	}
+}
+
+func TestMakeHttpClientRejectsBadProxy(t *testing.T) {
+	_, err := makeHttpClient(AppConfig{HttpProxy: "http://[::1"})
+
+	if err == nil {
+		t.Error("expected an error for a malformed proxy url")
+	}
+}
+
+// The client is shared by a run's fetches, so connections are reused even for
+// failed fetches that leave their body unread
+func TestFetchesReuseConnections(t *testing.T) {
+	var newConns int32
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, strings.Repeat("unavailable ", 4000), http.StatusServiceUnavailable)
+	}))
+	proxy.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	config := AppConfig{HttpProxy: proxy.URL}
+	setConfigDefaults(&config)
+
+	client, err := makeHttpClient(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageUrl, err := url.Parse("http://images.example.com/a.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		image := AbtImage{FileId: int64(i), ExternalUrl: imageUrl}
+
+		err = fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if !hasHttpStatus(err, http.StatusServiceUnavailable) {
+			t.Fatalf("got %v, want a 503", err)
+		}
+	}
+
+	if newConns != 1 {
+		t.Errorf("5 fetches opened %d connections, want 1", newConns)
+	}
+
+	transport := client.Transport.(*http.Transport)
+
+	if transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != config.FetchWorkers {
+		t.Errorf("got %d idle connections and %d per host, want 100 and %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, config.FetchWorkers)
+	}
+}
+
+func hasHttpStatus(err error, statusCode int) bool {
+	var statusErr *httpStatusError
+
+	return errors.As(err, &statusErr) && statusErr.StatusCode == statusCode
+}
@@ -1,25 +1,36 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
+	cryptorand "crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"io"
-	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AbtImage struct {
@@ -35,447 +46,1800 @@ type AbtImage struct {
 	Modified      string
 	FileExt       string
 	S3Url         string
+	// StoredS3Url is the object a retrieved row already had when it was
+	// loaded, which a failed refresh leaves in place
+	StoredS3Url   string
+	LocalPath     string
 	Attempts      int64
+	Width         int64
+	Height        int64
+	IsAnimated    bool
+	ThumbFilename string
+	ThumbS3Url    string
+	ErrorCode     string
+	LastError     string
+	ETag          string
+	LastModified  string
+	FetchedAt     time.Time
+
+	// span traces the file's processing, see startImageSpan
+	span trace.Span
 }
 
 type AppConfig struct {
-	Db   DbConfig  `json:"db"`
-	Solr string    `json:"solr"`
-	Aws  AwsConfig `json:"aws"`
+	Db                    DbConfig                  `json:"db"`
+	Solr                  SolrConfig                `json:"solr"`
+	Otel                  OtelConfig                `json:"otel"`
+	Events                EventsConfig              `json:"events"`
+	Aws                   AwsConfig                 `json:"aws"`
+	BatchSize             int                       `json:"batchSize"`
+	AllowedHosts          []string                  `json:"allowedHosts"`
+	StripExif             bool                      `json:"stripExif"`
+	Thumbnails            ThumbnailConfig           `json:"thumbnails"`
+	Recompress            RecompressConfig          `json:"recompress"`
+	MinWidth              int64                     `json:"minWidth"`
+	MinHeight             int64                     `json:"minHeight"`
+	FetchWorkers          int                       `json:"fetchWorkers"`
+	UploadWorkers         int                       `json:"uploadWorkers"`
+	AttemptLog            AttemptLogConfig          `json:"attemptLog"`
+	MaxDbWriters          int                       `json:"maxDbWriters"`
+	DbBatchSize           int                       `json:"dbBatchSize"`
+	MaxAttempts           int                       `json:"maxAttempts"`
+	HostAttempts          map[string]int            `json:"hostAttempts"`
+	HostAuth              map[string]HostAuthConfig `json:"hostAuth"`
+	HostMimeOverrides     map[string]string         `json:"hostMimeOverrides"`
+	CircuitThreshold      int                       `json:"circuitThreshold"`
+	CircuitCooldown       Duration                  `json:"circuitCooldown"`
+	MaxPerHostConcurrency int                       `json:"maxPerHostConcurrency"`
+	PerHostRatePerSec     float64                   `json:"perHostRatePerSec"`
+	HttpProxy             string                    `json:"httpProxy"`
+	DialTimeout           Duration                  `json:"dialTimeout"`
+	MaxIdleConns          int                       `json:"maxIdleConns"`
+	MaxIdleConnsPerHost   int                       `json:"maxIdleConnsPerHost"`
+	MaxFileSize           int64                     `json:"maxFileSize"`
+	MinFileSize           int64                     `json:"minFileSize"`
+	MaxBytesPerRun        int64                     `json:"maxBytesPerRun"`
+	MediaTypes            map[string]MediaType      `json:"mediaTypes"`
+	AllowedMimeTypes      []string                  `json:"allowedMimeTypes"`
+	SanitizeSvg           bool                      `json:"sanitizeSvg"`
+	Cache                 CacheConfig               `json:"cache"`
+	StripQueryParams      []string                  `json:"stripQueryParams"`
+	SummaryWebhook        string                    `json:"summaryWebhook"`
+	AlertWebhook          string                    `json:"alertWebhook"`
+	AlertFailureRate      float64                   `json:"alertFailureRate"`
+	StatusAddr            string                    `json:"statusAddr"`
+	ClaimRows             bool                      `json:"claimRows"`
+	WorkerId              string                    `json:"workerId"`
+	ClaimTimeout          Duration                  `json:"claimTimeout"`
+	RunMode               string                    `json:"runMode"`
+	RunTimeout            Duration                  `json:"runTimeout"`
+	PerImageTimeout       Duration                  `json:"perImageTimeout"`
+	ShutdownGracePeriod   Duration                  `json:"shutdownGracePeriod"`
+	TempDir               string                    `json:"tempDir"`
+	StaleTempFileAge      Duration                  `json:"staleTempFileAge"`
+	KeepLocalCopies       bool                      `json:"keepLocalCopies"`
+	LocalMirrorDir        string                    `json:"localMirrorDir"`
+	DownloadOnly          bool                      `json:"downloadOnly"`
+	StartupJitter         bool                      `json:"startupJitter"`
+	TickJitter            Duration                  `json:"tickJitter"`
+	AlignToClock          bool                      `json:"alignToClock"`
+	ShuffleBatch          bool                      `json:"shuffleBatch"`
+	HostPriorities        map[string]int            `json:"hostPriorities"`
+}
+
+// Duration is a time.Duration read from config as a string such as "90s" or "10m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	err := json.Unmarshal(data, &value)
+
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
 }
 
 type DbConfig struct {
-	User     string `json:"user"`
-	Password string `json:"pass"`
-	Server   string `json:"server"`
-	DbName   string `json:"dbName"`
+	User         string `json:"user"`
+	Password     string `json:"pass"`
+	PasswordFile string `json:"passFile"`
+	Server       string `json:"server"`
+	ReadServer   string `json:"readServer"`
+	WriteServer  string `json:"writeServer"`
+	DbName       string `json:"dbName"`
+}
+
+// readServer is where the queries picking files to process go, such as a read
+// replica. Without one they share the write server.
+func (c DbConfig) readServer() string {
+	if c.ReadServer != "" {
+		return c.ReadServer
+	}
+
+	return c.writeServer()
+}
+
+func (c DbConfig) writeServer() string {
+	if c.WriteServer != "" {
+		return c.WriteServer
+	}
+
+	if c.Server != "" {
+		return c.Server
+	}
+
+	return c.ReadServer
+}
+
+// ThumbnailConfig controls the thumbnails stored alongside images. Animated
+// GIFs are thumbnailed from their first frame unless SkipAnimated is set.
+type ThumbnailConfig struct {
+	Enabled      bool `json:"enabled"`
+	MaxEdge      int  `json:"maxEdge"`
+	Quality      int  `json:"quality"`
+	SkipAnimated bool `json:"skipAnimated"`
+}
+
+// ObjectLockConfig makes uploaded objects immutable for Retention after they're
+// stored. The bucket must have Object Lock enabled. Mode is GOVERNANCE or
+// COMPLIANCE, and leaving it empty stores objects without a lock.
+type ObjectLockConfig struct {
+	Mode      string   `json:"mode"`
+	Retention Duration `json:"retention"`
+}
+
+type AwsConfig struct {
+	Name                  string            `json:"name"`
+	Key                   string            `json:"key"`
+	KeyFile               string            `json:"keyFile"`
+	Secret                string            `json:"secret"`
+	SecretFile            string            `json:"secretFile"`
+	Endpoint              string            `json:"endpoint"`
+	Region                string            `json:"region"`
+	Bucket                string            `json:"bucket"`
+	Folder                string            `json:"folder"`
+	ACL                   string            `json:"acl"`
+	SSE                   string            `json:"sse"`
+	KmsKeyId              string            `json:"kmsKeyId"`
+	CacheControl          string            `json:"cacheControl"`
+	ContentDisposition    string            `json:"contentDisposition"`
+	ForcePathStyle        *bool             `json:"forcePathStyle"`
+	UseDefaultCredentials bool              `json:"useDefaultCredentials"`
+	RequestTimeout        Duration          `json:"requestTimeout"`
+	KeyTemplate           string            `json:"keyTemplate"`
+	KeyStrategy           string            `json:"keyStrategy"`
+	Tagging               bool              `json:"tagging"`
+	StorageClass          string            `json:"storageClass"`
+	ThumbStorageClass     string            `json:"thumbStorageClass"`
+	MaxUploadRetries      int               `json:"maxUploadRetries"`
+	UseAccelerate         bool              `json:"useAccelerate"`
+	UseDualStack          bool              `json:"useDualStack"`
+	ObjectLock            ObjectLockConfig  `json:"objectLock"`
+	Mirrors               []AwsMirrorConfig `json:"mirrors"`
+
+	keyTemplate *template.Template
+	mirrors     []AwsConfig
+}
+
+func setConfigDefaults(config *AppConfig) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+
+	if config.WorkerId == "" {
+		config.WorkerId = defaultWorkerId()
+	}
+
+	if config.ClaimTimeout <= 0 {
+		config.ClaimTimeout = Duration(30 * time.Minute)
+	}
+
+	if config.Aws.KeyStrategy == "" {
+		config.Aws.KeyStrategy = keyStrategyTimestamp
+	}
+
+	if config.Aws.KeyTemplate == "" {
+		config.Aws.KeyTemplate = defaultKeyTemplate
+	}
+
+	if config.Aws.MaxUploadRetries <= 0 {
+		config.Aws.MaxUploadRetries = 3
+	}
+
+	if config.Aws.RequestTimeout <= 0 {
+		config.Aws.RequestTimeout = Duration(time.Minute)
+	}
+
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = 3145728
+	}
+
+	if config.Solr.ImageField == "" {
+		config.Solr.ImageField = "post_image"
+	}
+
+	if config.ShutdownGracePeriod <= 0 {
+		config.ShutdownGracePeriod = Duration(30 * time.Second)
+	}
+
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = Duration(2 * time.Second)
+	}
+
+	if config.CircuitCooldown <= 0 {
+		config.CircuitCooldown = Duration(5 * time.Minute)
+	}
+
+	// An empty file is never worth uploading
+	if config.MinFileSize <= 0 {
+		config.MinFileSize = 1
+	}
+
+	if config.TempDir == "" {
+		config.TempDir = "."
+	}
+
+	if config.StaleTempFileAge <= 0 {
+		config.StaleTempFileAge = Duration(6 * time.Hour)
+	}
+
+	if config.StripQueryParams == nil {
+		config.StripQueryParams = defaultStripQueryParams
+	}
+
+	config.MediaTypes = mergeMediaTypes(config.MediaTypes)
+
+	// Only what can be cloned at all is allowed unless the list narrows it
+	if len(config.AllowedMimeTypes) == 0 {
+		config.AllowedMimeTypes = mediaTypeMimeTypes(config.MediaTypes)
+	}
+
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 3
+	}
+
+	// Hosts are looked up lowercased, whatever case they're configured in
+	hostAttempts := make(map[string]int, len(config.HostAttempts))
+
+	for host, maxAttempts := range config.HostAttempts {
+		hostAttempts[strings.ToLower(host)] = maxAttempts
+	}
+
+	config.HostAttempts = hostAttempts
+
+	hostAuth := make(map[string]HostAuthConfig, len(config.HostAuth))
+
+	for host, auth := range config.HostAuth {
+		hostAuth[strings.ToLower(host)] = auth
+	}
+
+	config.HostAuth = hostAuth
+
+	hostMimeOverrides := make(map[string]string, len(config.HostMimeOverrides))
+
+	for host, mimeType := range config.HostMimeOverrides {
+		hostMimeOverrides[strings.ToLower(host)] = mimeType
+	}
+
+	config.HostMimeOverrides = hostMimeOverrides
+
+	hostPriorities := make(map[string]int, len(config.HostPriorities))
+
+	for host, priority := range config.HostPriorities {
+		hostPriorities[strings.ToLower(host)] = priority
+	}
+
+	config.HostPriorities = hostPriorities
+
+	if config.FetchWorkers <= 0 {
+		config.FetchWorkers = 4
+	}
+
+	if config.UploadWorkers <= 0 {
+		config.UploadWorkers = 2
+	}
+
+	if config.MaxDbWriters <= 0 {
+		config.MaxDbWriters = 4
+	}
+
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = 100
+	}
+
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = config.FetchWorkers
+	}
+
+	if config.Recompress.Quality <= 0 {
+		config.Recompress.Quality = 82
+	}
+
+	if config.Recompress.MinSavingsPercent <= 0 {
+		config.Recompress.MinSavingsPercent = 10
+	}
+
+	if config.Thumbnails.MaxEdge <= 0 {
+		config.Thumbnails.MaxEdge = 320
+	}
+
+	if config.Thumbnails.Quality <= 0 {
+		config.Thumbnails.Quality = 80
+	}
+}
+
+const defaultConfigPath = "config/config.json"
+
+var stdinConfigOnce sync.Once
+var stdinConfig []byte
+var stdinConfigErr error
+
+// readConfigFile reads the config at path, or from stdin when path is "-".
+// Stdin can only be read once, so its contents are kept for later runs.
+func readConfigFile(path string) ([]byte, error) {
+	if path != "-" {
+		return os.ReadFile(path)
+	}
+
+	stdinConfigOnce.Do(func() {
+		stdinConfig, stdinConfigErr = io.ReadAll(os.Stdin)
+	})
+
+	return stdinConfig, stdinConfigErr
+}
+
+func loadConfig(path string) (AppConfig, error) {
+	config := AppConfig{}
+
+	encodedJson, err := readConfigFile(path)
+
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(encodedJson, &config)
+
+	if err != nil {
+		return config, err
+	}
+
+	err = resolveSecretFiles(&config)
+
+	if err != nil {
+		return config, err
+	}
+
+	setConfigDefaults(&config)
+
+	err = config.Validate()
+
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// Validate checks the parts of the config that can be wrong in ways that would
+// otherwise only show up part way through a run.
+func (config *AppConfig) Validate() error {
+	keyTemplate, err := parseKeyTemplate(config.Aws.KeyTemplate)
+
+	if err != nil {
+		return fmt.Errorf("invalid aws.keyTemplate: %w", err)
+	}
+
+	config.Aws.keyTemplate = keyTemplate
+
+	if config.KeepLocalCopies && config.LocalMirrorDir == "" {
+		return errors.New("keepLocalCopies needs a localMirrorDir")
+	}
+
+	if config.DownloadOnly && config.LocalMirrorDir == "" {
+		return errors.New("downloadOnly needs a localMirrorDir")
+	}
+
+	err = config.Events.validate()
+
+	if err != nil {
+		return err
+	}
+
+	err = config.Aws.validateEndpoint()
+
+	if err != nil {
+		return err
+	}
+
+	err = config.Aws.validateMirrors()
+
+	if err != nil {
+		return err
+	}
+
+	if !isValidKeyStrategy(config.Aws.KeyStrategy) {
+		return fmt.Errorf("invalid aws.keyStrategy %q, expected %s or %s", config.Aws.KeyStrategy, keyStrategyTimestamp, keyStrategyDeterministic)
+	}
+
+	if config.Aws.ObjectLock.Mode != "" {
+		if config.Aws.ObjectLock.Mode != s3.ObjectLockModeGovernance && config.Aws.ObjectLock.Mode != s3.ObjectLockModeCompliance {
+			return fmt.Errorf("invalid aws.objectLock.mode %q, expected %s or %s", config.Aws.ObjectLock.Mode, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+		}
+
+		if config.Aws.ObjectLock.Retention <= 0 {
+			return errors.New("aws.objectLock needs a retention")
+		}
+	}
+
+	for mimeType, mediaType := range config.MediaTypes {
+		if mediaType.Ext != sanitizeExt(mediaType.Ext) {
+			return fmt.Errorf("mediaTypes for %s has extension %q, expected a dot followed by letters or digits", mimeType, mediaType.Ext)
+		}
+	}
+
+	for host, mimeType := range config.HostMimeOverrides {
+		if _, ok := config.MediaTypes[mimeType]; !ok {
+			return fmt.Errorf("hostMimeOverrides for %s is %q, which isn't one of the mediaTypes", host, mimeType)
+		}
+	}
+
+	_, err = solrCommitQuery(config.Solr.CommitStrategy)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func maxAttemptsForHost(config AppConfig, host string) int {
+	maxAttempts, ok := config.HostAttempts[strings.ToLower(host)]
+
+	if ok && maxAttempts > 0 {
+		return maxAttempts
+	}
+
+	return config.MaxAttempts
+}
+
+// makeDbConnection opens a connection to the write server, which everything
+// but the polling for files to process uses.
+func makeDbConnection(config AppConfig) (*sql.DB, error) {
+	return openDb(config, config.Db.writeServer())
+}
+
+func openDb(config AppConfig, server string) (*sql.DB, error) {
+
+	dbParams := make(map[string]string)
+	dbParams["charset"] = "utf8mb4"
+
+	dbConfig := mysql.Config{
+		User:   config.Db.User,
+		Passwd: config.Db.Password,
+		Net:    "tcp",
+		Addr:   server,
+		DBName: config.Db.DbName,
+		Params: dbParams,
+	}
+
+	db, err := sql.Open("mysql", dbConfig.FormatDSN())
+	if err != nil {
+		return db, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return db, err
+	}
+
+	fmt.Println("opened database connection to", server)
+
+	return db, nil
+}
+
+// dbPools holds the connections for a run: read for picking files to process,
+// write for recording results. They're the same pool when no separate read
+// server is configured.
+type dbPools struct {
+	read  *sql.DB
+	write *sql.DB
+}
+
+func makeDbPools(config AppConfig) (dbPools, error) {
+	var pools dbPools
+
+	write, err := makeDbConnection(config)
+
+	if err != nil {
+		return pools, err
+	}
+
+	pools.write = write
+	pools.read = write
+
+	if config.Db.readServer() == config.Db.writeServer() {
+		return pools, nil
+	}
+
+	read, err := openDb(config, config.Db.readServer())
+
+	if err != nil {
+		_ = write.Close()
+		return pools, err
+	}
+
+	pools.read = read
+
+	return pools, nil
+}
+
+func (p dbPools) close() error {
+	err := p.write.Close()
+
+	if p.read != p.write {
+		readErr := p.read.Close()
+
+		if err == nil {
+			err = readErr
+		}
+	}
+
+	return err
+}
+
+// usePathStyle reports whether objects should be addressed as endpoint/bucket/key.
+// Unless configured explicitly it is on for custom endpoints, as most
+// S3-compatible stores such as MinIO need it.
+func usePathStyle(awsConfig AwsConfig) bool {
+	if awsConfig.ForcePathStyle != nil {
+		return *awsConfig.ForcePathStyle
+	}
+
+	return awsConfig.Endpoint != ""
+}
+
+// S3API is the subset of the S3 client used by the cloner. *s3.S3 satisfies it.
+type S3API interface {
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error)
+	DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+func useDefaultCredentials(awsConfig AwsConfig) bool {
+	return awsConfig.UseDefaultCredentials || (awsConfig.Key == "" && awsConfig.Secret == "")
+}
+
+// useAwsEndpointFeatures reports whether AWS-only endpoint options, transfer
+// acceleration and dualstack, apply. Custom endpoints such as DigitalOcean
+// Spaces or MinIO don't offer them, so they're ignored there.
+func useAwsEndpointFeatures(awsConfig AwsConfig) bool {
+	return awsConfig.Endpoint == ""
+}
+
+func makeS3Client(config AppConfig) (*s3.S3, error) {
+	return makeS3ClientFor(config.Aws)
+}
+
+// makeS3ClientFor creates a client for the bucket awsConfig describes, the
+// primary or one of its mirrors.
+func makeS3ClientFor(awsConfig AwsConfig) (*s3.S3, error) {
+	s3Config := &aws.Config{
+		Endpoint:         aws.String(awsConfig.Endpoint),
+		S3ForcePathStyle: aws.Bool(usePathStyle(awsConfig)),
+		S3UseAccelerate:  aws.Bool(awsConfig.UseAccelerate && useAwsEndpointFeatures(awsConfig)),
+	}
+
+	if awsConfig.UseDualStack && useAwsEndpointFeatures(awsConfig) {
+		s3Config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+
+	// Leaving Credentials unset makes the SDK use its default provider chain:
+	// environment, shared config and then the instance or task IAM role.
+	if !useDefaultCredentials(awsConfig) {
+		s3Config.Credentials = credentials.NewStaticCredentials(awsConfig.Key, awsConfig.Secret, "")
+	}
+
+	newSession, err := newAwsSession(s3Config, awsConfig.Region)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(newSession), nil
+}
+
+const imageColumns = "pk_file_id, fk_post_id, external_url, file_category, state, created, attempts, ingested_uri, etag, last_modified "
+
+func scanImageRows(getRows *sql.Rows) ([]AbtImage, error) {
+	var images []AbtImage
+
+	for getRows.Next() {
+		var pkFileId int64
+		var fkPostId int64
+		var attempts int64
+		var externalUrl string
+		var fileCategory sql.NullString
+		var state string
+		var created string
+		var ingestedUri sql.NullString
+		var etag sql.NullString
+		var lastModified sql.NullString
+
+		err := getRows.Scan(
+			&pkFileId,
+			&fkPostId,
+			&externalUrl,
+			&fileCategory,
+			&state,
+			&created,
+			&attempts,
+			&ingestedUri,
+			&etag,
+			&lastModified,
+		)
+
+		if err != nil {
+			return images, err
+		}
+
+		externalUrlObj, err := url.Parse(externalUrl)
+
+		if err != nil {
+			return images, err
+		}
+
+		image := AbtImage{
+			FileId:       pkFileId,
+			PostId:       fkPostId,
+			ExternalUrl:  externalUrlObj,
+			FileCategory: fileCategory.String,
+			State:        state,
+			Created:      created,
+			Attempts:     attempts,
+			S3Url:        ingestedUri.String,
+			ETag:         etag.String,
+			LastModified: lastModified.String,
+		}
+
+		if state == "retrieved" {
+			image.StoredS3Url = image.S3Url
+		}
+
+		images = append(images, image)
+	}
+
+	return images, getRows.Err()
+}
+
+func getImagesFromDb(ctx context.Context, db *sql.DB, batchSize int) ([]AbtImage, error) {
+	getRows, err := db.QueryContext(
+		ctx,
+		"SELECT "+imageColumns+
+			"FROM rss_aggregator.files "+
+			"WHERE state = 'pending' "+
+			"AND created >= now() - INTERVAL 2 hour "+
+			"ORDER BY created DESC "+
+			"LIMIT ?",
+		batchSize,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		err := getRows.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(getRows)
+
+	return scanImageRows(getRows)
+}
+
+func categoryForMime(mimeType string) string {
+	switch strings.SplitN(mimeType, "/", 2)[0] {
+	case "image":
+		return "image"
+	case "video":
+		return "video"
+	case "audio":
+		return "audio"
+	default:
+		return "other"
+	}
+}
+
+// randomSuffix returns 8 random hex characters.
+func randomSuffix() string {
+	suffix := make([]byte, 4)
+
+	_, err := cryptorand.Read(suffix)
+
+	if err != nil {
+		return fmt.Sprintf("%08x", uint32(time.Now().UnixNano()))
+	}
+
+	return hex.EncodeToString(suffix)
+}
+
+// setIngestedFilename names the downloaded file. The random suffix keeps
+// names unique even when the same file is stored twice within a second, e.g.
+// by two instances.
+func setIngestedFilename(image *AbtImage, tempDir string) error {
+	image.FileExt = sanitizeExt(image.FileExt)
+
+	if image.FileExt == "" {
+		return &UnsupportedMimeError{MimeType: image.MimeType}
+	}
+
+	filename := fmt.Sprintf("%d.%d.%d.%s%s", time.Now().Unix(), image.FileId, image.PostId, randomSuffix(), image.FileExt)
+	err := validateLocalFilename(filename)
+
+	if err != nil {
+		return err
+	}
+
+	image.LocalFilename = filepath.Join(tempDir, filename)
+
+	return nil
+}
+
+func isAllowedHost(host string, allowedHosts []string) bool {
+	for _, allowedHost := range allowedHosts {
+		allowedHost = strings.ToLower(allowedHost)
+
+		if host == allowedHost || strings.HasSuffix(host, "."+allowedHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPublicIp(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast())
+}
+
+// validateSourceUrl rejects URLs that should never be fetched: anything that
+// isn't http(s), hosts outside the allowlist (when one is configured) and IP
+// addresses that are loopback, private or link-local. Hostnames are checked
+// against the same ranges when they're dialled, see publicAddressControl.
+func validateSourceUrl(u *url.URL, allowedHosts []string) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New(fmt.Sprintf("unsupported url scheme: %s", u.Scheme))
+	}
+
+	host := strings.ToLower(u.Hostname())
+
+	if host == "" {
+		return errors.New("url has no host")
+	}
+
+	if len(allowedHosts) > 0 && !isAllowedHost(host, allowedHosts) {
+		return errors.New(fmt.Sprintf("host is not in the allowed hosts list: %s", host))
+	}
+
+	if ip := net.ParseIP(host); ip != nil && !isPublicIp(ip) {
+		return errors.New(fmt.Sprintf("host is a non-public address: %s", host))
+	}
+
+	return nil
+}
+
+// fetchStoreImageFromUrl downloads the file to local storage, or copies it
+// from the cache when it was downloaded recently. A nil cache disables caching.
+// Any error is returned as a *FetchError.
+func fetchStoreImageFromUrl(ctx context.Context, client *http.Client, config AppConfig, cache *fileCache, image *AbtImage) error {
+	image.FetchedAt = time.Now()
+
+	// The cache holds whatever earlier runs fetched, so the url and the file
+	// are checked against the current config before a cached copy is used
+	err := validateSourceUrl(image.ExternalUrl, config.AllowedHosts)
+
+	if err != nil {
+		return &FetchError{Url: image.ExternalUrl.String(), Err: err}
+	}
+
+	if cache != nil && cache.load(image, config.TempDir) {
+		fmt.Println("using cached copy of", image.ExternalUrl.String())
+		err = checkFilePolicy(config, *image)
+
+		if err != nil {
+			_ = os.Remove(image.LocalFilename)
+			return &FetchError{Url: image.ExternalUrl.String(), Err: err}
+		}
+
+		return nil
+	}
+
+	err = downloadImage(ctx, client, config, image)
+
+	if err != nil {
+		return &FetchError{Url: image.ExternalUrl.String(), Err: err}
+	}
+
+	if cache != nil {
+		err = cache.store(*image)
+
+		if err != nil {
+			fmt.Println("could not cache", image.ExternalUrl.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// checkFilePolicy applies the config's limits on what's stored to a file's
+// type and size, whether it was just downloaded or found in the cache.
+func checkFilePolicy(config AppConfig, image AbtImage) error {
+	if image.FileExt == "" {
+		return &UnsupportedMimeError{MimeType: image.MimeType}
+	}
+
+	if !isAllowedMimeType(resolvedMimeType(image), config.AllowedMimeTypes) {
+		return &DisallowedMimeError{MimeType: resolvedMimeType(image)}
+	}
+
+	// SVGs can carry script, so they're only kept once sanitized
+	if resolvedMimeType(image) == svgMimeType && !config.SanitizeSvg {
+		return &DisallowedMimeError{MimeType: svgMimeType}
+	}
+
+	if image.FileSize < -1 || image.FileSize > config.MaxFileSize {
+		return fmt.Errorf("%w: %s (%d bytes)", ErrFileTooLarge, image.MimeType, image.FileSize)
+	}
+
+	return nil
+}
+
+func downloadImage(ctx context.Context, client *http.Client, config AppConfig, image *AbtImage) error {
+	fmt.Println("fetching", image.ExternalUrl.String())
+
+	err := validateSourceUrl(image.ExternalUrl, config.AllowedHosts)
+
+	if err != nil {
+		return err
+	}
+
+	partialFilename := partialDownloadFilename(config.TempDir, image.FileId)
+	offset := partialDownloadSize(partialFilename)
+
+	startRequest := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", image.ExternalUrl.String(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	applyHostAuth(req, config.HostAuth)
+
+	// A file that was stored before only needs fetching again if it changed,
+	// as the existing object can be kept otherwise
+	if offset == 0 && image.S3Url != "" {
+		if image.ETag != "" {
+			req.Header.Set("If-None-Match", image.ETag)
+		}
+
+		if image.LastModified != "" {
+			req.Header.Set("If-Modified-Since", image.LastModified)
+		}
+	}
+
+	// Images are already compressed, and a gzipped body couldn't be resumed
+	req.Header.Set("Accept-Encoding", "identity")
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		// Drain what's left of the body so the connection can be reused
+		_, _ = io.CopyN(io.Discard, resp.Body, 64*1024)
+		err := resp.Body.Close()
+
+		if err != nil {
+			panic(err)
+		}
+	}(resp)
+
+	fmt.Printf("took %v to get file\n", time.Since(startRequest))
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		_ = os.Remove(partialFilename)
+		return errors.New("partial download no longer matches the source, restarting on next attempt")
+	}
+
+	if resp.StatusCode == http.StatusNotModified && image.S3Url != "" {
+		return ErrNotModified
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	decodedBody, decoded, err := decodeResponseBody(resp)
+
+	if err != nil {
+		return err
+	}
+
+	// Buffered so the start of the file can be sniffed without consuming it
+	body := bufio.NewReader(decodedBody)
+
+	resumed := offset > 0 && resp.StatusCode == http.StatusPartialContent && !decoded
+	image.FileSize = resp.ContentLength
+
+	if resumed {
+		rangeStart, totalSize, err := parseContentRange(resp.Header.Get("content-range"))
+
+		if err != nil || rangeStart != offset {
+			_ = os.Remove(partialFilename)
+			return fmt.Errorf("unexpected content range %q when resuming from %d bytes", resp.Header.Get("content-range"), offset)
+		}
+
+		fmt.Println("resuming download of", image.ExternalUrl, "from", offset, "bytes")
+		image.FileSize = totalSize
+	} else {
+		// The server sent the whole file, so anything downloaded before is discarded
+		offset = 0
+	}
+
+	image.MimeType = resp.Header.Get("content-type")
+
+	mediaType, _, parseErr := mime.ParseMediaType(image.MimeType)
+
+	if parseErr == nil {
+		image.MimeType = mediaType
+	}
+
+	// A generic binary type says no more about the file than no type at all
+	if image.MimeType == octetStreamMimeType {
+		image.MimeType = ""
+	}
+
+	overrideMimeType := hostMimeOverride(config.HostMimeOverrides, image.ExternalUrl.Hostname())
+
+	if overrideMimeType != "" {
+		image.MimeType = overrideMimeType
+	}
+
+	if mediaType, ok := config.MediaTypes[image.MimeType]; ok {
+		image.FileExt = mediaType.Ext
+		image.FileCategory = mediaType.Category
+	} else if image.MimeType == "" {
+		// Without a content type the URL's extension is trusted, but only if
+		// it's one of the extensions files are stored with
+		mimeType, ok := mimeTypeForExt(config.MediaTypes, urlFileExt(image.ExternalUrl))
+
+		if ok {
+			image.MimeType = mimeType
+			image.FileExt = config.MediaTypes[mimeType].Ext
+			image.FileCategory = config.MediaTypes[mimeType].Category
+		} else {
+			sniffedMimeType := sniffMimeType(body, partialFilename, resumed)
+
+			if mediaType, ok := config.MediaTypes[sniffedMimeType]; ok {
+				image.MimeType = sniffedMimeType
+				image.FileExt = mediaType.Ext
+				image.FileCategory = mediaType.Category
+			}
+		}
+	}
+
+	err = checkFilePolicy(config, *image)
+
+	if err != nil {
+		return err
+	}
+
+	// checkFilePolicy only lets an SVG through when SanitizeSvg is set, and
+	// then it is sanitized once downloaded
+	isSvg := resolvedMimeType(*image) == svgMimeType
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+	if resumed {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	out, err := os.OpenFile(partialFilename, flags, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	written, err := io.Copy(out, io.LimitReader(body, config.MaxFileSize+1-offset))
+	closeErr := out.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	// Keep what we have for the next attempt if the server can resume it
+	canResume := !decoded && (resumed || resp.Header.Get("accept-ranges") == "bytes")
+
+	if err != nil {
+		if !canResume {
+			_ = os.Remove(partialFilename)
+		}
+
+		return err
+	}
+
+	downloaded := offset + written
+
+	if downloaded > config.MaxFileSize {
+		_ = os.Remove(partialFilename)
+		return fmt.Errorf("%w: %s (more than %d bytes)", ErrFileTooLarge, image.MimeType, config.MaxFileSize)
+	}
+
+	if image.FileSize > 0 && !decoded && downloaded != image.FileSize {
+		if !canResume {
+			_ = os.Remove(partialFilename)
+		}
+
+		return fmt.Errorf("%w: got %d of %d bytes", ErrShortRead, downloaded, image.FileSize)
+	}
+
+	// Sources sometimes answer with an empty or truncated body and a 200, which
+	// would be stored as a broken image, so it's retried like a failed fetch
+	if downloaded < config.MinFileSize {
+		_ = os.Remove(partialFilename)
+		return fmt.Errorf("%w: got %d bytes, expected at least %d", ErrFileTooSmall, downloaded, config.MinFileSize)
+	}
+
+	// Record what was actually stored rather than what the headers claimed
+	image.FileSize = downloaded
+
+	if isSvg {
+		image.FileSize, err = sanitizeSvgFile(partialFilename)
+
+		if err != nil {
+			_ = os.Remove(partialFilename)
+			return fmt.Errorf("could not sanitize svg: %w", err)
+		}
+	}
+
+	image.ETag = resp.Header.Get("etag")
+	image.LastModified = resp.Header.Get("last-modified")
+
+	err = setIngestedFilename(image, config.TempDir)
+
+	if err != nil {
+		_ = os.Remove(partialFilename)
+		return err
+	}
+
+	return os.Rename(partialFilename, image.LocalFilename)
+}
+
+// putOptions are the settings that differ between objects, as opposed to the
+// ones in AwsConfig that apply to every upload.
+type putOptions struct {
+	ContentType  string
+	Tagging      string
+	StorageClass string
+}
+
+func newPutObjectInput(awsConfig AwsConfig, s3ObjectKey string, body io.ReadSeeker, options putOptions) *s3.PutObjectInput {
+	object := s3.PutObjectInput{
+		Bucket:      aws.String(awsConfig.Bucket),
+		Key:         aws.String(s3ObjectKey),
+		Body:        body,
+		ContentType: aws.String(options.ContentType),
+	}
+
+	// Without an ACL objects get the bucket's default, which is private. Buckets
+	// with ACLs disabled reject any ACL at all, including an empty one.
+	if awsConfig.ACL != "" {
+		object.ACL = aws.String(awsConfig.ACL)
+	}
+
+	if awsConfig.CacheControl != "" {
+		object.CacheControl = aws.String(awsConfig.CacheControl)
+	}
+
+	if awsConfig.ContentDisposition != "" {
+		object.ContentDisposition = aws.String(awsConfig.ContentDisposition)
+	}
+
+	if awsConfig.SSE != "" {
+		object.ServerSideEncryption = aws.String(awsConfig.SSE)
+	}
+
+	if awsConfig.SSE == s3.ServerSideEncryptionAwsKms && awsConfig.KmsKeyId != "" {
+		object.SSEKMSKeyId = aws.String(awsConfig.KmsKeyId)
+	}
+
+	if options.Tagging != "" {
+		object.Tagging = aws.String(options.Tagging)
+	}
+
+	// Without a storage class objects are stored as STANDARD
+	if options.StorageClass != "" {
+		object.StorageClass = aws.String(options.StorageClass)
+	}
+
+	// The SDK sends the Content-MD5 that locked uploads require
+	if awsConfig.ObjectLock.Mode != "" {
+		object.ObjectLockMode = aws.String(awsConfig.ObjectLock.Mode)
+		object.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(time.Duration(awsConfig.ObjectLock.Retention)).UTC())
+	}
+
+	return &object
+}
+
+// objectTagging returns the url-encoded tags describing where an object came
+// from, for lifecycle rules and cost reports, or nothing when tagging is off.
+func objectTagging(awsConfig AwsConfig, image AbtImage) string {
+	if !awsConfig.Tagging {
+		return ""
+	}
+
+	tags := url.Values{}
+	tags.Set("source_host", image.ExternalUrl.Hostname())
+	tags.Set("post_id", strconv.FormatInt(image.PostId, 10))
+	tags.Set("file_category", image.FileCategory)
+
+	return tags.Encode()
+}
+
+func putFileToCloud(ctx context.Context, s3Client S3API, awsConfig AwsConfig, s3ObjectKey string, localFilename string, options putOptions) error {
+	file, err := os.Open(localFilename)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	localMD5, err := fileMD5(file)
+
+	if err != nil {
+		return err
+	}
+
+	err = withUploadRetries(ctx, awsConfig.MaxUploadRetries, func() error {
+		_, err := file.Seek(0, io.SeekStart)
+
+		if err != nil {
+			return err
+		}
+
+		putCtx, cancel := context.WithTimeout(ctx, time.Duration(awsConfig.RequestTimeout))
+
+		defer func(cancel context.CancelFunc) {
+			cancel()
+		}(cancel)
+
+		output, err := s3Client.PutObjectWithContext(putCtx, newPutObjectInput(awsConfig, s3ObjectKey, file, options))
+
+		if err != nil {
+			return err
+		}
+
+		return checkUploadETag(awsConfig, output.ETag, localMD5)
+	})
+
+	if errors.Is(err, ErrETagMismatch) {
+		deleteCorruptObject(ctx, s3Client, awsConfig, s3ObjectKey)
+	}
+
+	if err != nil {
+		return &UploadError{Key: s3ObjectKey, Err: err}
+	}
+
+	return nil
 }
 
-type AwsConfig struct {
-	Name     string `json:"name"`
-	Key      string `json:"key"`
-	Secret   string `json:"secret"`
-	Endpoint string `json:"endpoint"`
-	Region   string `json:"region"`
-	Bucket   string `json:"bucket"`
-	Folder   string `json:"folder"`
-	ACL      string `json:"acl"`
+func uploadImageToCloud(ctx context.Context, s3Client S3API, awsConfig AwsConfig, image *AbtImage) (string, error) {
+	s3ObjectKey, err := buildObjectKey(awsConfig, image)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = putFileToCloud(ctx, s3Client, awsConfig, s3ObjectKey, image.LocalFilename, putOptions{
+		ContentType:  uploadContentType(*image),
+		Tagging:      objectTagging(awsConfig, *image),
+		StorageClass: awsConfig.StorageClass,
+	})
+
+	return s3ObjectKey, err
+}
+
+// imageRefUpdater writes each file's result back to the files table. The
+// update is prepared once per run rather than for every file, and at most
+// maxWriters updates run at once so a busy pipeline can't tie up every
+// database connection. Successful results can be batched, see queue.
+type imageRefUpdater struct {
+	db      *sql.DB
+	stmt    *sql.Stmt
+	writers chan struct{}
+
+	batchSize  int
+	batchMutex sync.Mutex
+	batch      []queuedUpdate
 }
 
-type AbtSolrDocs []AbtSolrDocument
+func newImageRefUpdater(ctx context.Context, db *sql.DB, maxWriters int, batchSize int) (*imageRefUpdater, error) {
+	stmt, err := db.PrepareContext(ctx, "UPDATE `files` "+
+		"SET `mime_type` = ?, `file_category` = ?, `file_size` = ?, `ingested_uri` = ?, `thumbnail_uri` = ?, `width` = ?, `height` = ?, `is_animated` = ?, `etag` = ?, `last_modified` = ?, `error_code` = ?, `last_error` = ?, `state` = ?, `modified` = ?, attempts = attempts + 1 "+
+		"WHERE `pk_file_id` = ?")
+
+	if err != nil {
+		return nil, err
+	}
 
-type AbtSolrDocument struct {
-	Id        int64           `json:"id"`
-	PostImage SolrSetDocument `json:"post_image"`
+	return &imageRefUpdater{
+		db:        db,
+		stmt:      stmt,
+		writers:   make(chan struct{}, maxWriters),
+		batchSize: batchSize,
+	}, nil
 }
 
-type SolrSetDocument struct {
-	Set string `json:"set"`
+func (u *imageRefUpdater) update(ctx context.Context, image AbtImage) error {
+	// Runs that don't write their results to the db have no updater
+	if u == nil {
+		return nil
+	}
+
+	_, err := u.write(ctx, image)
+
+	return err
 }
 
-func makeDbConnection(config AppConfig) (*sql.DB, error) {
+// write updates a file's row, reporting whether it was stored as given rather
+// than marked a duplicate.
+func (u *imageRefUpdater) write(ctx context.Context, image AbtImage) (bool, error) {
+	u.writers <- struct{}{}
 
-	dbParams := make(map[string]string)
-	dbParams["charset"] = "utf8mb4"
+	defer func() {
+		<-u.writers
+	}()
 
-	dbConfig := mysql.Config{
-		User:   config.Db.User,
-		Passwd: config.Db.Password,
-		Net:    "tcp",
-		Addr:   config.Db.Server,
-		DBName: config.Db.DbName,
-		Params: dbParams,
+	_, err := u.stmt.ExecContext(ctx, updateArgs(image)...)
+
+	// Another row already holds what this one would be given, so it has been
+	// processed already and there's nothing to gain from trying again
+	if isDuplicateKeyError(err) {
+		fmt.Println("file", image.FileId, "duplicates one already stored, marking it rejected:", err)
+		return false, markDuplicate(ctx, u.db, image, err)
 	}
 
-	db, err := sql.Open("mysql", dbConfig.FormatDSN())
-	if err != nil {
-		return db, err
+	return err == nil, err
+}
+
+func updateArgs(image AbtImage) []interface{} {
+	return []interface{}{
+		image.MimeType,
+		sql.NullString{String: image.FileCategory, Valid: image.FileCategory != ""},
+		image.FileSize,
+		image.S3Url,
+		sql.NullString{String: image.ThumbS3Url, Valid: image.ThumbS3Url != ""},
+		sql.NullInt64{Int64: image.Width, Valid: image.Width > 0},
+		sql.NullInt64{Int64: image.Height, Valid: image.Height > 0},
+		sql.NullBool{Bool: image.IsAnimated, Valid: resolvedMimeType(image) == "image/gif"},
+		sql.NullString{String: image.ETag, Valid: image.ETag != ""},
+		sql.NullString{String: image.LastModified, Valid: image.LastModified != ""},
+		sql.NullString{String: image.ErrorCode, Valid: image.ErrorCode != ""},
+		sql.NullString{String: image.LastError, Valid: image.LastError != ""},
+		image.State,
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		image.FileId,
 	}
+}
 
-	err = db.Ping()
-	if err != nil {
-		return db, err
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func markDuplicate(ctx context.Context, db sqlExecer, image AbtImage, duplicateErr error) error {
+	setImageError(&image, errorCodeDuplicate, duplicateErr)
+
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `error_code` = ?, `last_error` = ?, `state` = 'rejected', `modified` = ?, attempts = attempts + 1 "+
+			"WHERE `pk_file_id` = ?",
+		image.ErrorCode,
+		image.LastError,
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		image.FileId,
+	)
+
+	return err
+}
+
+// markRefreshFailed records the error from failing to store a file again
+// without touching the rest of its row.
+func (u *imageRefUpdater) markRefreshFailed(ctx context.Context, image AbtImage) error {
+	if u == nil {
+		return nil
 	}
 
-	fmt.Println("opened database connection")
+	u.writers <- struct{}{}
 
-	return db, nil
+	defer func() {
+		<-u.writers
+	}()
+
+	_, err := u.db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `error_code` = ?, `last_error` = ?, `modified` = ? "+
+			"WHERE `pk_file_id` = ?",
+		image.ErrorCode,
+		image.LastError,
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		image.FileId,
+	)
+
+	return err
 }
 
-func getImagesFromDb(db *sql.DB) ([]AbtImage, error) {
-	var images []AbtImage
+func (u *imageRefUpdater) close() error {
+	return u.stmt.Close()
+}
 
-	getRows, err := db.Query(
-		"SELECT pk_file_id, fk_post_id, external_url, state, created, attempts " +
-			"FROM rss_aggregator.files " +
-			"WHERE state = 'pending' " +
-			"AND created >= now() - INTERVAL 2 hour " +
-			"ORDER BY created DESC",
+// markImageUnchangedInDb marks a file retrieved again without touching what was
+// stored about it, for when the source says it hasn't changed since.
+func markImageUnchangedInDb(ctx context.Context, db *sql.DB, image AbtImage) error {
+	_, err := db.ExecContext(
+		ctx,
+		"UPDATE `files` "+
+			"SET `ingested_uri` = ?, `error_code` = NULL, `last_error` = NULL, `state` = 'retrieved', `modified` = ?, attempts = attempts + 1 "+
+			"WHERE `pk_file_id` = ?",
+		image.S3Url,
+		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		image.FileId,
 	)
 
-	if err != nil {
-		return images, err
-	}
+	return err
+}
+
+// updateSolrWithImageRef points the post's document at the stored image. With
+// a VersionField configured the update is skipped when the document already
+// has an image fetched later than this one, and uses Solr's optimistic
+// concurrency so a racing update from another instance isn't overwritten.
+func updateSolrWithImageRef(ctx context.Context, httpClient *http.Client, image AbtImage, solrConfig SolrConfig) {
+	if solrConfig.VersionField == "" {
+		err := postSolrUpdate(ctx, httpClient, solrConfig, solrImageDoc(image, solrConfig, nil))
 
-	defer func(getRows *sql.Rows) {
-		err := getRows.Close()
 		if err != nil {
-			panic(err)
+			fmt.Println("could not update solr for post", image.PostId, err)
 		}
-	}(getRows)
 
-	for getRows.Next() {
-		var pkFileId int64
-		var fkPostId int64
-		var attempts int64
-		var externalUrl string
-		var state string
-		var created string
+		return
+	}
 
-		err = getRows.Scan(
-			&pkFileId,
-			&fkPostId,
-			&externalUrl,
-			&state,
-			&created,
-			&attempts,
-		)
+	for attempt := 1; ; attempt++ {
+		versions, err := getSolrVersions(ctx, httpClient, solrConfig, image.PostId)
 
 		if err != nil {
-			return images, err
+			fmt.Println("could not read solr versions for post", image.PostId, err)
+			return
 		}
 
-		externalUrlObj, err := url.Parse(externalUrl)
+		if versions.ImageVersion >= image.FetchedAt.UnixMilli() {
+			fmt.Println("solr already has a newer image for post", image.PostId, "skipping update")
+			return
+		}
 
-		if err != nil {
-			return images, err
+		err = postSolrUpdate(ctx, httpClient, solrConfig, solrImageDoc(image, solrConfig, &versions))
+
+		if errors.Is(err, errSolrConflict) && attempt < maxSolrConflictRetries {
+			continue
 		}
 
-		image := AbtImage{
-			FileId:      pkFileId,
-			PostId:      fkPostId,
-			ExternalUrl: externalUrlObj,
-			State:       state,
-			Created:     created,
-			Attempts:    attempts,
+		if err != nil {
+			fmt.Println("could not update solr for post", image.PostId, err)
 		}
 
-		images = append(images, image)
+		return
 	}
+}
 
-	return images, nil
+func deleteLocalImage(image AbtImage) error {
+	err := os.Remove(image.LocalFilename)
+	return err
 }
 
-func setIngestedFilename(image *AbtImage) {
-	if image.FileExt != "" {
-		image.LocalFilename = fmt.Sprintf(
-			"%d.%d.%d%s", time.Now().Unix(), image.FileId, image.PostId, image.FileExt,
-		)
+// mirrorLocalImage moves the downloaded file into a dated folder under
+// mirrorDir rather than deleting it, keeping a local copy of everything stored.
+func mirrorLocalImage(image AbtImage, mirrorDir string) (string, error) {
+	dir := filepath.Join(mirrorDir, time.Now().Format(dateFolderLayout))
+
+	err := os.MkdirAll(dir, 0755)
+
+	if err != nil {
+		return "", err
 	}
-}
 
-func fetchStoreImageFromUrl(image *AbtImage) error {
-	fmt.Println("fetching", image.ExternalUrl.String())
+	mirrorFilename := filepath.Join(dir, filepath.Base(image.LocalFilename))
 
-	startRequest := time.Now()
+	err = os.Rename(image.LocalFilename, mirrorFilename)
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
+	if err == nil {
+		return mirrorFilename, nil
 	}
 
-	resp, err := client.Get(image.ExternalUrl.String())
+	// Renaming fails when the mirror is on another filesystem
+	_, err = copyFile(mirrorFilename, image.LocalFilename)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	defer func(resp *http.Response) {
-		err := resp.Body.Close()
-
-		if err != nil {
-			panic(err)
-		}
-	}(resp)
+	return mirrorFilename, os.Remove(image.LocalFilename)
+}
 
-	fmt.Printf("took %v to get file\n", time.Since(startRequest))
+// start processes one batch of pending files. Only problems that stop the whole
+// run, such as bad config or an unreachable database, are returned. Errors with
+// individual files are recorded against the file and in the run summary.
+func start(configPath string, source imageSource) error {
+	fmt.Println("starting media cloner")
 
-	image.MimeType = resp.Header.Get("content-type")
-	image.FileSize = resp.ContentLength
+	setRunInProgress(true)
+	defer setRunInProgress(false)
 
-	if image.MimeType == "image/jpeg" {
-		image.FileExt = ".jpg"
-	} else if image.MimeType == "image/png" {
-		image.FileExt = ".png"
-	} else if image.MimeType == "image/gif" {
-		image.FileExt = ".gif"
-	} else if image.MimeType == "" {
-		fileExt := filepath.Ext(image.ExternalUrl.String())
+	config, err := loadConfig(configPath)
 
-		if fileExt != "" {
-			image.FileExt = fileExt
-		}
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
 	}
 
-	if image.FileExt != "" && image.FileSize >= -1 && image.FileSize <= 3145728 {
-		setIngestedFilename(image)
+	var dbs dbPools
 
-		out, err := os.Create(image.LocalFilename)
+	if source.usesDb() {
+		dbs, err = makeDbPools(config)
 
 		if err != nil {
-			return err
+			return fmt.Errorf("could not open db connection: %w", err)
 		}
 
-		defer func(out *os.File) {
-			err := out.Close()
-
+		defer func(dbs dbPools) {
+			fmt.Println("closing database connection at", time.Now().Format(time.RFC1123Z))
+			err := dbs.close()
 			if err != nil {
-				panic(err)
+				fmt.Println("could not close database connection", err)
 			}
-		}(out)
-
-		_, err = io.Copy(out, resp.Body)
-	} else {
-		return errors.New(
-			fmt.Sprintf("invalid mime type or file too large: %s (%d bytes)", image.MimeType, image.FileSize),
-		)
+		}(dbs)
 	}
 
-	return err
+	return runBatch(context.Background(), config, dbs, source)
 }
 
-func uploadImageToCloud(s3Client *s3.S3, bucket string, baseFolder string, acl string, image *AbtImage) (string, error) {
-	t := time.Now()
-	dateTimeFolder := t.Format("20060102")
-	s3ObjectKey := "/" + baseFolder + "/" + dateTimeFolder + "/" + image.LocalFilename
+// newS3Client creates the S3 clients s3Clients hands out. It's a variable so
+// tests can see when a client is created.
+var newS3Client = makeS3ClientFor
+
+// runBatch loads the next batch of files from source and clones them. The S3
+// session and http clients are only set up once there's something to clone.
+func runBatch(ctx context.Context, config AppConfig, dbs dbPools, source imageSource) error {
+	// Results are always written to the primary
+	db := dbs.write
 
-	file, err := os.Open(image.LocalFilename)
+	images, err := source.loadImages(ctx, dbs, config)
 
 	if err != nil {
-		return s3ObjectKey, err
+		return fmt.Errorf("error getting images: %w", err)
 	}
 
-	object := s3.PutObjectInput{
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(s3ObjectKey),
-		Body:        file,
-		ACL:         aws.String(acl),
-		ContentType: aws.String(image.MimeType),
+	if len(images) == 0 {
+		fmt.Println("no images to process, skipping")
+		return nil
 	}
 
-	_, err = s3Client.PutObject(&object)
+	var s3Client S3API
+	var mirrors []uploadTarget
 
-	if err != nil {
-		return s3ObjectKey, err
-	}
+	// Download only runs never touch the bucket
+	if !config.DownloadOnly {
+		s3Client, err = s3Clients.get(config.Aws)
 
-	return s3ObjectKey, err
-}
+		if err != nil {
+			return fmt.Errorf("could not connect to s3 storage provider: %w", err)
+		}
 
-func updateImageRefInDb(db *sql.DB, image AbtImage) error {
-	stmt, err := db.Prepare("UPDATE `files` " +
-		"SET `mime_type` = ?, `file_size` = ?, `ingested_uri` = ?, `state` = ?, `modified` = ?, attempts = attempts + 1 " +
-		"WHERE `pk_file_id` = ?")
+		mirrors, err = mirrorTargets(config.Aws)
 
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = stmt.Exec(
-		image.MimeType,
-		image.FileSize,
-		image.S3Url,
-		image.State,
-		time.Now().UTC().Format("2006-01-02 15:04:05"),
-		image.FileId,
-	)
+	httpClient, err := makeHttpClient(config)
 
-	return err
-}
+	if err != nil {
+		return fmt.Errorf("could not create http client: %w", err)
+	}
+
+	cache, err := newFileCache(config.Cache, config.StripQueryParams)
 
-func updateSolrWithImageRef(image AbtImage, solrBaseUrl string) {
-	docs := AbtSolrDocs{
-		AbtSolrDocument{
-			Id: image.PostId,
-			PostImage: SolrSetDocument{
-				Set: image.S3Url,
-			},
-		},
+	if err != nil {
+		fmt.Println("could not open file cache, continuing without it", err)
 	}
 
-	postBody, err := json.Marshal(docs)
+	publisher, err := newPublisher(config)
 
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return fmt.Errorf("could not create events publisher: %w", err)
 	}
 
-	solrUrl := solrBaseUrl + "/update?commit=true"
+	cloner := newMediaCloner(config, db, s3Client, httpClient, &http.Client{Timeout: 10 * time.Second})
+	cloner.cache = cache
+	cloner.publisher = publisher
+	cloner.mirrors = mirrors
 
-	req, err := http.NewRequest("POST", solrUrl, bytes.NewBuffer(postBody))
+	if db != nil {
+		updater, err := newImageRefUpdater(ctx, db, config.MaxDbWriters, config.DbBatchSize)
 
-	if err != nil {
-		fmt.Println(err.Error())
-		return
+		if err != nil {
+			return fmt.Errorf("could not prepare file update: %w", err)
+		}
+
+		defer func(updater *imageRefUpdater) {
+			_ = updater.close()
+		}(updater)
+
+		cloner.updater = updater
+
+		if config.AttemptLog.Enabled {
+			cloner.attempts = &attemptLogger{db: db, retain: config.AttemptLog.Retain}
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	cloner.processImages(ctx, images)
 
-	defer func(cancel context.CancelFunc) {
-		cancel()
-	}(cancel)
+	return nil
+}
 
-	req = req.WithContext(ctx)
+var runMutex sync.Mutex
 
-	httpClient := &http.Client{}
+// startIfIdle runs start unless a run is already in progress, in which case it
+// returns straight away rather than processing the same rows twice.
+func startIfIdle(configPath string, source imageSource) error {
+	if !runMutex.TryLock() {
+		fmt.Println("warning: previous run is still in progress, skipping this one")
+		return nil
+	}
 
-	resp, err := httpClient.Do(req)
+	defer runMutex.Unlock()
 
-	if err != nil {
-		fmt.Println(err.Error())
-		return
+	if shutdown.stopped() {
+		fmt.Println("shutting down, not starting another run")
+		return nil
 	}
 
-	defer func(resp *http.Response) {
-		_ = resp.Body.Close()
-	}(resp)
+	return start(configPath, source)
 }
 
-func deleteLocalImage(image AbtImage) error {
-	err := os.Remove(image.LocalFilename)
-	return err
+// isOneShot reports whether to run a single pass and exit rather than run as a
+// service.
+func isOneShot(config AppConfig, once bool) bool {
+	return once || config.RunMode == "oneshot"
 }
 
-func start() {
-	fmt.Println("starting media cloner")
+// randomDelay returns a random duration in [0, max), used to spread out
+// instances that would otherwise hit the database and sources at the same time.
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// nextAlignedTick is the first multiple of d since the zero time after now,
+// so with a 10 minute interval runs land on :00, :10, :20 and so on.
+func nextAlignedTick(now time.Time, d time.Duration) time.Time {
+	return now.Truncate(d).Add(d)
+}
 
-	encodedJson, err := ioutil.ReadFile("config/config.json")
+func runService(d time.Duration, tickJitter time.Duration, alignToClock bool, configPath string) {
+	tick := func() {
+		time.Sleep(randomDelay(tickJitter))
 
-	if err != nil {
-		panic(err)
+		err := startIfIdle(configPath, dbImageSource{})
+
+		if err != nil {
+			fmt.Println("run failed", err)
+		}
 	}
 
-	config := AppConfig{}
+	if !alignToClock {
+		ticker := time.NewTicker(d)
 
-	err = json.Unmarshal(encodedJson, &config)
+		for _ = range ticker.C {
+			tick()
+		}
+	}
 
-	if err != nil {
-		panic(err)
+	// Working the next tick out from the clock each time means a long run or
+	// a slow wake up never shifts the ones after it
+	for {
+		time.Sleep(time.Until(nextAlignedTick(time.Now(), d)))
+		tick()
 	}
+}
 
-	db, err := makeDbConnection(config)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		err := runAudit(os.Args[2:])
+
+		if err != nil {
+			fmt.Println("audit failed", err)
+			os.Exit(1)
+		}
 
-	if err != nil {
-		fmt.Println("could not open db connection", err)
 		return
 	}
 
-	defer func(db *sql.DB) {
-		fmt.Println("closing database connection at", time.Now().Format(time.RFC1123Z))
-		err := db.Close()
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		err := runBackfill(os.Args[2:])
+
 		if err != nil {
-			panic(err)
+			fmt.Println("backfill failed", err)
+			os.Exit(1)
 		}
-	}(db)
 
-	images, err := getImagesFromDb(db)
-
-	if err != nil {
-		fmt.Println("error getting images from db", err)
 		return
 	}
 
-	s3Config := &aws.Config{
-		Credentials: credentials.NewStaticCredentials(config.Aws.Key, config.Aws.Secret, ""),
-		Endpoint:    aws.String(config.Aws.Endpoint),
-		Region:      aws.String(config.Aws.Region),
-	}
+	if len(os.Args) > 1 && os.Args[1] == "process-file" {
+		err := runProcessFile(os.Args[2:])
 
-	newSession, err := session.NewSession(s3Config)
+		if err != nil {
+			fmt.Println("process-file failed", err)
+			os.Exit(1)
+		}
 
-	if err != nil {
-		fmt.Println("could not connect to s3 storage provider", err)
 		return
 	}
 
-	s3Client := s3.New(newSession)
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		err := runGc(os.Args[2:])
+
+		if err != nil {
+			fmt.Println("gc failed", err)
+			os.Exit(1)
+		}
 
-	var storedImages []AbtImage
+		return
+	}
 
-	for _, image := range images {
-		err := fetchStoreImageFromUrl(&image)
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		err := runStats(os.Args[2:])
 
 		if err != nil {
-			fmt.Println("could not fetch image", image.ExternalUrl, err)
+			fmt.Println("stats failed", err)
+			os.Exit(1)
+		}
 
-			if image.Attempts >= 3 {
-				image.State = "failed"
-				err := updateImageRefInDb(db, image)
+		return
+	}
 
-				if err != nil {
-					fmt.Println("could not update db with file's failed state", err)
-				}
-			} else {
-				err := updateImageRefInDb(db, image)
+	once := flag.Bool("once", false, "run a single pass and exit instead of running as a service")
+	configPath := flag.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	urlsFile := flag.String("urls-file", "", "process the URLs listed in this file once instead of pending rows from the db")
+	writeDb := flag.Bool("write-db", false, "with --urls-file, record results against the file ids given in the file")
+	flag.Parse()
 
-				if err != nil {
-					fmt.Println("could not increment file retrieval attempt", err)
-				}
-			}
+	if *showVersion {
+		fmt.Println("abt-media-cloner", versionString())
+		return
+	}
 
-			continue
-		}
+	fmt.Println("starting abt-media-cloner", versionString())
 
-		fmt.Println("stored image to local from", image.ExternalUrl, "as", image.LocalFilename)
-		storedImages = append(storedImages, image)
+	config, err := loadConfig(*configPath)
 
-		image.S3Url, err = uploadImageToCloud(s3Client, config.Aws.Bucket, config.Aws.Folder, config.Aws.ACL, &image)
+	if err != nil {
+		fmt.Println("could not load config", err)
+		os.Exit(1)
+	}
 
-		if err != nil {
-			fmt.Println("could not upload", image.ExternalUrl, "for this reason:", err)
-			continue
-		}
+	if config.Solr.BaseUrl == "" {
+		fmt.Println("no solr url configured, solr sync is disabled")
+	}
+
+	err = prepareTempDir(config)
+
+	if err != nil {
+		fmt.Println("could not prepare temp dir", err)
+		os.Exit(1)
+	}
 
-		fmt.Println("uploaded image to s3 account. URI is", image.S3Url)
+	shutdownTracing, err := setupTracing(context.Background(), config.Otel)
 
-		image.State = "retrieved"
+	if err != nil {
+		fmt.Println("could not set up tracing", err)
+		os.Exit(1)
+	}
 
-		err = updateImageRefInDb(db, image)
+	if *urlsFile != "" {
+		err = startIfIdle(*configPath, urlsFileSource{path: *urlsFile, writeDb: *writeDb})
+		_ = shutdownTracing(context.Background())
 
 		if err != nil {
-			fmt.Println("could not update db with file's retrieved state", err)
+			fmt.Println("run failed", err)
+			os.Exit(1)
 		}
 
-		updateSolrWithImageRef(image, config.Solr)
+		return
 	}
 
-	for _, image := range storedImages {
-		err := deleteLocalImage(image)
+	handleShutdownSignals(time.Duration(config.ShutdownGracePeriod), shutdownTracing)
+
+	if isOneShot(config, *once) {
+		err = startIfIdle(*configPath, dbImageSource{})
+		_ = shutdownTracing(context.Background())
 
 		if err != nil {
-			fmt.Println("could not delete", image.LocalFilename)
-			continue
+			fmt.Println("run failed", err)
+			os.Exit(1)
 		}
 
-		fmt.Println("removed local copy of file", image.LocalFilename)
+		return
+	}
+
+	if config.StatusAddr != "" {
+		startStatusServer(config.StatusAddr)
 	}
-}
 
-func runService(d time.Duration) {
-	ticker := time.NewTicker(d)
+	interval := 10 * time.Minute
 
-	for _ = range ticker.C {
-		start()
+	if config.StartupJitter {
+		delay := randomDelay(interval)
+		fmt.Println("waiting", delay, "before the first run")
+		time.Sleep(delay)
 	}
-}
 
-func main() {
-	start()
+	err = startIfIdle(*configPath, dbImageSource{})
 
-	interval := 10 * time.Minute
-	go runService(interval)
+	if err != nil {
+		fmt.Println("run failed", err)
+	}
+
+	go runService(interval, time.Duration(config.TickJitter), config.AlignToClock, *configPath)
 
-	fmt.Println("starting ticker to clone media every", interval)
+	if config.AlignToClock {
+		fmt.Println("starting ticker to clone media every", interval, "aligned to the clock, next at", nextAlignedTick(time.Now(), interval).Format(time.RFC1123Z))
+	} else {
+		fmt.Println("starting ticker to clone media every", interval)
+	}
 
 	// Run application indefinitely
 	select {}
@@ -0,0 +1,1213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+var testImageColumns = []string{"pk_file_id", "fk_post_id", "external_url", "file_category", "state", "created", "attempts", "ingested_uri", "etag", "last_modified"}
+
+func TestGetImagesFromDbLimitsToBatchSize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	rows := sqlmock.NewRows(testImageColumns).
+		AddRow(1, 10, "https://example.com/a.jpg", nil, "pending", "2024-01-01 00:00:00", 0, nil, nil, nil).
+		AddRow(2, 11, "https://example.com/b.png", "image", "pending", "2024-01-01 00:00:00", 1, "/media/b.png", `"v1"`, "Mon, 01 Jan 2024 00:00:00 GMT")
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE state = 'pending'") + ".*" + regexp.QuoteMeta("LIMIT ?")).
+		WithArgs(25).
+		WillReturnRows(rows)
+
+	images, err := getImagesFromDb(context.Background(), db, 25)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+
+	if images[0].FileCategory != "" {
+		t.Errorf("got category %q for a file without one", images[0].FileCategory)
+	}
+
+	if images[1].FileId != 2 || images[1].ExternalUrl.Host != "example.com" || images[1].FileCategory != "image" || images[1].Attempts != 1 {
+		t.Errorf("unexpected image %+v", images[1])
+	}
+
+	if images[1].S3Url != "/media/b.png" || images[1].ETag != `"v1"` || images[1].LastModified != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Errorf("got stored object %q and validators %q, %q", images[1].S3Url, images[1].ETag, images[1].LastModified)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunBatchSkipsS3SessionWhenNothingPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE state = 'pending'")).
+		WithArgs(25).
+		WillReturnRows(sqlmock.NewRows(testImageColumns))
+
+	created := countS3Clients(t)
+
+	err = runBatch(context.Background(), AppConfig{BatchSize: 25}, dbPools{read: db, write: db}, dbImageSource{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *created != 0 {
+		t.Errorf("created %d s3 clients for an empty batch, want none", *created)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetConfigDefaultsBatchSize(t *testing.T) {
+	tests := []struct {
+		batchSize int
+		want      int
+	}{
+		{0, 100},
+		{-5, 100},
+		{250, 250},
+	}
+
+	for _, test := range tests {
+		config := AppConfig{BatchSize: test.batchSize}
+		setConfigDefaults(&config)
+
+		if config.BatchSize != test.want {
+			t.Errorf("batchSize %d defaulted to %d, want %d", test.batchSize, config.BatchSize, test.want)
+		}
+	}
+}
+
+func TestValidateSourceUrl(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowedHosts []string
+		wantErr      bool
+	}{
+		{"https://example.com/a.jpg", nil, false},
+		{"http://example.com/a.jpg", nil, false},
+		{"ftp://example.com/a.jpg", nil, true},
+		{"file:///etc/passwd", nil, true},
+		{"https:///a.jpg", nil, true},
+		{"http://127.0.0.1/a.jpg", nil, true},
+		{"http://[::1]/a.jpg", nil, true},
+		{"http://10.0.0.5/a.jpg", nil, true},
+		{"http://192.168.1.1/a.jpg", nil, true},
+		{"http://172.16.0.1/a.jpg", nil, true},
+		{"http://169.254.169.254/latest/meta-data", nil, true},
+		{"http://[fe80::1]/a.jpg", nil, true},
+		{"http://0.0.0.0/a.jpg", nil, true},
+		{"http://93.184.216.34/a.jpg", nil, false},
+		{"https://cdn.example.com/a.jpg", []string{"example.com"}, false},
+		{"https://EXAMPLE.com/a.jpg", []string{"example.com"}, false},
+		{"https://example.org/a.jpg", []string{"example.com"}, true},
+		{"https://notexample.com/a.jpg", []string{"example.com"}, true},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = validateSourceUrl(u, test.allowedHosts)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateSourceUrl(%s, %v) = %v, want error %t", test.url, test.allowedHosts, err, test.wantErr)
+		}
+	}
+}
+
+// Canceling a run stops its fetches and db writes rather than recording them as
+// failed attempts, so the file is still pending for the next run
+func TestCanceledFetchLeavesFileRetryable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	imageUrl, err := url.Parse("https://example.com/a.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{FileId: 1, ExternalUrl: imageUrl, State: "pending"}
+
+	client, err := makeHttpClient(AppConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fetchStoreImageFromUrl(ctx, client, AppConfig{}, nil, &image)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the fetch to be canceled", err)
+	}
+
+	if image.LocalFilename != "" || image.State != "pending" {
+		t.Errorf("expected nothing to be stored, got %q in state %s", image.LocalFilename, image.State)
+	}
+
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files`"))
+
+	updater, err := newImageRefUpdater(context.Background(), db, 1, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updater.update(ctx, image)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the update to be canceled", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxAttemptsForHost(t *testing.T) {
+	config := AppConfig{HostAttempts: map[string]int{"Flaky.Example.com": 10, "gone.example.com": 1}}
+	setConfigDefaults(&config)
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"flaky.example.com", 10},
+		{"FLAKY.example.com", 10},
+		{"gone.example.com", 1},
+		{"example.com", 3},
+		{"other.example.org", 3},
+	}
+
+	for _, test := range tests {
+		got := maxAttemptsForHost(config, test.host)
+
+		if got != test.want {
+			t.Errorf("maxAttemptsForHost(%s) = %d, want %d", test.host, got, test.want)
+		}
+	}
+}
+
+func TestNewPutObjectInputEncryption(t *testing.T) {
+	tests := []struct {
+		sse       string
+		kmsKeyId  string
+		wantSse   string
+		wantKeyId string
+	}{
+		{"", "", "", ""},
+		{"AES256", "", "AES256", ""},
+		{"AES256", "ignored", "AES256", ""},
+		{"aws:kms", "", "aws:kms", ""},
+		{"aws:kms", "arn:aws:kms:key", "aws:kms", "arn:aws:kms:key"},
+	}
+
+	for _, test := range tests {
+		awsConfig := AwsConfig{Bucket: "bucket", SSE: test.sse, KmsKeyId: test.kmsKeyId}
+		object := newPutObjectInput(awsConfig, "/media/a.jpg", nil, putOptions{ContentType: "image/jpeg"})
+
+		if aws.StringValue(object.ServerSideEncryption) != test.wantSse || aws.StringValue(object.SSEKMSKeyId) != test.wantKeyId {
+			t.Errorf("sse %q key %q: got %v and %v, want %q and %q", test.sse, test.kmsKeyId, object.ServerSideEncryption, object.SSEKMSKeyId, test.wantSse, test.wantKeyId)
+		}
+
+		if aws.StringValue(object.Bucket) != "bucket" || aws.StringValue(object.Key) != "/media/a.jpg" || aws.StringValue(object.ContentType) != "image/jpeg" {
+			t.Errorf("unexpected object %v", object)
+		}
+	}
+}
+
+func TestPutFileToCloudSendsObjectHeaders(t *testing.T) {
+	var received http.Header
+	var receivedPath string
+
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		receivedPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	})
+
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("png data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	awsConfig := AwsConfig{
+		Bucket:             "bucket",
+		ACL:                "public-read",
+		SSE:                "AES256",
+		CacheControl:       "public, max-age=31536000",
+		ContentDisposition: "inline",
+		RequestTimeout:     Duration(time.Minute),
+	}
+
+	err = putFileToCloud(context.Background(), s3Client, awsConfig, "media/1.png", localFilename, putOptions{ContentType: "image/png"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receivedPath != "/bucket/media/1.png" {
+		t.Errorf("put to %s, want /bucket/media/1.png", receivedPath)
+	}
+
+	want := map[string]string{
+		"Content-Type":                 "image/png",
+		"Cache-Control":                "public, max-age=31536000",
+		"Content-Disposition":          "inline",
+		"X-Amz-Acl":                    "public-read",
+		"X-Amz-Server-Side-Encryption": "AES256",
+	}
+
+	for name, value := range want {
+		if received.Get(name) != value {
+			t.Errorf("%s header %q, want %q", name, received.Get(name), value)
+		}
+	}
+}
+
+func TestPutFileToCloudStopsOnCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		// Hang like an unresponsive endpoint until the test is over
+		<-release
+	})
+
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("png data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		requestTimeout time.Duration
+		cancel         bool
+	}{
+		{"canceled", time.Minute, true},
+		{"timed out", 50 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		if test.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+
+		awsConfig := AwsConfig{Bucket: "bucket", RequestTimeout: Duration(test.requestTimeout)}
+		started := time.Now()
+
+		err = putFileToCloud(ctx, s3Client, awsConfig, "media/1.png", localFilename, putOptions{ContentType: "image/png"})
+		cancel()
+
+		if err == nil {
+			t.Errorf("%s: expected the upload to fail", test.name)
+		}
+
+		if time.Since(started) > 5*time.Second {
+			t.Errorf("%s: upload took %v to give up", test.name, time.Since(started))
+		}
+	}
+}
+
+func TestNewPutObjectInputLeavesUnsetHeadersOut(t *testing.T) {
+	object := newPutObjectInput(AwsConfig{Bucket: "bucket"}, "/media/a.jpg", nil, putOptions{ContentType: "image/jpeg"})
+
+	if object.CacheControl != nil || object.ContentDisposition != nil {
+		t.Errorf("expected no cache control or content disposition, got %v and %v", object.CacheControl, object.ContentDisposition)
+	}
+
+	// Buckets with ACLs disabled reject even an empty one
+	if object.ACL != nil {
+		t.Errorf("expected no acl, got %v", object.ACL)
+	}
+
+	if object.StorageClass != nil || object.Tagging != nil {
+		t.Errorf("expected no storage class or tagging, got %v and %v", object.StorageClass, object.Tagging)
+	}
+
+	object = newPutObjectInput(AwsConfig{Bucket: "bucket", ACL: "private"}, "/media/a.jpg", nil, putOptions{ContentType: "image/jpeg"})
+
+	if aws.StringValue(object.ACL) != "private" {
+		t.Errorf("got acl %v, want private", object.ACL)
+	}
+}
+
+func TestObjectLockPropagatesToPuts(t *testing.T) {
+	var received http.Header
+
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	})
+
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		objectLock ObjectLockConfig
+		wantMode   string
+	}{
+		{ObjectLockConfig{}, ""},
+		{ObjectLockConfig{Mode: "GOVERNANCE", Retention: Duration(24 * time.Hour)}, "GOVERNANCE"},
+		{ObjectLockConfig{Mode: "COMPLIANCE", Retention: Duration(24 * time.Hour)}, "COMPLIANCE"},
+	}
+
+	for _, test := range tests {
+		awsConfig := AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute), ObjectLock: test.objectLock}
+		started := time.Now()
+
+		err = putFileToCloud(context.Background(), s3Client, awsConfig, "media/1.png", localFilename, putOptions{ContentType: "image/png"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mode := received.Get("x-amz-object-lock-mode"); mode != test.wantMode {
+			t.Errorf("%+v: sent lock mode %q, want %q", test.objectLock, mode, test.wantMode)
+		}
+
+		retainUntil := received.Get("x-amz-object-lock-retain-until-date")
+
+		if test.wantMode == "" {
+			if retainUntil != "" {
+				t.Errorf("unlocked put sent a retention of %s", retainUntil)
+			}
+
+			continue
+		}
+
+		until, err := time.Parse(time.RFC3339, retainUntil)
+
+		if err != nil {
+			t.Fatalf("%+v: sent retention %q: %v", test.objectLock, retainUntil, err)
+		}
+
+		if until.Before(started.Add(23*time.Hour)) || until.After(time.Now().Add(25*time.Hour)) {
+			t.Errorf("%+v: got retention until %s, want a day from now", test.objectLock, until)
+		}
+
+		// S3 refuses locked uploads without one
+		if received.Get("Content-MD5") == "" {
+			t.Errorf("%+v: locked put sent no Content-MD5", test.objectLock)
+		}
+	}
+}
+
+func TestValidateObjectLock(t *testing.T) {
+	tests := []struct {
+		objectLock ObjectLockConfig
+		wantErr    bool
+	}{
+		{ObjectLockConfig{}, false},
+		{ObjectLockConfig{Mode: "GOVERNANCE", Retention: Duration(time.Hour)}, false},
+		{ObjectLockConfig{Mode: "governance", Retention: Duration(time.Hour)}, true},
+		{ObjectLockConfig{Mode: "COMPLIANCE"}, true},
+	}
+
+	for _, test := range tests {
+		config := AppConfig{Aws: AwsConfig{ObjectLock: test.objectLock}}
+		setConfigDefaults(&config)
+
+		if err := config.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%+v: got %v, want error %t", test.objectLock, err, test.wantErr)
+		}
+	}
+}
+
+func TestStorageClassPropagatesToPuts(t *testing.T) {
+	var mutex sync.Mutex
+	storageClasses := map[string]string{}
+
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		storageClasses[r.URL.Path] = r.Header.Get("x-amz-storage-class")
+		mutex.Unlock()
+	})
+
+	dir := t.TempDir()
+	localFilename := filepath.Join(dir, "1.png")
+	thumbFilename := filepath.Join(dir, "1.thumb.jpg")
+
+	for _, filename := range []string{localFilename, thumbFilename} {
+		err := os.WriteFile(filename, []byte("data"), 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		storageClass      string
+		thumbStorageClass string
+		wantImage         string
+		wantThumb         string
+	}{
+		{"", "", "", ""},
+		{"STANDARD_IA", "", "STANDARD_IA", "STANDARD_IA"},
+		{"INTELLIGENT_TIERING", "ONEZONE_IA", "INTELLIGENT_TIERING", "ONEZONE_IA"},
+	}
+
+	for _, test := range tests {
+		config := AppConfig{Aws: AwsConfig{
+			Bucket:            "bucket",
+			Folder:            "media",
+			KeyTemplate:       "{{.Folder}}/{{.FileId}}.{{.Ext}}",
+			StorageClass:      test.storageClass,
+			ThumbStorageClass: test.thumbStorageClass,
+			RequestTimeout:    Duration(time.Minute),
+		}}
+		setConfigDefaults(&config)
+
+		err := config.Validate()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image := AbtImage{FileId: 1, MimeType: "image/png", FileExt: ".png", LocalFilename: localFilename, ThumbFilename: thumbFilename}
+
+		image.S3Url, err = uploadImageToCloud(context.Background(), s3Client, config.Aws, &image)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = uploadThumbnailToCloud(context.Background(), s3Client, config.Aws, &image)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := storageClasses["/bucket/media/1.png"]; got != test.wantImage {
+			t.Errorf("%+v: image stored as %q, want %q", test, got, test.wantImage)
+		}
+
+		if got := storageClasses["/bucket/media/thumbs/1.thumb.jpg"]; got != test.wantThumb {
+			t.Errorf("%+v: thumbnail stored as %q, want %q", test, got, test.wantThumb)
+		}
+	}
+}
+
+func TestObjectTagging(t *testing.T) {
+	image := AbtImage{PostId: 34, FileCategory: "image", ExternalUrl: testUrl(t, "http://images.example.com/a.jpg")}
+
+	if tagging := objectTagging(AwsConfig{}, image); tagging != "" {
+		t.Errorf("got tagging %q with tagging off, want none", tagging)
+	}
+
+	tagging := objectTagging(AwsConfig{Tagging: true}, image)
+
+	if tagging != "file_category=image&post_id=34&source_host=images.example.com" {
+		t.Errorf("got tagging %q", tagging)
+	}
+
+	// Values are url-encoded so one can't add tags of its own
+	image.FileCategory = "a b&c=d"
+
+	tagging = objectTagging(AwsConfig{Tagging: true}, image)
+
+	if tagging != "file_category=a+b%26c%3Dd&post_id=34&source_host=images.example.com" {
+		t.Errorf("got tagging %q", tagging)
+	}
+}
+
+func TestUploadImageToCloudSendsTagging(t *testing.T) {
+	var received string
+
+	s3Client := newTestS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("x-amz-tagging")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+
+	err := os.WriteFile(localFilename, []byte("png data"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := AppConfig{Aws: AwsConfig{Bucket: "bucket", Tagging: true, RequestTimeout: Duration(time.Minute)}}
+	setConfigDefaults(&config)
+
+	err = config.Validate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := AbtImage{
+		FileId:        12,
+		PostId:        34,
+		MimeType:      "image/png",
+		FileCategory:  "image",
+		LocalFilename: localFilename,
+		ExternalUrl:   testUrl(t, "http://images.example.com/a.png"),
+	}
+
+	_, err = uploadImageToCloud(context.Background(), s3Client, config.Aws, &image)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received != "file_category=image&post_id=34&source_host=images.example.com" {
+		t.Errorf("got tagging header %q", received)
+	}
+}
+
+func TestUsePathStyle(t *testing.T) {
+	tests := []struct {
+		endpoint       string
+		forcePathStyle *bool
+		want           bool
+	}{
+		{"", nil, false},
+		{"http://minio:9000", nil, true},
+		{"http://minio:9000", aws.Bool(false), false},
+		{"", aws.Bool(true), true},
+	}
+
+	for _, test := range tests {
+		awsConfig := AwsConfig{Endpoint: test.endpoint, ForcePathStyle: test.forcePathStyle, Region: "us-east-1"}
+
+		if got := usePathStyle(awsConfig); got != test.want {
+			t.Errorf("usePathStyle(%q, %v) = %t, want %t", test.endpoint, aws.BoolValue(test.forcePathStyle), got, test.want)
+		}
+
+		s3Client, err := makeS3Client(AppConfig{Aws: awsConfig})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if aws.BoolValue(s3Client.Config.S3ForcePathStyle) != test.want {
+			t.Errorf("endpoint %q: client path style %t, want %t", test.endpoint, !test.want, test.want)
+		}
+	}
+}
+
+func TestMakeS3ClientCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	tests := []struct {
+		awsConfig AwsConfig
+		wantKey   string
+	}{
+		{AwsConfig{Key: "static-key", Secret: "static-secret"}, "static-key"},
+		{AwsConfig{}, "env-key"},
+		{AwsConfig{Key: "static-key", Secret: "static-secret", UseDefaultCredentials: true}, "env-key"},
+	}
+
+	for _, test := range tests {
+		test.awsConfig.Region = "us-east-1"
+		s3Client, err := makeS3Client(AppConfig{Aws: test.awsConfig})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := s3Client.Config.Credentials.Get()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value.AccessKeyID != test.wantKey {
+			t.Errorf("%+v: got key %s, want %s", test.awsConfig, value.AccessKeyID, test.wantKey)
+		}
+	}
+}
+
+// newProxiedClient is a fetch client whose requests are all answered by
+// handler, acting as the proxy, so tests can use public looking source urls.
+func newProxiedClient(t *testing.T, config *AppConfig, handler http.HandlerFunc) *http.Client {
+	t.Helper()
+
+	proxy := httptest.NewServer(handler)
+	t.Cleanup(proxy.Close)
+
+	config.HttpProxy = proxy.URL
+	setConfigDefaults(config)
+
+	client, err := makeHttpClient(*config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// chdirTemp runs the rest of the test in a temp dir, as files are downloaded
+// to the working dir.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+}
+
+func testUrl(t *testing.T, rawUrl string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestFetchStoreImageFromUrlMediaTypes(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{MaxFileSize: 64}
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large.mp4":
+			w.Header().Set("content-type", "video/mp4")
+			_, _ = w.Write(make([]byte, 128))
+		case "/streamed.mp4":
+			// Without a Content-Length the size is only found out while copying
+			w.Header().Set("content-type", "video/mp4")
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(make([]byte, 128))
+		case "/page.html":
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<html></html>"))
+		case "/clip.mp4":
+			w.Header().Set("content-type", "video/mp4")
+			_, _ = w.Write([]byte("mp4 data"))
+		case "/song.mp3":
+			w.Header().Set("content-type", "audio/mpeg")
+			_, _ = w.Write([]byte("mp3 data"))
+		default:
+			w.Header().Set("content-type", "image/png; charset=binary")
+			_, _ = w.Write([]byte("png data"))
+		}
+	})
+
+	tests := []struct {
+		path         string
+		wantExt      string
+		wantCategory string
+		wantErr      bool
+	}{
+		{"/a.png", ".png", "image", false},
+		{"/clip.mp4", ".mp4", "video", false},
+		{"/song.mp3", ".mp3", "audio", false},
+		{"/page.html", "", "", true},
+		{"/large.mp4", ".mp4", "video", true},
+		{"/streamed.mp4", ".mp4", "video", true},
+	}
+
+	for _, test := range tests {
+		image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com"+test.path)}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want error %t", test.path, err, test.wantErr)
+		}
+
+		if test.wantErr && !errors.Is(err, ErrUnsupportedMime) && !errors.Is(err, ErrFileTooLarge) {
+			t.Errorf("%s: got %v, want an invalid mime error", test.path, err)
+		}
+
+		if image.FileExt != test.wantExt || image.FileCategory != test.wantCategory {
+			t.Errorf("%s: got extension %q and category %q, want %q and %q", test.path, image.FileExt, image.FileCategory, test.wantExt, test.wantCategory)
+		}
+
+		if test.wantErr && image.LocalFilename != "" {
+			if _, err := os.Stat(image.LocalFilename); err == nil {
+				t.Errorf("%s: the rejected file was left behind", test.path)
+			}
+		}
+	}
+}
+
+func TestSetConfigDefaultsMediaTypes(t *testing.T) {
+	config := AppConfig{}
+	setConfigDefaults(&config)
+
+	if !reflect.DeepEqual(config.MediaTypes, defaultMediaTypes) {
+		t.Errorf("got default media types %v, want %v", config.MediaTypes, defaultMediaTypes)
+	}
+
+	var configured AppConfig
+
+	err := json.Unmarshal([]byte(`{"mediaTypes": {
+		"image/webp": ".webp",
+		"Image/HEIC": {"ext": ".heic", "category": "photo"},
+		"video/mp4": {"ext": ".m4v"},
+		"audio/ogg": ""
+	}}`), &configured)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setConfigDefaults(&configured)
+
+	tests := []struct {
+		mimeType string
+		want     MediaType
+		wantOk   bool
+	}{
+		// An extension alone takes the category from the MIME type
+		{"image/webp", MediaType{Ext: ".webp", Category: "image"}, true},
+		{"image/heic", MediaType{Ext: ".heic", Category: "photo"}, true},
+		// Configured types replace the default for the same MIME type
+		{"video/mp4", MediaType{Ext: ".m4v", Category: "video"}, true},
+		// and no extension removes it
+		{"audio/ogg", MediaType{}, false},
+		// The rest of the defaults are kept
+		{"image/jpeg", MediaType{Ext: ".jpg", Category: "image"}, true},
+	}
+
+	for _, test := range tests {
+		got, ok := configured.MediaTypes[test.mimeType]
+
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("%s: got %+v, %t, want %+v, %t", test.mimeType, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestSetIngestedFilenameIsUnique(t *testing.T) {
+	seen := map[string]bool{}
+
+	// The same file stored over and over within the same second, as by
+	// instances racing for it
+	for i := 0; i < 10000; i++ {
+		image := AbtImage{FileId: 12, PostId: 34, FileExt: ".jpg"}
+		setIngestedFilename(&image, "tmp")
+
+		if seen[image.LocalFilename] {
+			t.Fatalf("%s was given out twice", image.LocalFilename)
+		}
+
+		seen[image.LocalFilename] = true
+
+		if !tempFilePattern.MatchString(filepath.Base(image.LocalFilename)) || filepath.Dir(image.LocalFilename) != "tmp" {
+			t.Fatalf("%s isn't a temp file the startup sweep would find", image.LocalFilename)
+		}
+	}
+}
+
+func TestCategoryForMime(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"image/jpeg", "image"},
+		{"image/svg+xml", "image"},
+		{"video/mp4", "video"},
+		{"audio/mpeg", "audio"},
+		{"application/pdf", "other"},
+		{"text/html", "other"},
+		{"", "other"},
+	}
+
+	for _, test := range tests {
+		if got := categoryForMime(test.mimeType); got != test.want {
+			t.Errorf("categoryForMime(%q) = %s, want %s", test.mimeType, got, test.want)
+		}
+	}
+}
+
+func TestStartIfIdleSkipsOverlappingRun(t *testing.T) {
+	// Hold the lock as a run in progress would. If startIfIdle didn't skip it
+	// would block here, or go on to read a config that doesn't exist
+	runMutex.Lock()
+
+	skipped := make(chan bool)
+
+	go func() {
+		skipped <- startIfIdle(defaultConfigPath, dbImageSource{}) == nil
+	}()
+
+	select {
+	case ok := <-skipped:
+		if !ok {
+			t.Error("expected the overlapping run to be skipped")
+		}
+	case <-time.After(time.Second):
+		t.Error("startIfIdle waited for the run in progress")
+	}
+
+	runMutex.Unlock()
+}
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	var config struct {
+		ClaimTimeout Duration `json:"claimTimeout"`
+	}
+
+	err := json.Unmarshal([]byte(`{"claimTimeout": "90s"}`), &config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Duration(config.ClaimTimeout) != 90*time.Second {
+		t.Errorf("got %v, want 90s", time.Duration(config.ClaimTimeout))
+	}
+
+	err = json.Unmarshal([]byte(`{"claimTimeout": "soon"}`), &config)
+
+	if err == nil {
+		t.Error("expected an error for a malformed duration")
+	}
+}
+
+func TestRandomDelay(t *testing.T) {
+	if delay := randomDelay(0); delay != 0 {
+		t.Errorf("got %v with no jitter, want 0", delay)
+	}
+
+	max := 30 * time.Second
+	seen := map[time.Duration]bool{}
+
+	for i := 0; i < 100; i++ {
+		delay := randomDelay(max)
+
+		if delay < 0 || delay >= max {
+			t.Fatalf("got delay %v, want it in [0, %v)", delay, max)
+		}
+
+		seen[delay] = true
+	}
+
+	// Instances only spread out if they don't all wait the same time
+	if len(seen) < 2 {
+		t.Error("got the same delay every time, want it to vary")
+	}
+}
+
+func TestDbConfigServers(t *testing.T) {
+	tests := []struct {
+		db        DbConfig
+		wantRead  string
+		wantWrite string
+	}{
+		{DbConfig{Server: "db:3306"}, "db:3306", "db:3306"},
+		{DbConfig{Server: "db:3306", ReadServer: "replica:3306"}, "replica:3306", "db:3306"},
+		{DbConfig{Server: "db:3306", WriteServer: "primary:3306"}, "primary:3306", "primary:3306"},
+		{DbConfig{ReadServer: "replica:3306", WriteServer: "primary:3306"}, "replica:3306", "primary:3306"},
+		// Only a read server is as good as a single server
+		{DbConfig{ReadServer: "replica:3306"}, "replica:3306", "replica:3306"},
+	}
+
+	for _, test := range tests {
+		if read, write := test.db.readServer(), test.db.writeServer(); read != test.wantRead || write != test.wantWrite {
+			t.Errorf("%+v: got read %s and write %s, want %s and %s", test.db, read, write, test.wantRead, test.wantWrite)
+		}
+	}
+}
+
+func TestNextAlignedTick(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed
+	}
+
+	tests := []struct {
+		now  string
+		d    time.Duration
+		want string
+	}{
+		{"2024-01-01T10:03:27Z", 10 * time.Minute, "2024-01-01T10:10:00Z"},
+		{"2024-01-01T10:59:59Z", 10 * time.Minute, "2024-01-01T11:00:00Z"},
+		// Exactly on a boundary waits for the next one rather than running twice
+		{"2024-01-01T10:10:00Z", 10 * time.Minute, "2024-01-01T10:20:00Z"},
+		{"2024-01-01T23:45:00Z", time.Hour, "2024-01-02T00:00:00Z"},
+		{"2024-01-01T10:03:27Z", 15 * time.Minute, "2024-01-01T10:15:00Z"},
+	}
+
+	for _, test := range tests {
+		got := nextAlignedTick(at(test.now), test.d)
+
+		if !got.Equal(at(test.want)) {
+			t.Errorf("nextAlignedTick(%s, %v) = %s, want %s", test.now, test.d, got.Format(time.RFC3339), test.want)
+		}
+	}
+}
+
+func TestIsOneShot(t *testing.T) {
+	tests := []struct {
+		runMode string
+		once    bool
+		want    bool
+	}{
+		{"", false, false},
+		{"service", false, false},
+		{"oneshot", false, true},
+		{"service", true, true},
+		{"", true, true},
+	}
+
+	for _, test := range tests {
+		if got := isOneShot(AppConfig{RunMode: test.runMode}, test.once); got != test.want {
+			t.Errorf("isOneShot(%q, %t) = %t, want %t", test.runMode, test.once, got, test.want)
+		}
+	}
+}
+
+func TestStartReturnsConfigErrors(t *testing.T) {
+	chdirTemp(t)
+
+	err := start(defaultConfigPath, dbImageSource{})
+
+	if err == nil || !strings.Contains(err.Error(), "could not load config") {
+		t.Fatalf("got %v, want a config error", err)
+	}
+
+	// The failed run doesn't leave the next one thinking it's still going
+	err = startIfIdle(defaultConfigPath, dbImageSource{})
+
+	if err == nil {
+		t.Error("expected the next run to go ahead and fail the same way")
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+	// Run from somewhere other than the config's dir, as under systemd or cron
+	chdirTemp(t)
+
+	path := filepath.Join(t.TempDir(), "cloner.json")
+	err := os.WriteFile(path, []byte(`{"batchSize": 7}`), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.BatchSize != 7 {
+		t.Errorf("got batch size %d, want 7", config.BatchSize)
+	}
+
+	_, err = loadConfig(defaultConfigPath)
+
+	if err == nil {
+		t.Error("expected an error as there's no config in the working dir")
+	}
+}
+
+func TestLoadConfigFromStdin(t *testing.T) {
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = reader
+
+	t.Cleanup(func() {
+		os.Stdin = stdin
+	})
+
+	_, _ = writer.Write([]byte(`{"batchSize": 9}`))
+	_ = writer.Close()
+
+	// Stdin is only read once, so later runs get the same config
+	for i := 0; i < 2; i++ {
+		config, err := loadConfig("-")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.BatchSize != 9 {
+			t.Errorf("run %d got batch size %d, want 9", i, config.BatchSize)
+		}
+	}
+}
+
+func TestImageRefUpdaterPreparesOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// One prepare serves every update in the run
+	prepare := mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files`"))
+
+	for fileId := 1; fileId <= 3; fileId++ {
+		prepare.ExpectExec().
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "retrieved", sqlmock.AnyArg(), fileId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	prepare.WillBeClosed()
+
+	updater, err := newImageRefUpdater(context.Background(), db, 2, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fileId := int64(1); fileId <= 3; fileId++ {
+		err = updater.update(context.Background(), AbtImage{FileId: fileId, State: "retrieved"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = updater.close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImageRefUpdaterCapsWriters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE `files`")).
+		ExpectExec().
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	updater, err := newImageRefUpdater(context.Background(), db, 1, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Take the only writer slot, as a slow update would
+	updater.writers <- struct{}{}
+
+	done := make(chan error)
+
+	go func() {
+		done <- updater.update(context.Background(), AbtImage{FileId: 1, State: "retrieved"})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("update ran while every writer was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-updater.writers
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update didn't run once a writer was free")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const octetStreamMimeType = "application/octet-stream"
+
+// sniffLength is how much of a file http.DetectContentType looks at
+const sniffLength = 512
+
+// MediaType is how files of one MIME type are stored: the extension they're
+// given and the category recorded for them. In the config it can also be just
+// the extension, leaving the category to follow from the MIME type, e.g.
+// "image/heic": ".heic".
+type MediaType struct {
+	Ext      string `json:"ext"`
+	Category string `json:"category"`
+}
+
+func (t *MediaType) UnmarshalJSON(data []byte) error {
+	var ext string
+
+	if json.Unmarshal(data, &ext) == nil {
+		*t = MediaType{Ext: ext}
+		return nil
+	}
+
+	// A distinct type so this doesn't recurse back into UnmarshalJSON
+	type mediaType MediaType
+
+	return json.Unmarshal(data, (*mediaType)(t))
+}
+
+// defaultMediaTypes are the MIME types accepted for cloning out of the box.
+var defaultMediaTypes = map[string]MediaType{
+	"image/jpeg": {Ext: ".jpg", Category: "image"},
+	"image/png":  {Ext: ".png", Category: "image"},
+	"image/gif":  {Ext: ".gif", Category: "image"},
+	"video/mp4":  {Ext: ".mp4", Category: "video"},
+	"video/webm": {Ext: ".webm", Category: "video"},
+	"audio/mpeg": {Ext: ".mp3", Category: "audio"},
+	"audio/mp4":  {Ext: ".m4a", Category: "audio"},
+	"audio/ogg":  {Ext: ".ogg", Category: "audio"},
+}
+
+// mergeMediaTypes adds the configured media types to the defaults, replacing
+// any for the same MIME type. An entry with no extension removes the type.
+func mergeMediaTypes(configured map[string]MediaType) map[string]MediaType {
+	mediaTypes := make(map[string]MediaType, len(defaultMediaTypes)+len(configured))
+
+	for mimeType, mediaType := range defaultMediaTypes {
+		mediaTypes[mimeType] = mediaType
+	}
+
+	for mimeType, mediaType := range configured {
+		mimeType = strings.ToLower(mimeType)
+
+		if mediaType.Ext == "" {
+			delete(mediaTypes, mimeType)
+			continue
+		}
+
+		if mediaType.Category == "" {
+			mediaType.Category = categoryForMime(mimeType)
+		}
+
+		mediaTypes[mimeType] = mediaType
+	}
+
+	return mediaTypes
+}
+
+// resolvedMimeType is the file's MIME type, worked out from its extension when
+// the source didn't send one.
+func resolvedMimeType(image AbtImage) string {
+	if image.MimeType != "" {
+		return image.MimeType
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(image.FileExt))
+
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// uploadContentTypes are the types an object can be stored with. Anything else
+// a source claims, such as text/html, could be rendered as a page from the
+// bucket's domain, so it's stored as application/octet-stream instead.
+var uploadContentTypes = []string{"image/*", "video/*"}
+
+// uploadContentType is the Content-Type an object is stored with. Without one
+// browsers may refuse to render it, so it falls back to the extension and then
+// to application/octet-stream.
+func uploadContentType(image AbtImage) string {
+	contentType := resolvedMimeType(image)
+
+	if contentType == "" || !isAllowedMimeType(contentType, uploadContentTypes) {
+		return octetStreamMimeType
+	}
+
+	return contentType
+}
+
+// mediaTypeMimeTypes lists the MIME types MediaTypes has an extension for,
+// which is the default allowlist.
+func mediaTypeMimeTypes(mediaTypes map[string]MediaType) []string {
+	mimeTypes := make([]string, 0, len(mediaTypes))
+
+	for mimeType := range mediaTypes {
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+
+	sort.Strings(mimeTypes)
+
+	return mimeTypes
+}
+
+// mimeTypeForExt finds the MIME type MediaTypes stores with fileExt, for files
+// served without a content type.
+func mimeTypeForExt(mediaTypes map[string]MediaType, fileExt string) (string, bool) {
+	if fileExt == "" {
+		return "", false
+	}
+
+	for _, mimeType := range mediaTypeMimeTypes(mediaTypes) {
+		if strings.EqualFold(mediaTypes[mimeType].Ext, fileExt) {
+			return mimeType, true
+		}
+	}
+
+	return "", false
+}
+
+// isAllowedMimeType reports whether mimeType is on the allowlist. Entries such
+// as image/* match a whole top-level type.
+func isAllowedMimeType(mimeType string, allowedMimeTypes []string) bool {
+	mimeType = strings.ToLower(mimeType)
+
+	for _, allowed := range allowedMimeTypes {
+		allowed = strings.ToLower(allowed)
+
+		if allowed == mimeType {
+			return true
+		}
+
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostMimeOverride is the MIME type configured for a host whose files are
+// always served with the wrong type, or "" if there isn't one.
+func hostMimeOverride(overrides map[string]string, host string) string {
+	return overrides[strings.ToLower(host)]
+}
+
+// sniffMimeType works out a file's type from its first bytes for sources that
+// don't say what it is. A resumed download is sniffed from the part already
+// on disk, as the body only holds the rest of it. It returns "" when the
+// bytes aren't recognised.
+func sniffMimeType(body *bufio.Reader, partialFilename string, resumed bool) string {
+	var head []byte
+
+	if resumed {
+		file, err := os.Open(partialFilename)
+
+		if err != nil {
+			return ""
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		head = make([]byte, sniffLength)
+		n, _ := io.ReadFull(file, head)
+		head = head[:n]
+	} else {
+		// Peek returns what it could read along with an error for short files
+		head, _ = body.Peek(sniffLength)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+
+	if err != nil || mediaType == octetStreamMimeType {
+		return ""
+	}
+
+	return mediaType
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsAllowedMimeType(t *testing.T) {
+	allowed := []string{"image/*", "video/MP4"}
+
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"image/png", true},
+		{"image/svg+xml", true},
+		{"video/mp4", true},
+		{"Video/Mp4", true},
+		{"video/webm", false},
+		{"text/html", false},
+		{"application/pdf", false},
+		{"imagex/png", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := isAllowedMimeType(test.mimeType, allowed); got != test.want {
+			t.Errorf("isAllowedMimeType(%q) = %t, want %t", test.mimeType, got, test.want)
+		}
+	}
+}
+
+func TestSetConfigDefaultsAllowsMediaTypes(t *testing.T) {
+	config := AppConfig{MediaTypes: map[string]MediaType{"image/webp": {Ext: ".webp"}}}
+	setConfigDefaults(&config)
+
+	if !reflect.DeepEqual(config.AllowedMimeTypes, mediaTypeMimeTypes(config.MediaTypes)) || !isAllowedMimeType("image/webp", config.AllowedMimeTypes) {
+		t.Errorf("got default allowlist %v, want the media types", config.AllowedMimeTypes)
+	}
+
+	config = AppConfig{AllowedMimeTypes: []string{"image/png"}}
+	setConfigDefaults(&config)
+
+	if !reflect.DeepEqual(config.AllowedMimeTypes, []string{"image/png"}) {
+		t.Errorf("configured allowlist replaced by %v", config.AllowedMimeTypes)
+	}
+}
+
+func TestMimeTypeForExt(t *testing.T) {
+	mediaTypes := map[string]MediaType{"image/jpeg": {Ext: ".jpg"}, "video/mp4": {Ext: ".mp4"}}
+
+	tests := []struct {
+		fileExt  string
+		want     string
+		wantFind bool
+	}{
+		{".jpg", "image/jpeg", true},
+		{".JPG", "image/jpeg", true},
+		{".mp4", "video/mp4", true},
+		{".svg", "", false},
+		{".html", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := mimeTypeForExt(mediaTypes, test.fileExt)
+
+		if got != test.want || ok != test.wantFind {
+			t.Errorf("mimeTypeForExt(%q) = %q, %t, want %q, %t", test.fileExt, got, ok, test.want, test.wantFind)
+		}
+	}
+}
+
+func TestFetchStoreImageFromUrlEnforcesAllowlist(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{
+		MediaTypes: map[string]MediaType{
+			"image/png":     {Ext: ".png"},
+			"image/svg+xml": {Ext: ".svg"},
+			"video/mp4":     {Ext: ".mp4"},
+		},
+		AllowedMimeTypes: []string{"image/png", "video/*"},
+	}
+
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/drawing.svg":
+			w.Header().Set("content-type", "image/svg+xml")
+		case "/clip.mp4":
+			w.Header().Set("content-type", "video/mp4")
+		case "/page.html":
+			w.Header().Set("content-type", "text/html")
+		case "/untyped.png", "/untyped.svg", "/untyped.html":
+			// Go sniffs a type for responses that don't set one, so it has to
+			// be sent empty to leave the client guessing from the extension
+			w.Header()["Content-Type"] = nil
+		default:
+			w.Header().Set("content-type", "image/png")
+		}
+
+		_, _ = w.Write([]byte("data"))
+	})
+
+	tests := []struct {
+		path    string
+		wantExt string
+		wantErr error
+	}{
+		{"/a.png", ".png", nil},
+		{"/clip.mp4", ".mp4", nil},
+		{"/untyped.png", ".png", nil},
+		// A configured media type that the allowlist doesn't include
+		{"/drawing.svg", ".svg", ErrDisallowedMime},
+		{"/untyped.svg", ".svg", ErrDisallowedMime},
+		// Neither a media type nor an extension files are stored with
+		{"/page.html", "", ErrUnsupportedMime},
+		{"/untyped.html", "", ErrUnsupportedMime},
+	}
+
+	for i, test := range tests {
+		image := AbtImage{FileId: int64(i + 1), PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com"+test.path)}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", test.path, err, test.wantErr)
+		}
+
+		if image.FileExt != test.wantExt {
+			t.Errorf("%s: got extension %q, want %q", test.path, image.FileExt, test.wantExt)
+		}
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	tests := []struct {
+		image AbtImage
+		want  string
+	}{
+		{AbtImage{MimeType: "image/png", FileExt: ".png"}, "image/png"},
+		{AbtImage{MimeType: "video/mp4", FileExt: ".mp4"}, "video/mp4"},
+		// Worked out from the extension when the source sent no type
+		{AbtImage{FileExt: ".jpg"}, "image/jpeg"},
+		{AbtImage{FileExt: ".unknown"}, "application/octet-stream"},
+		{AbtImage{}, "application/octet-stream"},
+		// Never stored as something a browser would render as a page
+		{AbtImage{MimeType: "text/html", FileExt: ".png"}, "application/octet-stream"},
+		{AbtImage{FileExt: ".html"}, "application/octet-stream"},
+		{AbtImage{MimeType: "application/javascript"}, "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		if got := uploadContentType(test.image); got != test.want {
+			t.Errorf("uploadContentType(%+v) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestFetchStoreImageFromUrlSniffsAndOverridesMimeTypes(t *testing.T) {
+	chdirTemp(t)
+
+	config := AppConfig{
+		MediaTypes: map[string]MediaType{
+			"image/png":  {Ext: ".png"},
+			"image/jpeg": {Ext: ".jpg"},
+		},
+		HostMimeOverrides: map[string]string{"Legacy.Example.com": "image/jpeg"},
+	}
+
+	client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/binary":
+			w.Header().Set("content-type", "application/octet-stream")
+		case "/text":
+			w.Header()["Content-Type"] = nil
+			_, _ = w.Write([]byte("just some text"))
+			return
+		default:
+			w.Header()["Content-Type"] = nil
+		}
+
+		_, _ = w.Write(testPng)
+	})
+
+	tests := []struct {
+		url      string
+		wantMime string
+		wantExt  string
+		wantErr  error
+	}{
+		// No type and no extension to go on, so the bytes decide
+		{"http://images.example.com/untyped", "image/png", ".png", nil},
+		{"http://images.example.com/binary", "image/png", ".png", nil},
+		{"http://images.example.com/text", "", "", ErrUnsupportedMime},
+		// The override wins over whatever the host sends, in any case
+		{"http://LEGACY.example.com/binary", "image/jpeg", ".jpg", nil},
+	}
+
+	for i, test := range tests {
+		image := AbtImage{FileId: int64(i + 1), PostId: 2, ExternalUrl: testUrl(t, test.url)}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", test.url, err, test.wantErr)
+		}
+
+		if image.MimeType != test.wantMime || image.FileExt != test.wantExt {
+			t.Errorf("%s: got %q and %q, want %q and %q", test.url, image.MimeType, image.FileExt, test.wantMime, test.wantExt)
+		}
+	}
+}
+
+func TestSetConfigDefaultsLowercasesHostMimeOverrides(t *testing.T) {
+	config := AppConfig{HostMimeOverrides: map[string]string{"Legacy.Example.com": "image/jpeg"}}
+	setConfigDefaults(&config)
+
+	if got := hostMimeOverride(config.HostMimeOverrides, "legacy.EXAMPLE.com"); got != "image/jpeg" {
+		t.Errorf("got override %q, want image/jpeg", got)
+	}
+}
+
+func TestValidateRejectsUnknownHostMimeOverride(t *testing.T) {
+	config := AppConfig{
+		MediaTypes:        map[string]MediaType{"image/png": {Ext: ".png"}},
+		HostMimeOverrides: map[string]string{"legacy.example.com": "image/x-legacy"},
+	}
+	setConfigDefaults(&config)
+
+	if config.Validate() == nil {
+		t.Error("expected an error for an override that isn't one of the media types")
+	}
+}
+
+func TestSniffMimeTypeOfResumedDownload(t *testing.T) {
+	partialFilename := filepath.Join(t.TempDir(), "1.part")
+
+	err := os.WriteFile(partialFilename, testPng[:20], 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rest of the file says nothing, it's the part on disk that counts
+	got := sniffMimeType(bufio.NewReader(bytes.NewReader(testPng[20:])), partialFilename, true)
+
+	if got != "image/png" {
+		t.Errorf("got %q, want image/png", got)
+	}
+}
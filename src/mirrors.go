@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// AwsMirrorConfig is a further bucket every uploaded file is copied to, such
+// as one in another region for disaster recovery. Objects get the same key and
+// headers as on the primary, and settings left empty are taken from it, so a
+// mirror on the same provider usually only needs a region and bucket.
+type AwsMirrorConfig struct {
+	Name                  string `json:"name"`
+	Key                   string `json:"key"`
+	KeyFile               string `json:"keyFile"`
+	Secret                string `json:"secret"`
+	SecretFile            string `json:"secretFile"`
+	Endpoint              string `json:"endpoint"`
+	Region                string `json:"region"`
+	Bucket                string `json:"bucket"`
+	StorageClass          string `json:"storageClass"`
+	ForcePathStyle        *bool  `json:"forcePathStyle"`
+	UseDefaultCredentials bool   `json:"useDefaultCredentials"`
+}
+
+// awsConfig is the primary's config with the mirror's settings laid over it.
+func (m AwsMirrorConfig) awsConfig(primary AwsConfig) AwsConfig {
+	mirror := primary
+	mirror.Mirrors = nil
+	mirror.mirrors = nil
+	mirror.Name = m.Name
+
+	if m.Endpoint != "" || m.Region != "" {
+		mirror.Endpoint = m.Endpoint
+		mirror.Region = m.Region
+		mirror.ForcePathStyle = nil
+	}
+
+	if m.ForcePathStyle != nil {
+		mirror.ForcePathStyle = m.ForcePathStyle
+	}
+
+	if m.Key != "" || m.Secret != "" || m.UseDefaultCredentials {
+		mirror.Key = m.Key
+		mirror.Secret = m.Secret
+		mirror.UseDefaultCredentials = m.UseDefaultCredentials
+	}
+
+	mirror.Bucket = m.Bucket
+
+	if m.StorageClass != "" {
+		mirror.StorageClass = m.StorageClass
+	}
+
+	return mirror
+}
+
+// validateMirrors checks each mirror and keeps the config it resolves to.
+func (c *AwsConfig) validateMirrors() error {
+	c.mirrors = nil
+	names := map[string]bool{}
+
+	for i, m := range c.Mirrors {
+		if m.Name == "" {
+			return fmt.Errorf("aws.mirrors[%d] needs a name", i)
+		}
+
+		if names[m.Name] {
+			return fmt.Errorf("aws.mirrors has more than one mirror named %q", m.Name)
+		}
+
+		names[m.Name] = true
+
+		if m.Bucket == "" {
+			return fmt.Errorf("aws.mirrors %q needs a bucket", m.Name)
+		}
+
+		mirror := m.awsConfig(*c)
+		err := mirror.validateEndpoint()
+
+		if err != nil {
+			return fmt.Errorf("aws.mirrors %q: %w", m.Name, err)
+		}
+
+		if mirror.Endpoint == c.Endpoint && mirror.Region == c.Region && mirror.Bucket == c.Bucket {
+			return fmt.Errorf("aws.mirrors %q is the same bucket as the primary", m.Name)
+		}
+
+		c.mirrors = append(c.mirrors, mirror)
+	}
+
+	return nil
+}
+
+// uploadTarget is a mirror bucket along with the client for it.
+type uploadTarget struct {
+	awsConfig AwsConfig
+	client    S3API
+}
+
+// mirrorS3Clients keeps a shared client per mirror, in the same way as
+// s3Clients does for the primary.
+var mirrorS3Clients = struct {
+	mutex   sync.Mutex
+	clients map[string]*sharedS3Client
+}{clients: map[string]*sharedS3Client{}}
+
+func mirrorTargets(awsConfig AwsConfig) ([]uploadTarget, error) {
+	mirrorS3Clients.mutex.Lock()
+	defer mirrorS3Clients.mutex.Unlock()
+
+	var targets []uploadTarget
+
+	for _, mirror := range awsConfig.mirrors {
+		shared, ok := mirrorS3Clients.clients[mirror.Name]
+
+		if !ok {
+			shared = &sharedS3Client{}
+			mirrorS3Clients.clients[mirror.Name] = shared
+		}
+
+		client, err := shared.get(mirror)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to mirror %s: %w", mirror.Name, err)
+		}
+
+		targets = append(targets, uploadTarget{awsConfig: mirror, client: client})
+	}
+
+	return targets, nil
+}
+
+// uploadToMirrors copies a file already stored on the primary to each mirror
+// under the same key. The primary holds the copy that's referenced, so a
+// mirror failing is only logged. Thumbnails are kept on the primary alone.
+func (c *mediaCloner) uploadToMirrors(ctx context.Context, image AbtImage) {
+	for _, target := range c.mirrors {
+		span := startStageSpan(ctx, image, "mirror_upload")
+		err := putFileToCloud(ctx, target.client, target.awsConfig, image.S3Url, image.LocalFilename, putOptions{
+			ContentType:  uploadContentType(image),
+			Tagging:      objectTagging(target.awsConfig, image),
+			StorageClass: target.awsConfig.StorageClass,
+		})
+		span.End()
+
+		if err != nil {
+			fmt.Println("could not upload", image.S3Url, "to mirror", target.awsConfig.Name, err)
+			continue
+		}
+
+		fmt.Println("uploaded", image.S3Url, "to mirror", target.awsConfig.Name)
+	}
+}
+
+// restoreMirrorObject copies an object from the primary to a mirror that's
+// lost it, by way of a temp file in tempDir.
+func restoreMirrorObject(ctx context.Context, s3Client S3API, awsConfig AwsConfig, target uploadTarget, s3ObjectKey string, tempDir string) error {
+	getCtx, cancel := context.WithTimeout(ctx, time.Duration(awsConfig.RequestTimeout))
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	object, err := s3Client.GetObjectWithContext(getCtx, &s3.GetObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(s3ObjectKey),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(object.Body)
+
+	tempFile, err := os.CreateTemp(tempDir, "mirror-")
+
+	if err != nil {
+		return err
+	}
+
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(tempFile.Name())
+
+	_, err = io.Copy(tempFile, object.Body)
+	closeErr := tempFile.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return putFileToCloud(ctx, target.client, target.awsConfig, s3ObjectKey, tempFile.Name(), putOptions{
+		ContentType:  aws.StringValue(object.ContentType),
+		StorageClass: target.awsConfig.StorageClass,
+	})
+}
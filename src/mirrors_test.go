@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testMirror(t *testing.T, name string) (uploadTarget, *fakeBucket) {
+	bucket := &fakeBucket{objects: map[string][]byte{}}
+
+	return uploadTarget{
+		awsConfig: AwsConfig{Name: name, Bucket: name, RequestTimeout: Duration(time.Second)},
+		client:    newTestS3Client(t, bucket.ServeHTTP),
+	}, bucket
+}
+
+func TestProcessImagesUploadsToMirrors(t *testing.T) {
+	tc := newTestCloner(t, nil)
+	mirror, mirrorBucket := testMirror(t, "backup")
+	tc.cloner.mirrors = []uploadTarget{mirror}
+
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{tc.image(t, 1, 100, "/a.png", 0)})
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(mirrorBucket.objects) != 1 {
+		t.Fatalf("got %d objects on the mirror, want 1", len(mirrorBucket.objects))
+	}
+
+	for key, data := range mirrorBucket.objects {
+		if _, ok := tc.bucket.objects["/bucket"+key[len("/backup"):]]; !ok {
+			t.Errorf("mirror object %s isn't under the primary's key", key)
+		}
+
+		if string(data) != string(testPng) {
+			t.Errorf("mirror object %s doesn't hold the source file", key)
+		}
+	}
+}
+
+func TestAuditMirrorsRestoresMissingCopies(t *testing.T) {
+	config := AppConfig{
+		Aws:     AwsConfig{Bucket: "primary", RequestTimeout: Duration(time.Second)},
+		TempDir: t.TempDir(),
+	}
+
+	primary := &fakeBucket{objects: map[string][]byte{"/primary/media/a.png": testPng}}
+
+	complete, completeBucket := testMirror(t, "complete")
+	completeBucket.objects["/complete/media/a.png"] = testPng
+	behind, behindBucket := testMirror(t, "behind")
+	file := auditedFile{FileId: 1, IngestedUri: "media/a.png"}
+	mirrors := []uploadTarget{complete, behind}
+
+	missing := auditMirrors(context.Background(), newTestS3Client(t, primary.ServeHTTP), config, mirrors, file, false)
+
+	if missing != 1 || len(behindBucket.objects) != 0 {
+		t.Fatalf("got %d missing and %d objects on the mirror, want 1 reported and nothing copied", missing, len(behindBucket.objects))
+	}
+
+	missing = auditMirrors(context.Background(), newTestS3Client(t, primary.ServeHTTP), config, mirrors, file, true)
+
+	if missing != 1 {
+		t.Errorf("got %d missing, want 1", missing)
+	}
+
+	if string(behindBucket.objects["/behind/media/a.png"]) != string(testPng) {
+		t.Error("mirror wasn't given a copy of the primary's object")
+	}
+
+	if completeBucket.puts != 0 {
+		t.Errorf("mirror that had the object got %d uploads", completeBucket.puts)
+	}
+}
+
+func TestDeleteFromMirrors(t *testing.T) {
+	first, firstBucket := testMirror(t, "first")
+	second, secondBucket := testMirror(t, "second")
+	firstBucket.objects["/first/media/a.png"] = testPng
+	secondBucket.objects["/second/media/a.png"] = testPng
+	secondBucket.objects["/second/media/b.png"] = testPng
+
+	failed := deleteFromMirrors(context.Background(), []uploadTarget{first, second}, "media/a.png", 1)
+
+	if failed {
+		t.Error("deleting from the mirrors reported a failure")
+	}
+
+	if len(firstBucket.objects) != 0 || len(secondBucket.objects) != 1 {
+		t.Errorf("mirrors hold %d and %d objects, want 0 and 1", len(firstBucket.objects), len(secondBucket.objects))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultKeyTemplate = "/{{.Folder}}/{{.Date}}/{{.Filename}}"
+
+// dateFolderLayout is how dates are written in object keys and mirror paths
+const dateFolderLayout = "20060102"
+
+// objectKeyData is what a key template can refer to.
+type objectKeyData struct {
+	Folder   string
+	Date     string
+	PostId   int64
+	FileId   int64
+	Ext      string
+	Filename string
+}
+
+func parseKeyTemplate(keyTemplate string) (*template.Template, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(keyTemplate)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Render once with sample values so mistakes such as unknown fields are
+	// caught when the config is loaded rather than on the first upload
+	_, err = renderObjectKey(tmpl, objectKeyData{
+		Folder:   "folder",
+		Date:     "20060102",
+		PostId:   1,
+		FileId:   1,
+		Ext:      "jpg",
+		Filename: "1.1.1.jpg",
+	})
+
+	return tmpl, err
+}
+
+func renderObjectKey(tmpl *template.Template, data objectKeyData) (string, error) {
+	var key bytes.Buffer
+
+	err := tmpl.Execute(&key, data)
+
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(key.String()) == "" {
+		return "", errors.New("key template rendered an empty key")
+	}
+
+	return key.String(), nil
+}
+
+const (
+	keyStrategyTimestamp     = "timestamp"
+	keyStrategyDeterministic = "deterministic"
+)
+
+func isValidKeyStrategy(keyStrategy string) bool {
+	return keyStrategy == keyStrategyTimestamp || keyStrategy == keyStrategyDeterministic
+}
+
+// buildObjectKey renders the key an image is uploaded to. With the timestamp
+// strategy the date is the upload date and the filename includes the time it
+// was downloaded, so reprocessing a file stores a new object. With the
+// deterministic strategy both come from the file row alone, so reprocessing
+// overwrites the same object.
+func buildObjectKey(awsConfig AwsConfig, image *AbtImage) (string, error) {
+	data := objectKeyData{
+		Folder:   awsConfig.Folder,
+		Date:     time.Now().Format(dateFolderLayout),
+		PostId:   image.PostId,
+		FileId:   image.FileId,
+		Ext:      strings.TrimPrefix(image.FileExt, "."),
+		Filename: filepath.Base(image.LocalFilename),
+	}
+
+	if awsConfig.KeyStrategy == keyStrategyDeterministic {
+		created, err := time.Parse("2006-01-02 15:04:05", image.Created)
+
+		if err != nil {
+			return "", fmt.Errorf("could not read created date of file %d: %w", image.FileId, err)
+		}
+
+		data.Date = created.Format(dateFolderLayout)
+		data.Filename = fmt.Sprintf("%d.%d%s", image.FileId, image.PostId, image.FileExt)
+	}
+
+	return renderObjectKey(awsConfig.keyTemplate, data)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildObjectKey(t *testing.T) {
+	image := &AbtImage{FileId: 12, PostId: 34, FileExt: ".jpg", LocalFilename: "1700000000.12.34.jpg"}
+	today := time.Now().Format("20060102")
+
+	tests := []struct {
+		keyTemplate string
+		want        string
+	}{
+		{"", "/media/" + today + "/1700000000.12.34.jpg"},
+		{"posts/{{.PostId}}/{{.FileId}}.{{.Ext}}", "posts/34/12.jpg"},
+		{"{{.Folder}}/{{.Date}}/{{.FileId}}", "media/" + today + "/12"},
+	}
+
+	for _, test := range tests {
+		config := AppConfig{Aws: AwsConfig{Folder: "media", KeyTemplate: test.keyTemplate}}
+		setConfigDefaults(&config)
+
+		err := config.Validate()
+
+		if err != nil {
+			t.Errorf("%q: %v", test.keyTemplate, err)
+			continue
+		}
+
+		key, err := buildObjectKey(config.Aws, image)
+
+		if err != nil || key != test.want {
+			t.Errorf("%q rendered %q, %v, want %q", test.keyTemplate, key, err, test.want)
+		}
+	}
+}
+
+func TestValidateRejectsBadKeyTemplates(t *testing.T) {
+	tests := []string{
+		"{{.PostId",
+		"{{.Bucket}}/{{.FileId}}",
+		"{{if false}}{{.FileId}}{{end}}",
+	}
+
+	for _, keyTemplate := range tests {
+		config := AppConfig{Aws: AwsConfig{KeyTemplate: keyTemplate}}
+
+		err := config.Validate()
+
+		if err == nil || !strings.Contains(err.Error(), "aws.keyTemplate") {
+			t.Errorf("%q: got %v, want an invalid template error", keyTemplate, err)
+		}
+	}
+}
+
+func TestBuildObjectKeyDeterministicIsStableAcrossRuns(t *testing.T) {
+	config := AppConfig{Aws: AwsConfig{Folder: "media", KeyStrategy: keyStrategyDeterministic}}
+	setConfigDefaults(&config)
+
+	err := config.Validate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same row downloaded by two runs gets a different local filename each
+	// time, but must still be stored under the same key
+	firstRun := &AbtImage{FileId: 12, PostId: 34, FileExt: ".jpg", Created: "2023-05-06 07:08:09", LocalFilename: "1700000000.12.34.jpg"}
+	secondRun := &AbtImage{FileId: 12, PostId: 34, FileExt: ".jpg", Created: "2023-05-06 07:08:09", LocalFilename: "1800000000.12.34.jpg"}
+
+	firstKey, err := buildObjectKey(config.Aws, firstRun)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secondKey, err := buildObjectKey(config.Aws, secondRun)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if firstKey != "/media/20230506/12.34.jpg" || secondKey != firstKey {
+		t.Errorf("got keys %q and %q, want both /media/20230506/12.34.jpg", firstKey, secondKey)
+	}
+}
+
+func TestBuildObjectKeyDeterministicNeedsCreatedDate(t *testing.T) {
+	config := AppConfig{Aws: AwsConfig{KeyStrategy: keyStrategyDeterministic}}
+	setConfigDefaults(&config)
+
+	err := config.Validate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = buildObjectKey(config.Aws, &AbtImage{FileId: 12, PostId: 34, FileExt: ".jpg"})
+
+	if err == nil {
+		t.Error("expected an error for a file without a created date")
+	}
+}
+
+func TestValidateRejectsUnknownKeyStrategy(t *testing.T) {
+	config := AppConfig{Aws: AwsConfig{KeyStrategy: "random"}}
+	setConfigDefaults(&config)
+
+	err := config.Validate()
+
+	if err == nil || !strings.Contains(err.Error(), "aws.keyStrategy") {
+		t.Errorf("got %v, want an invalid key strategy error", err)
+	}
+}
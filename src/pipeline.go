@@ -0,0 +1,57 @@
+package main
+
+import "sync"
+
+// runPipeline pushes images through two independent worker pools: fetch
+// workers download each image and hand successful ones to upload workers over
+// a channel, so a slow upload never holds up the next download. fetch returns
+// false when the image should not continue to the upload stage.
+func runPipeline(
+	images []AbtImage,
+	fetchWorkers int,
+	uploadWorkers int,
+	fetch func(image *AbtImage) bool,
+	upload func(image *AbtImage),
+) {
+	pending := make(chan AbtImage)
+	fetched := make(chan AbtImage, uploadWorkers)
+
+	var fetchWg sync.WaitGroup
+	var uploadWg sync.WaitGroup
+
+	for i := 0; i < fetchWorkers; i++ {
+		fetchWg.Add(1)
+
+		go func() {
+			defer fetchWg.Done()
+
+			for image := range pending {
+				if fetch(&image) {
+					fetched <- image
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < uploadWorkers; i++ {
+		uploadWg.Add(1)
+
+		go func() {
+			defer uploadWg.Done()
+
+			for image := range fetched {
+				upload(&image)
+			}
+		}()
+	}
+
+	for _, image := range images {
+		pending <- image
+	}
+
+	close(pending)
+	fetchWg.Wait()
+
+	close(fetched)
+	uploadWg.Wait()
+}
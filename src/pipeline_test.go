@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyTracker records the most calls in flight at once
+type concurrencyTracker struct {
+	mutex    sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrencyTracker) enter() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inFlight++
+
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+}
+
+func (c *concurrencyTracker) leave() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inFlight--
+}
+
+func TestRunPipelineBoundsConcurrencyAndDrains(t *testing.T) {
+	var images []AbtImage
+
+	for i := 1; i <= 20; i++ {
+		images = append(images, AbtImage{FileId: int64(i)})
+	}
+
+	var fetches, uploads concurrencyTracker
+	var uploadedMutex sync.Mutex
+	uploaded := map[int64]bool{}
+
+	fetch := func(image *AbtImage) bool {
+		fetches.enter()
+		defer fetches.leave()
+
+		time.Sleep(2 * time.Millisecond)
+
+		// Odd files fail to fetch and must never reach the upload stage
+		return image.FileId%2 == 0
+	}
+
+	upload := func(image *AbtImage) {
+		uploads.enter()
+		defer uploads.leave()
+
+		time.Sleep(5 * time.Millisecond)
+
+		uploadedMutex.Lock()
+		uploaded[image.FileId] = true
+		uploadedMutex.Unlock()
+	}
+
+	runPipeline(images, 3, 2, fetch, upload)
+
+	if fetches.max > 3 || uploads.max > 2 {
+		t.Errorf("got up to %d fetches and %d uploads at once, want at most 3 and 2", fetches.max, uploads.max)
+	}
+
+	if fetches.max < 2 {
+		t.Errorf("expected fetches to run concurrently, got at most %d", fetches.max)
+	}
+
+	// Every fetched file is uploaded before runPipeline returns
+	if len(uploaded) != 10 {
+		t.Errorf("got %d uploads, want 10", len(uploaded))
+	}
+
+	for fileId := range uploaded {
+		if fileId%2 != 0 {
+			t.Errorf("file %d failed to fetch but was uploaded", fileId)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// fileIdSource processes the given rows whatever their state or age, for
+// looking into why one file isn't being stored or redoing files the audit
+// found missing.
+type fileIdSource struct {
+	fileIds []int64
+	refetch bool
+}
+
+func (s fileIdSource) usesDb() bool {
+	return true
+}
+
+// The rows are read from the primary, as a replica may not have caught up with
+// the result of the last attempt at them, or with audit resetting them.
+func (s fileIdSource) loadImages(ctx context.Context, dbs dbPools, _ AppConfig) ([]AbtImage, error) {
+	var images []AbtImage
+
+	for _, fileId := range s.fileIds {
+		image, err := getImageFromDb(ctx, dbs.write, fileId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("loaded file %d: post %d, state %s, %d attempts, created %s, url %s, stored as %q\n",
+			image.FileId, image.PostId, image.State, image.Attempts, image.Created, image.ExternalUrl, image.S3Url)
+
+		images = append(images, image)
+	}
+
+	if s.refetch {
+		dropValidators(images)
+	}
+
+	return images, nil
+}
+
+// dropValidators makes stored files be fetched again in full, replacing their
+// objects, rather than kept when the source says they haven't changed. It's
+// for files that may have been stored wrongly.
+func dropValidators(images []AbtImage) {
+	for i := range images {
+		images[i].ETag = ""
+		images[i].LastModified = ""
+	}
+}
+
+func getImageFromDb(ctx context.Context, db *sql.DB, fileId int64) (AbtImage, error) {
+	getRows, err := db.QueryContext(
+		ctx,
+		"SELECT "+imageColumns+
+			"FROM rss_aggregator.files "+
+			"WHERE pk_file_id = ?",
+		fileId,
+	)
+
+	if err != nil {
+		return AbtImage{}, err
+	}
+
+	defer func(getRows *sql.Rows) {
+		_ = getRows.Close()
+	}(getRows)
+
+	images, err := scanImageRows(getRows)
+
+	if err != nil {
+		return AbtImage{}, err
+	}
+
+	if len(images) == 0 {
+		return AbtImage{}, fmt.Errorf("no file with id %d", fileId)
+	}
+
+	return images[0], nil
+}
+
+type fileResult struct {
+	State       string
+	Attempts    int64
+	IngestedUri sql.NullString
+	ErrorCode   sql.NullString
+	LastError   sql.NullString
+}
+
+func getFileResultFromDb(ctx context.Context, db *sql.DB, fileId int64) (fileResult, error) {
+	var result fileResult
+
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT state, attempts, ingested_uri, error_code, last_error "+
+			"FROM rss_aggregator.files "+
+			"WHERE pk_file_id = ?",
+		fileId,
+	).Scan(&result.State, &result.Attempts, &result.IngestedUri, &result.ErrorCode, &result.LastError)
+
+	return result, err
+}
+
+// runProcessFile runs one file through the whole pipeline straight away,
+// logging each step, then prints what was recorded for it.
+func runProcessFile(args []string) error {
+	flags := flag.NewFlagSet("process-file", flag.ExitOnError)
+	fileId := flags.Int64("file-id", 0, "id of the file to process")
+	refetch := flags.Bool("refetch", false, "fetch the file again in full even if the source says it hasn't changed")
+	configPath := flags.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	if *fileId <= 0 {
+		return errors.New("--file-id is required")
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		return err
+	}
+
+	err = prepareTempDir(config)
+
+	if err != nil {
+		return err
+	}
+
+	err = start(*configPath, fileIdSource{fileIds: []int64{*fileId}, refetch: *refetch})
+
+	if err != nil {
+		return err
+	}
+
+	db, err := makeDbConnection(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	result, err := getFileResultFromDb(context.Background(), db, *fileId)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("file", *fileId, "is now", result.State, "after", result.Attempts, "attempts")
+
+	if result.IngestedUri.Valid {
+		fmt.Println("stored as", result.IngestedUri.String)
+	}
+
+	if result.ErrorCode.Valid && result.ErrorCode.String != "" {
+		fmt.Println("last error", result.ErrorCode.String, result.LastError.String)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFileIdSourceLoadsRowsWhateverTheirState(t *testing.T) {
+	// A replica that may be behind is never asked
+	replica, _, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer replica.Close()
+
+	tests := []struct {
+		fileId     int64
+		row        []driver.Value
+		wantStored string
+		wantETag   string
+	}{
+		// A stored row keeps its object if processing it again fails
+		{7, []driver.Value{7, 70, "https://example.com/a.jpg", "image", "retrieved", "2020-01-01 00:00:00", 2, "https://test.s3.amazonaws.com/a.jpg", `"v1"`, nil}, "https://test.s3.amazonaws.com/a.jpg", `"v1"`},
+		{8, []driver.Value{8, 80, "https://example.com/b.jpg", nil, "failed", "2020-01-01 00:00:00", 3, nil, nil, nil}, "", ""},
+	}
+
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM rss_aggregator.files WHERE pk_file_id = ?")).
+			WithArgs(test.fileId).
+			WillReturnRows(sqlmock.NewRows(testImageColumns).AddRow(test.row...))
+
+		images, err := fileIdSource{fileIds: []int64{test.fileId}}.loadImages(context.Background(), dbPools{read: replica, write: db}, AppConfig{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(images) != 1 || images[0].FileId != test.fileId {
+			t.Fatalf("got %+v, want file %d", images, test.fileId)
+		}
+
+		if images[0].StoredS3Url != test.wantStored {
+			t.Errorf("file %d: got stored object %q, want %q", test.fileId, images[0].StoredS3Url, test.wantStored)
+		}
+
+		// Kept so an unchanged source doesn't mean uploading the file again
+		if images[0].ETag != test.wantETag {
+			t.Errorf("file %d: got etag %q, want %q", test.fileId, images[0].ETag, test.wantETag)
+		}
+
+		err = mock.ExpectationsWereMet()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		_ = db.Close()
+	}
+}
+
+func TestFileIdSourceReportsMissingFile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE pk_file_id = ?")).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(testImageColumns))
+
+	_, err = fileIdSource{fileIds: []int64{9}}.loadImages(context.Background(), dbPools{read: db, write: db}, AppConfig{})
+
+	if err == nil {
+		t.Error("missing file loaded without an error")
+	}
+}
+
+func TestFileIdSourceLoadsEachFile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// As audit --fix hands over the files it reset
+	for _, fileId := range []int64{3, 5} {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE pk_file_id = ?")).
+			WithArgs(fileId).
+			WillReturnRows(sqlmock.NewRows(testImageColumns).
+				AddRow(fileId, 10*fileId, "https://example.com/a.jpg", "image", "pending", "2020-01-01 00:00:00", 1, nil, nil, nil))
+	}
+
+	images, err := fileIdSource{fileIds: []int64{3, 5}}.loadImages(context.Background(), dbPools{read: db, write: db}, AppConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 2 || images[0].FileId != 3 || images[1].FileId != 5 {
+		t.Errorf("got %+v, want files 3 and 5", images)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileIdSourceRefetchDropsValidators(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE pk_file_id = ?")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(testImageColumns).
+			AddRow(7, 70, "https://example.com/a.jpg", "image", "retrieved", "2020-01-01 00:00:00", 2, "https://test.s3.amazonaws.com/a.jpg", `"v1"`, "Mon, 01 Jan 2024 00:00:00 GMT"))
+
+	images, err := fileIdSource{fileIds: []int64{7}, refetch: true}.loadImages(context.Background(), dbPools{read: db, write: db}, AppConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].ETag != "" || images[0].LastModified != "" {
+		t.Errorf("got %+v, want the validators dropped", images)
+	}
+
+	// The object is still there to fall back on if fetching it fails
+	if images[0].StoredS3Url != "https://test.s3.amazonaws.com/a.jpg" {
+		t.Errorf("got stored object %q", images[0].StoredS3Url)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+)
+
+type RecompressConfig struct {
+	Enabled           bool    `json:"enabled"`
+	Quality           int     `json:"quality"`
+	MinSavingsPercent float64 `json:"minSavingsPercent"`
+	ConvertPng        bool    `json:"convertPng"`
+}
+
+// isWorthwhile reports whether newSize saves at least minSavingsPercent of
+// oldSize.
+func isWorthwhile(oldSize int64, newSize int64, minSavingsPercent float64) bool {
+	if oldSize <= 0 || newSize >= oldSize {
+		return false
+	}
+
+	return float64(oldSize-newSize)/float64(oldSize)*100 >= minSavingsPercent
+}
+
+// isOpaque reports whether an image has no transparency, which is what makes
+// a PNG safe to turn into a JPEG. PNG photos are almost always opaque, while
+// logos and icons that rely on transparency are left alone.
+func isOpaque(img image.Image) bool {
+	opaque, ok := img.(interface{ Opaque() bool })
+
+	return ok && opaque.Opaque()
+}
+
+// recompressImage re-encodes a JPEG at the configured quality, and with
+// ConvertPng an opaque PNG as a JPEG, keeping the result only when it's at
+// least MinSavingsPercent smaller. A converted PNG gets a new local filename,
+// extension and MIME type so the stored object and the DB describe the JPEG.
+// It returns the previous local filename when the file was renamed.
+func recompressImage(abtImage *AbtImage, config RecompressConfig) (string, error) {
+	isJpeg := abtImage.MimeType == "image/jpeg" || abtImage.FileExt == ".jpg" || abtImage.FileExt == ".jpeg"
+	isPng := abtImage.MimeType == "image/png" || abtImage.FileExt == ".png"
+
+	if !isJpeg && !(isPng && config.ConvertPng) {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(abtImage.LocalFilename)
+
+	if err != nil {
+		return "", err
+	}
+
+	var img image.Image
+
+	if isJpeg {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	} else {
+		img, err = png.Decode(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if isPng && !isOpaque(img) {
+		return "", nil
+	}
+
+	// The re-encoded file has no EXIF, so the orientation goes into the pixels
+	img = applyOrientation(img, readExifOrientation(data))
+
+	var out bytes.Buffer
+
+	err = jpeg.Encode(&out, img, &jpeg.Options{Quality: config.Quality})
+
+	if err != nil {
+		return "", err
+	}
+
+	if !isWorthwhile(int64(len(data)), int64(out.Len()), config.MinSavingsPercent) {
+		return "", nil
+	}
+
+	if isJpeg {
+		err = os.WriteFile(abtImage.LocalFilename, out.Bytes(), 0644)
+
+		if err != nil {
+			return "", err
+		}
+
+		abtImage.FileSize = int64(out.Len())
+
+		return "", nil
+	}
+
+	previousFilename := abtImage.LocalFilename
+	jpegFilename := strings.TrimSuffix(previousFilename, abtImage.FileExt) + ".jpg"
+
+	err = os.WriteFile(jpegFilename, out.Bytes(), 0644)
+
+	if err != nil {
+		return "", err
+	}
+
+	_ = os.Remove(previousFilename)
+
+	abtImage.LocalFilename = jpegFilename
+	abtImage.FileExt = ".jpg"
+	abtImage.MimeType = "image/jpeg"
+	abtImage.FileSize = int64(out.Len())
+
+	return previousFilename, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// noisyImage is a photo-like image, which compresses poorly as a PNG or as a
+// high quality JPEG.
+func noisyImage(width int, height int, alpha uint8) *image.NRGBA {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(random.Intn(256)), G: uint8(x), B: uint8(y), A: alpha})
+		}
+	}
+
+	return img
+}
+
+func writeRecompressFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	localFilename := filepath.Join(t.TempDir(), name)
+
+	err := os.WriteFile(localFilename, data, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return localFilename
+}
+
+func encodeTestJpeg(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func encodeTestPng(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	err := png.Encode(&out, img)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestRecompressImageShrinksJpeg(t *testing.T) {
+	original := encodeTestJpeg(t, noisyImage(64, 64, 255), 100)
+	localFilename := writeRecompressFile(t, "1.jpg", original)
+
+	abtImage := AbtImage{LocalFilename: localFilename, MimeType: "image/jpeg", FileExt: ".jpg", FileSize: int64(len(original))}
+
+	previousFilename, err := recompressImage(&abtImage, RecompressConfig{Quality: 50, MinSavingsPercent: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if previousFilename != "" || len(data) >= len(original) || abtImage.FileSize != int64(len(data)) {
+		t.Errorf("got %d bytes with size %d from %d, renamed from %q, want it smaller in place", len(data), abtImage.FileSize, len(original), previousFilename)
+	}
+}
+
+func TestRecompressImageKeepsOriginalUnlessWorthwhile(t *testing.T) {
+	// Already at a lower quality than asked for, so re-encoding saves nothing
+	original := encodeTestJpeg(t, noisyImage(64, 64, 255), 50)
+	localFilename := writeRecompressFile(t, "1.jpg", original)
+
+	abtImage := AbtImage{LocalFilename: localFilename, MimeType: "image/jpeg", FileExt: ".jpg", FileSize: int64(len(original))}
+
+	_, err := recompressImage(&abtImage, RecompressConfig{Quality: 90, MinSavingsPercent: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, original) || abtImage.FileSize != int64(len(original)) {
+		t.Errorf("got %d bytes with size %d, want the original %d left alone", len(data), abtImage.FileSize, len(original))
+	}
+}
+
+func TestRecompressImageConvertsOpaquePng(t *testing.T) {
+	original := encodeTestPng(t, noisyImage(64, 64, 255))
+	localFilename := writeRecompressFile(t, "1.png", original)
+
+	abtImage := AbtImage{LocalFilename: localFilename, MimeType: "image/png", FileExt: ".png", FileSize: int64(len(original))}
+
+	previousFilename, err := recompressImage(&abtImage, RecompressConfig{Quality: 80, MinSavingsPercent: 10, ConvertPng: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if previousFilename != localFilename || abtImage.MimeType != "image/jpeg" || abtImage.FileExt != ".jpg" || !strings.HasSuffix(abtImage.LocalFilename, ".jpg") {
+		t.Fatalf("got %+v renamed from %q, want it converted to a jpeg", abtImage, previousFilename)
+	}
+
+	if _, err := os.Stat(localFilename); !os.IsNotExist(err) {
+		t.Error("the original png should have been removed")
+	}
+
+	data, err := os.ReadFile(abtImage.LocalFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil || int64(len(data)) != abtImage.FileSize {
+		t.Errorf("converted file isn't a %d byte jpeg: %v", abtImage.FileSize, err)
+	}
+}
+
+func TestRecompressImageLeavesTransparentPng(t *testing.T) {
+	original := encodeTestPng(t, noisyImage(64, 64, 128))
+	localFilename := writeRecompressFile(t, "1.png", original)
+
+	abtImage := AbtImage{LocalFilename: localFilename, MimeType: "image/png", FileExt: ".png", FileSize: int64(len(original))}
+
+	previousFilename, err := recompressImage(&abtImage, RecompressConfig{Quality: 80, MinSavingsPercent: 10, ConvertPng: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if previousFilename != "" || abtImage.MimeType != "image/png" || !bytes.Equal(data, original) {
+		t.Errorf("got %+v, want the transparent png left alone", abtImage)
+	}
+}
+
+func TestRecompressImageKeepsOrientation(t *testing.T) {
+	localFilename := writeRecompressFile(t, "1.jpg", exifJpeg(t, 6))
+
+	abtImage := AbtImage{LocalFilename: localFilename, MimeType: "image/jpeg", FileExt: ".jpg"}
+
+	// Any saving will do, as the EXIF block alone is dropped
+	_, err := recompressImage(&abtImage, RecompressConfig{Quality: 50, MinSavingsPercent: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte("Exif")) || img.Bounds().Dx() != 2 || img.Bounds().Dy() != 4 {
+		t.Errorf("got a %dx%d image, want the 4x2 image turned to 2x4", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
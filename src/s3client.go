@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ClientMaxFailures is how many S3 calls in a row can fail with a transient
+// error before the client is thrown away and created again on the next run.
+const s3ClientMaxFailures = 5
+
+// sharedS3Client keeps one S3 client for the life of the service rather than
+// creating a session every run.
+type sharedS3Client struct {
+	mutex    sync.Mutex
+	client   *s3.S3
+	key      string
+	failures int
+}
+
+var s3Clients sharedS3Client
+
+// s3ClientKey covers the settings a client is created from, so a config
+// change picks up a new client.
+func s3ClientKey(awsConfig AwsConfig) string {
+	return fmt.Sprintf(
+		"%s|%s|%s|%s|%t|%t|%t|%t",
+		awsConfig.Endpoint,
+		awsConfig.Region,
+		awsConfig.Key,
+		awsConfig.Secret,
+		usePathStyle(awsConfig),
+		useDefaultCredentials(awsConfig),
+		awsConfig.UseAccelerate,
+		awsConfig.UseDualStack,
+	)
+}
+
+// get returns the client from an earlier run if the AWS config hasn't changed
+// and calls haven't been failing, and a new one otherwise.
+func (c *sharedS3Client) get(awsConfig AwsConfig) (S3API, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := s3ClientKey(awsConfig)
+
+	if c.client == nil || c.key != key || c.failures >= s3ClientMaxFailures {
+		if c.client != nil && c.failures >= s3ClientMaxFailures {
+			fmt.Println("recreating s3 client after", c.failures, "failed calls in a row")
+		}
+
+		client, err := newS3Client(awsConfig)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.client = client
+		c.key = key
+		c.failures = 0
+	}
+
+	return &trackedS3Client{client: c.client, shared: c}, nil
+}
+
+// record tracks whether the client is healthy. Only transient errors count
+// against it; a missing object or denied request says nothing about the
+// connection.
+func (c *sharedS3Client) record(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err == nil {
+		c.failures = 0
+	} else if isRetryableS3Error(err) {
+		c.failures++
+	}
+}
+
+// trackedS3Client reports the outcome of every call back to the shared client.
+type trackedS3Client struct {
+	client *s3.S3
+	shared *sharedS3Client
+}
+
+func (t *trackedS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	output, err := t.client.PutObjectWithContext(ctx, input, opts...)
+	t.shared.record(err)
+
+	return output, err
+}
+
+func (t *trackedS3Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	output, err := t.client.DeleteObjectWithContext(ctx, input, opts...)
+	t.shared.record(err)
+
+	return output, err
+}
+
+func (t *trackedS3Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	output, err := t.client.HeadObjectWithContext(ctx, input, opts...)
+	t.shared.record(err)
+
+	return output, err
+}
+
+func (t *trackedS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	output, err := t.client.GetObjectWithContext(ctx, input, opts...)
+	t.shared.record(err)
+
+	return output, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// countS3Clients counts the clients created through newS3Client for the rest
+// of the test.
+func countS3Clients(t *testing.T) *int {
+	t.Helper()
+
+	created := 0
+	makeClient := newS3Client
+
+	t.Cleanup(func() {
+		newS3Client = makeClient
+	})
+
+	newS3Client = func(awsConfig AwsConfig) (*s3.S3, error) {
+		created++
+		return makeClient(awsConfig)
+	}
+
+	return &created
+}
+
+func TestSharedS3ClientIsReusedAcrossRuns(t *testing.T) {
+	created := countS3Clients(t)
+
+	var clients sharedS3Client
+	awsConfig := AwsConfig{Region: "eu-west-1", Key: "key", Secret: "secret"}
+
+	for run := 0; run < 3; run++ {
+		_, err := clients.get(awsConfig)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if *created != 1 {
+		t.Errorf("created %d clients over 3 runs, want 1", *created)
+	}
+
+	// A config change, e.g. rotated credentials, needs a new client
+	awsConfig.Secret = "rotated"
+
+	_, err := clients.get(awsConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *created != 2 {
+		t.Errorf("created %d clients after the config changed, want 2", *created)
+	}
+}
+
+func TestSharedS3ClientIsRecreatedAfterTransientFailures(t *testing.T) {
+	created := countS3Clients(t)
+
+	var clients sharedS3Client
+	awsConfig := AwsConfig{Region: "eu-west-1"}
+
+	_, err := clients.get(awsConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors that say nothing about the connection don't count against it
+	for i := 0; i < s3ClientMaxFailures; i++ {
+		clients.record(awserr.New("AccessDenied", "access denied", nil))
+	}
+
+	for i := 0; i < s3ClientMaxFailures-1; i++ {
+		clients.record(awserr.New("ServiceUnavailable", "slow down", nil))
+	}
+
+	_, err = clients.get(awsConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *created != 1 {
+		t.Fatalf("created %d clients before the failures added up, want 1", *created)
+	}
+
+	clients.record(awserr.New("ServiceUnavailable", "slow down", nil))
+
+	_, err = clients.get(awsConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *created != 2 {
+		t.Errorf("created %d clients after %d failures in a row, want 2", *created, s3ClientMaxFailures)
+	}
+}
+
+func TestTrackedS3ClientRecordsCalls(t *testing.T) {
+	clients := &sharedS3Client{failures: 2}
+	client := &trackedS3Client{client: newTestS3Client(t, (&fakeBucket{objects: map[string][]byte{}}).ServeHTTP), shared: clients}
+
+	// A successful call shows the client is healthy again
+	_, err := client.PutObjectWithContext(context.Background(), newPutObjectInput(AwsConfig{Bucket: "bucket"}, "/media/a.png", bytes.NewReader(testPng), putOptions{ContentType: "image/png"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clients.failures != 0 {
+		t.Errorf("got %d failures after a successful call, want 0", clients.failures)
+	}
+}
+
+func TestMakeS3ClientEndpointFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		aws      AwsConfig
+		wantHost string
+	}{
+		{"plain", AwsConfig{Region: "eu-west-1"}, "bucket.s3.eu-west-1.amazonaws.com"},
+		{"accelerate", AwsConfig{Region: "eu-west-1", UseAccelerate: true}, "bucket.s3-accelerate.amazonaws.com"},
+		{"dualstack", AwsConfig{Region: "eu-west-1", UseDualStack: true}, "bucket.s3.dualstack.eu-west-1.amazonaws.com"},
+		// A custom endpoint is used as it is, whatever AWS options are set
+		{"custom endpoint", AwsConfig{Region: "eu-west-1", Endpoint: "https://ams3.digitaloceanspaces.com", UseAccelerate: true, UseDualStack: true}, "ams3.digitaloceanspaces.com"},
+	}
+
+	for _, test := range tests {
+		test.aws.Key = "key"
+		test.aws.Secret = "secret"
+
+		client, err := makeS3Client(AppConfig{Aws: test.aws})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := client.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("media/1.png")})
+
+		err = req.Build()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.HTTPRequest.URL.Host != test.wantHost {
+			t.Errorf("%s: got host %s, want %s", test.name, req.HTTPRequest.URL.Host, test.wantHost)
+		}
+	}
+}
+
+func TestS3ClientKeyIncludesEndpointFeatures(t *testing.T) {
+	base := AwsConfig{Region: "eu-west-1"}
+
+	for _, changed := range []AwsConfig{
+		{Region: "eu-west-1", UseAccelerate: true},
+		{Region: "eu-west-1", UseDualStack: true},
+	} {
+		if s3ClientKey(changed) == s3ClientKey(base) {
+			t.Errorf("%+v shares a client with %+v", changed, base)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+var uploadRetryBaseDelay = 500 * time.Millisecond
+
+var retryableS3ErrorCodes = map[string]bool{
+	"SlowDown":                     true,
+	"Throttling":                   true,
+	"ThrottlingException":          true,
+	"RequestLimitExceeded":         true,
+	"RequestTimeout":               true,
+	"InternalError":                true,
+	"ServiceUnavailable":           true,
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+}
+
+// isContextError reports whether an S3 call failed because its context was
+// cancelled or ran out of time, which the SDK reports wrapped in its own
+// errors.
+func isContextError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var awsErr awserr.Error
+
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() == request.CanceledErrorCode || isContextError(awsErr.OrigErr())
+	}
+
+	return false
+}
+
+// isRetryableS3Error reports whether a failed S3 call is worth repeating.
+// Throttling, 5xx responses and network failures are; anything else, such as
+// access denied or a missing bucket, will fail the same way next time. Calls
+// cut short by their context aren't either, as the run is stopping or out of
+// time.
+func isRetryableS3Error(err error) bool {
+	if err == nil || isContextError(err) {
+		return false
+	}
+
+	// Uploading again overwrites an object that was corrupted on the way
+	if errors.Is(err, ErrETagMismatch) {
+		return true
+	}
+
+	var requestErr awserr.RequestFailure
+
+	if errors.As(err, &requestErr) && (requestErr.StatusCode() >= 500 || requestErr.StatusCode() == 429) {
+		return true
+	}
+
+	var awsErr awserr.Error
+
+	if errors.As(err, &awsErr) {
+		return retryableS3ErrorCodes[awsErr.Code()]
+	}
+
+	return false
+}
+
+func uploadRetryDelay(retry int) time.Duration {
+	return uploadRetryBaseDelay << uint(retry)
+}
+
+// withUploadRetries calls put until it succeeds, fails with an error that is
+// not retryable or has been retried maxRetries times, backing off exponentially
+// between attempts.
+func withUploadRetries(ctx context.Context, maxRetries int, put func() error) error {
+	var err error
+
+	for retry := 0; ; retry++ {
+		err = put()
+
+		if err == nil || retry >= maxRetries || !isRetryableS3Error(err) || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(uploadRetryDelay(retry))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestIsRetryableS3Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttled", awserr.New("SlowDown", "slow down", nil), true},
+		{"server error", awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "req"), true},
+		{"network", awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), true},
+		{"etag mismatch", fmt.Errorf("%w: stored a, sent b", ErrETagMismatch), true},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"), false},
+		{"canceled", awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), false},
+		{"deadline", awserr.New(request.ErrCodeRequestError, "send request failed", context.DeadlineExceeded), false},
+		{"bare canceled", context.Canceled, false},
+		{"nil", nil, false},
+	}
+
+	for _, test := range tests {
+		got := isRetryableS3Error(test.err)
+
+		if got != test.want {
+			t.Errorf("%s: isRetryableS3Error(%v) = %t, want %t", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestWithUploadRetriesStopsOnCancel(t *testing.T) {
+	calls := 0
+
+	err := withUploadRetries(context.Background(), 3, func() error {
+		calls++
+		return awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled)
+	})
+
+	if err == nil || calls != 1 {
+		t.Errorf("got %v after %d calls, want the cancel returned after 1", err, calls)
+	}
+}
+
+func TestWithUploadRetriesBacksOff(t *testing.T) {
+	baseDelay := uploadRetryBaseDelay
+	uploadRetryBaseDelay = 20 * time.Millisecond
+
+	t.Cleanup(func() {
+		uploadRetryBaseDelay = baseDelay
+	})
+
+	var calls []time.Time
+
+	// Fails twice with a throttling error, then goes through
+	err := withUploadRetries(context.Background(), 3, func() error {
+		calls = append(calls, time.Now())
+
+		if len(calls) <= 2 {
+			return awserr.New("SlowDown", "slow down", nil)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(calls))
+	}
+
+	for retry := 0; retry < 2; retry++ {
+		waited := calls[retry+1].Sub(calls[retry])
+
+		if waited < uploadRetryDelay(retry) {
+			t.Errorf("retry %d came after %v, want at least %v", retry+1, waited, uploadRetryDelay(retry))
+		}
+	}
+
+	if uploadRetryDelay(1) != 2*uploadRetryDelay(0) {
+		t.Errorf("delays %v and %v don't back off exponentially", uploadRetryDelay(0), uploadRetryDelay(1))
+	}
+}
+
+func TestWithUploadRetriesGivesUp(t *testing.T) {
+	baseDelay := uploadRetryBaseDelay
+	uploadRetryBaseDelay = time.Millisecond
+
+	t.Cleanup(func() {
+		uploadRetryBaseDelay = baseDelay
+	})
+
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		// Retried until MaxUploadRetries is used up
+		{"throttled", awserr.New("SlowDown", "slow down", nil), 3},
+		// Not worth repeating at all
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"), 1},
+	}
+
+	for _, test := range tests {
+		calls := 0
+
+		err := withUploadRetries(context.Background(), 2, func() error {
+			calls++
+			return test.err
+		})
+
+		if err == nil || calls != test.wantCalls {
+			t.Errorf("%s: got %v after %d calls, want an error after %d", test.name, err, calls, test.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func readSecretFile(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// resolveSecretFiles replaces secrets in the config with the contents of their
+// *File counterpart, for deployments where secrets are mounted as files rather
+// than written into the config. A file that is set takes precedence over the
+// inline value.
+func resolveSecretFiles(config *AppConfig) error {
+	secrets := []struct {
+		name  string
+		path  string
+		value *string
+	}{
+		{"db.passFile", config.Db.PasswordFile, &config.Db.Password},
+		{"aws.keyFile", config.Aws.KeyFile, &config.Aws.Key},
+		{"aws.secretFile", config.Aws.SecretFile, &config.Aws.Secret},
+		{"solr.auth.passwordFile", config.Solr.Auth.PasswordFile, &config.Solr.Auth.Password},
+		{"solr.auth.headerValueFile", config.Solr.Auth.HeaderValueFile, &config.Solr.Auth.HeaderValue},
+	}
+
+	for i := range config.Aws.Mirrors {
+		mirror := &config.Aws.Mirrors[i]
+
+		secrets = append(secrets, []struct {
+			name  string
+			path  string
+			value *string
+		}{
+			{fmt.Sprintf("aws.mirrors[%d].keyFile", i), mirror.KeyFile, &mirror.Key},
+			{fmt.Sprintf("aws.mirrors[%d].secretFile", i), mirror.SecretFile, &mirror.Secret},
+		}...)
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+
+		value, err := readSecretFile(secret.path)
+
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", secret.name, err)
+		}
+
+		*secret.value = value
+	}
+
+	for host, auth := range config.HostAuth {
+		err := resolveHostAuthFiles(host, &auth)
+
+		if err != nil {
+			return err
+		}
+
+		config.HostAuth[host] = auth
+	}
+
+	return nil
+}
+
+func resolveHostAuthFiles(host string, auth *HostAuthConfig) error {
+	secrets := []struct {
+		name  string
+		path  string
+		value *string
+	}{
+		{"passwordFile", auth.PasswordFile, &auth.Password},
+		{"tokenFile", auth.TokenFile, &auth.Token},
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+
+		value, err := readSecretFile(secret.path)
+
+		if err != nil {
+			return fmt.Errorf("could not read hostAuth.%s.%s: %w", host, secret.name, err)
+		}
+
+		*secret.value = value
+	}
+
+	return nil
+}
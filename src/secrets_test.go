@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSecretFile(t *testing.T, name string, secret string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(secret), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestResolveSecretFiles(t *testing.T) {
+	config := AppConfig{
+		Db: DbConfig{
+			Password:     "inline-pass",
+			PasswordFile: writeSecretFile(t, "db-pass", "file-pass\n"),
+		},
+		Aws: AwsConfig{
+			Key:        "inline-key",
+			Secret:     "inline-secret",
+			SecretFile: writeSecretFile(t, "aws-secret", "file-secret\r\n"),
+		},
+	}
+
+	err := resolveSecretFiles(&config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file takes precedence over the inline value, with the trailing newline
+	// most editors and kubectl leave on trimmed
+	if config.Db.Password != "file-pass" {
+		t.Errorf("got db password %q, want file-pass", config.Db.Password)
+	}
+
+	if config.Aws.Secret != "file-secret" {
+		t.Errorf("got aws secret %q, want file-secret", config.Aws.Secret)
+	}
+
+	// Without a file the inline value is kept
+	if config.Aws.Key != "inline-key" {
+		t.Errorf("got aws key %q, want inline-key", config.Aws.Key)
+	}
+}
+
+func TestResolveSecretFilesReportsMissingFile(t *testing.T) {
+	config := AppConfig{Aws: AwsConfig{KeyFile: filepath.Join(t.TempDir(), "missing")}}
+
+	err := resolveSecretFiles(&config)
+
+	if err == nil || !strings.Contains(err.Error(), "aws.keyFile") {
+		t.Errorf("got %v, want an error naming aws.keyFile", err)
+	}
+}
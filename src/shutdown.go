@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownDrain lets a run that's under way when the service is asked to stop
+// keep working through the rows it already has for a grace period. Files still
+// outstanding when it runs out are left pending, which hands claimed rows back
+// straight away rather than waiting for the stale claim reset.
+type shutdownDrain struct {
+	once     sync.Once
+	stopping chan struct{}
+	expired  chan struct{}
+}
+
+var shutdown = newShutdownDrain()
+
+// shutdownHardDeadline is how long after the grace period a run has to record
+// its results before the service exits anyway, so a hung db or Solr write
+// can't keep it from stopping.
+const shutdownHardDeadline = 15 * time.Second
+
+func newShutdownDrain() *shutdownDrain {
+	return &shutdownDrain{
+		stopping: make(chan struct{}),
+		expired:  make(chan struct{}),
+	}
+}
+
+// begin stops new runs from starting and ends the current one after grace.
+func (d *shutdownDrain) begin(grace time.Duration) {
+	d.once.Do(func() {
+		close(d.stopping)
+		time.AfterFunc(grace, func() {
+			close(d.expired)
+		})
+	})
+}
+
+func (d *shutdownDrain) stopped() bool {
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// bound returns a context that's cancelled once the grace period has run out.
+func (d *shutdownDrain) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-d.expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// waitForRun waits for the run in progress, if any, to finish, reporting
+// whether it did within timeout.
+func waitForRun(runs sync.Locker, timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		runs.Lock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// handleShutdownSignals drains the current run on SIGTERM or SIGINT, then
+// flushes tracing and exits. A second signal, or the run still going
+// shutdownHardDeadline after the grace period, exits straight away.
+func handleShutdownSignals(grace time.Duration, shutdownTracing func(context.Context) error) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-signals
+		fmt.Println("received", sig, "finishing the current run for up to", grace)
+		shutdown.begin(grace)
+
+		go func() {
+			<-signals
+			fmt.Println("received a second signal, exiting without waiting for the run")
+			os.Exit(1)
+		}()
+
+		// Waits for the run in progress, if any, to record its results
+		if !waitForRun(&runMutex, grace+shutdownHardDeadline) {
+			fmt.Println("the run hasn't finished", shutdownHardDeadline, "after the grace period, exiting without it")
+			_ = shutdownTracing(context.Background())
+			os.Exit(1)
+		}
+
+		_ = shutdownTracing(context.Background())
+		fmt.Println("shut down cleanly")
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// drainForTest swaps in a shutdown that hasn't begun, as the real one can only
+// begin once.
+func drainForTest(t *testing.T) *shutdownDrain {
+	previous := shutdown
+	shutdown = newShutdownDrain()
+
+	t.Cleanup(func() {
+		shutdown = previous
+	})
+
+	return shutdown
+}
+
+func TestProcessImagesDrainsOnShutdown(t *testing.T) {
+	drain := drainForTest(t)
+
+	tc := newTestCloner(t, func(config *AppConfig) {
+		config.FetchWorkers = 1
+		config.ClaimRows = true
+	})
+
+	// The file fetched before the grace period runs out is stored, and the
+	// claimed rows still outstanding are handed back
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+
+	for _, fileId := range []int64{2, 3} {
+		tc.mock.ExpectExec(regexp.QuoteMeta("SET `state` = 'pending', `worker_id` = NULL")).
+			WithArgs(fileId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	drain.begin(300 * time.Millisecond)
+	started := time.Now()
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 1, 100, "/a.png", 0),
+		tc.image(t, 2, 200, "/slow.png", 0),
+		tc.image(t, 3, 300, "/b.png", 0),
+	})
+
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("run took %v, want it stopped by the grace period", time.Since(started))
+	}
+
+	err := tc.mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tc.cloner.summary.Succeeded != 1 || tc.cloner.summary.Skipped != 2 || tc.cloner.summary.Failed != 0 {
+		t.Errorf("got %d succeeded, %d skipped and %d failed, want 1, 2 and 0", tc.cloner.summary.Succeeded, tc.cloner.summary.Skipped, tc.cloner.summary.Failed)
+	}
+}
+
+func TestStartIfIdleSkipsRunsWhenShuttingDown(t *testing.T) {
+	drainForTest(t).begin(time.Minute)
+
+	// The config doesn't exist, so this only succeeds without starting a run
+	err := startIfIdle("missing.json", dbImageSource{})
+
+	if err != nil {
+		t.Errorf("got %v, want no run started", err)
+	}
+}
+
+func TestWaitForRun(t *testing.T) {
+	var idle sync.Mutex
+
+	if !waitForRun(&idle, time.Second) {
+		t.Error("expected an idle service to stop straight away")
+	}
+
+	// A run that never finishes is given up on at the deadline
+	var stuck sync.Mutex
+	stuck.Lock()
+	started := time.Now()
+
+	if waitForRun(&stuck, 50*time.Millisecond) {
+		t.Error("expected the stuck run to hit the deadline")
+	}
+
+	if time.Since(started) > time.Second {
+		t.Errorf("waited %v for the stuck run, want the deadline", time.Since(started))
+	}
+}
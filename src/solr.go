@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	solrRequestTimeout     = 10 * time.Second
+	maxSolrConflictRetries = 3
+)
+
+// errSolrConflict is returned when a document changed between reading its
+// version and updating it.
+var errSolrConflict = errors.New("solr document was changed by another update")
+
+// SolrConfig says where file references are indexed. Updates are posted to
+// <baseUrl>/<collection>/update, so BaseUrl can be just the Solr host.
+type SolrConfig struct {
+	BaseUrl        string         `json:"baseUrl"`
+	Collection     string         `json:"collection"`
+	CommitStrategy string         `json:"commitStrategy"`
+	VersionField   string         `json:"versionField"`
+	ImageField     string         `json:"imageField"`
+	Auth           SolrAuthConfig `json:"auth"`
+}
+
+// UnmarshalJSON also accepts the older form of the config, a single URL that
+// already includes the collection.
+func (c *SolrConfig) UnmarshalJSON(data []byte) error {
+	var baseUrl string
+
+	if json.Unmarshal(data, &baseUrl) == nil {
+		*c = SolrConfig{BaseUrl: baseUrl}
+		return nil
+	}
+
+	// A distinct type so this doesn't recurse back into UnmarshalJSON
+	type solrConfig SolrConfig
+
+	return json.Unmarshal(data, (*solrConfig)(c))
+}
+
+// SolrAuthConfig holds the credentials for a secured Solr, either basic auth or
+// a custom header such as one checked by a reverse proxy. The password and
+// header value can be read from files like the other secrets.
+type SolrAuthConfig struct {
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	PasswordFile    string `json:"passwordFile"`
+	HeaderName      string `json:"headerName"`
+	HeaderValue     string `json:"headerValue"`
+	HeaderValueFile string `json:"headerValueFile"`
+}
+
+func applySolrAuth(req *http.Request, auth SolrAuthConfig) {
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	if auth.HeaderName != "" {
+		req.Header.Set(auth.HeaderName, auth.HeaderValue)
+	}
+}
+
+// solrCommitQuery returns the query string that tells Solr when to commit an
+// update: straight away with commit=true, within a number of milliseconds with
+// commitWithin=<ms>, or not at all with none, leaving it to Solr's autoCommit.
+func solrCommitQuery(strategy string) (string, error) {
+	switch {
+	case strategy == "" || strategy == "commit=true":
+		return "commit=true", nil
+	case strategy == "none":
+		return "", nil
+	case strings.HasPrefix(strategy, "commitWithin="):
+		commitWithin, err := strconv.Atoi(strings.TrimPrefix(strategy, "commitWithin="))
+
+		if err != nil || commitWithin <= 0 {
+			return "", fmt.Errorf("invalid solr commit strategy %q, commitWithin must be a positive number of milliseconds", strategy)
+		}
+
+		return "commitWithin=" + strconv.Itoa(commitWithin), nil
+	}
+
+	return "", fmt.Errorf("unknown solr commit strategy %q", strategy)
+}
+
+func solrUpdateUrl(solrConfig SolrConfig) (string, error) {
+	query, err := solrCommitQuery(solrConfig.CommitStrategy)
+
+	if err != nil {
+		return "", err
+	}
+
+	updateUrl, err := url.JoinPath(solrConfig.BaseUrl, solrConfig.Collection, "update")
+
+	if err != nil {
+		return "", err
+	}
+
+	if query == "" {
+		return updateUrl, nil
+	}
+
+	return updateUrl + "?" + query, nil
+}
+
+func solrGetUrl(solrConfig SolrConfig, postId int64) (string, error) {
+	getUrl, err := url.JoinPath(solrConfig.BaseUrl, solrConfig.Collection, "get")
+
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("id", strconv.FormatInt(postId, 10))
+	query.Set("fl", "_version_,"+solrConfig.VersionField)
+
+	return getUrl + "?" + query.Encode(), nil
+}
+
+// solrVersions are the versions of a post's document as last indexed:
+// DocVersion is Solr's own _version_ and ImageVersion when the image it points
+// at was fetched, in Unix milliseconds.
+type solrVersions struct {
+	Found        bool
+	DocVersion   int64
+	ImageVersion int64
+}
+
+// getSolrVersions reads a post's versions with a real-time get, which sees
+// updates that haven't been committed yet.
+func getSolrVersions(ctx context.Context, httpClient *http.Client, solrConfig SolrConfig, postId int64) (solrVersions, error) {
+	var versions solrVersions
+
+	getUrl, err := solrGetUrl(solrConfig, postId)
+
+	if err != nil {
+		return versions, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, solrRequestTimeout)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", getUrl, nil)
+
+	if err != nil {
+		return versions, err
+	}
+
+	applySolrAuth(req, solrConfig.Auth)
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return versions, err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return versions, &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	var result struct {
+		Doc map[string]int64 `json:"doc"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	if err != nil {
+		return versions, err
+	}
+
+	if result.Doc == nil {
+		return versions, nil
+	}
+
+	versions.Found = true
+	versions.DocVersion = result.Doc["_version_"]
+	versions.ImageVersion = result.Doc[solrConfig.VersionField]
+
+	return versions, nil
+}
+
+// SolrSetDocument is an atomic update replacing the value of one field.
+type SolrSetDocument struct {
+	Set interface{} `json:"set"`
+}
+
+// SolrDocument is an update to one document, its id along with a
+// SolrSetDocument for each field changed. Updates are partial, so fields that
+// aren't included keep their indexed value.
+type SolrDocument map[string]interface{}
+
+// solrImageFields are the fields describing a post's stored image, imageField
+// holding its URL and the rest named after it, e.g. post_image_width. Details
+// that aren't known, such as the dimensions of a video or a thumbnail that
+// wasn't made, are left out rather than cleared.
+func solrImageFields(image AbtImage, imageField string) map[string]SolrSetDocument {
+	fields := map[string]SolrSetDocument{
+		imageField: {Set: image.S3Url},
+	}
+
+	if image.Width > 0 && image.Height > 0 {
+		fields[imageField+"_width"] = SolrSetDocument{Set: image.Width}
+		fields[imageField+"_height"] = SolrSetDocument{Set: image.Height}
+	}
+
+	if image.ThumbS3Url != "" {
+		fields[imageField+"_thumb"] = SolrSetDocument{Set: image.ThumbS3Url}
+	}
+
+	if image.FileSize > 0 {
+		fields[imageField+"_size"] = SolrSetDocument{Set: image.FileSize}
+	}
+
+	return fields
+}
+
+// solrImageDoc builds the atomic update setting a post's image. Given the
+// document's versions, it also records when the image was fetched and only
+// applies if the document is still at the version read, or, if there was no
+// document, still doesn't exist.
+func solrImageDoc(image AbtImage, solrConfig SolrConfig, versions *solrVersions) SolrDocument {
+	doc := SolrDocument{"id": image.PostId}
+
+	for field, update := range solrImageFields(image, solrConfig.ImageField) {
+		doc[field] = update
+	}
+
+	if versions == nil {
+		return doc
+	}
+
+	doc[solrConfig.VersionField] = SolrSetDocument{Set: image.FetchedAt.UnixMilli()}
+	doc["_version_"] = int64(-1)
+
+	if versions.Found {
+		doc["_version_"] = versions.DocVersion
+	}
+
+	return doc
+}
+
+// postSolrUpdate sends a single document update, returning errSolrConflict if
+// Solr rejected it because of its _version_.
+func postSolrUpdate(ctx context.Context, httpClient *http.Client, solrConfig SolrConfig, doc SolrDocument) error {
+	postBody, err := json.Marshal([]SolrDocument{doc})
+
+	if err != nil {
+		return err
+	}
+
+	solrUrl, err := solrUpdateUrl(solrConfig)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, solrRequestTimeout)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", solrUrl, bytes.NewBuffer(postBody))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	applySolrAuth(req, solrConfig.Auth)
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode == http.StatusConflict {
+		return errSolrConflict
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
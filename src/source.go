@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageSource produces the batch of files a run processes. Runs only open a
+// database connection when the source says it needs one.
+type imageSource interface {
+	usesDb() bool
+	loadImages(ctx context.Context, dbs dbPools, config AppConfig) ([]AbtImage, error)
+}
+
+// dbImageSource is the normal source, the pending rows of the files table.
+type dbImageSource struct{}
+
+func (s dbImageSource) usesDb() bool {
+	return true
+}
+
+// Claiming rows writes to them, so only the plain poll can go to a replica.
+func (s dbImageSource) loadImages(ctx context.Context, dbs dbPools, config AppConfig) ([]AbtImage, error) {
+	if !config.ClaimRows {
+		return getImagesFromDb(ctx, dbs.read, config.BatchSize)
+	}
+
+	released, err := releaseStaleClaims(ctx, dbs.write, time.Duration(config.ClaimTimeout))
+
+	if err != nil {
+		fmt.Println("could not release stale claims", err)
+	} else if released > 0 {
+		fmt.Println("released", released, "stale claimed files back to pending")
+	}
+
+	return claimImages(ctx, dbs.write, config.WorkerId, config.BatchSize)
+}
+
+// urlsFileSource reads the files to process from a text file, for backfills
+// and testing. Results are only written to the database when writeDb is set,
+// which needs the lines to carry real file and post ids.
+type urlsFileSource struct {
+	path    string
+	writeDb bool
+}
+
+func (s urlsFileSource) usesDb() bool {
+	return s.writeDb
+}
+
+func (s urlsFileSource) loadImages(_ context.Context, _ dbPools, _ AppConfig) ([]AbtImage, error) {
+	file, err := os.Open(s.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	return parseUrlsFile(file, s.writeDb)
+}
+
+// parseUrlsFile reads one file per line, either just its URL or
+// "<fileId>,<postId>,<url>". Blank lines and lines starting with # are
+// skipped. Lines without ids use the line number as the file id, which keeps
+// local filenames apart but can't be written to the database.
+func parseUrlsFile(r io.Reader, requireIds bool) ([]AbtImage, error) {
+	var images []AbtImage
+
+	created := time.Now().UTC().Format("2006-01-02 15:04:05")
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		image := AbtImage{
+			FileId:  int64(lineNumber),
+			State:   "pending",
+			Created: created,
+		}
+
+		rawUrl := line
+		fields := strings.SplitN(line, ",", 3)
+
+		if len(fields) == 3 {
+			fileId, fileIdErr := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+			postId, postIdErr := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+
+			if fileIdErr == nil && postIdErr == nil {
+				image.FileId = fileId
+				image.PostId = postId
+				rawUrl = strings.TrimSpace(fields[2])
+			}
+		}
+
+		if requireIds && rawUrl == line {
+			return images, fmt.Errorf("line %d has no file and post ids, which are needed to write to the db", lineNumber)
+		}
+
+		externalUrl, err := url.Parse(rawUrl)
+
+		if err != nil {
+			return images, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		image.ExternalUrl = externalUrl
+		images = append(images, image)
+	}
+
+	return images, scanner.Err()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseUrlsFile(t *testing.T) {
+	input := strings.Join([]string{
+		"# backfill for the january outage",
+		"http://images.example.com/a.png",
+		"",
+		"   ",
+		"12, 34 ,http://images.example.com/b.png",
+		"  # indented comments are skipped too",
+		"http://images.example.com/c.png?size=large,crop",
+	}, "\n")
+
+	images, err := parseUrlsFile(strings.NewReader(input), false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		fileId int64
+		postId int64
+		url    string
+	}{
+		// Lines without ids are numbered by line
+		{2, 0, "http://images.example.com/a.png"},
+		{12, 34, "http://images.example.com/b.png"},
+		{7, 0, "http://images.example.com/c.png?size=large,crop"},
+	}
+
+	if len(images) != len(want) {
+		t.Fatalf("got %d images, want %d", len(images), len(want))
+	}
+
+	for i, w := range want {
+		image := images[i]
+
+		if image.FileId != w.fileId || image.PostId != w.postId || image.ExternalUrl.String() != w.url || image.State != "pending" {
+			t.Errorf("line %d: got file %d, post %d, %s in state %s, want %d, %d, %s", i, image.FileId, image.PostId, image.ExternalUrl, image.State, w.fileId, w.postId, w.url)
+		}
+	}
+}
+
+func TestParseUrlsFileErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		requireIds bool
+		wantErr    string
+	}{
+		{"bad url", "http://images.example.com/a.png\nhttp://[::1/b.png", false, "line 2"},
+		{"bad url after ids", "1,2,%zz", false, "line 1"},
+		{"no ids when required", "1,2,http://images.example.com/a.png\nhttp://images.example.com/b.png", true, "line 2"},
+		{"ids that aren't numbers", "a,b,http://images.example.com/a.png", true, "line 1"},
+	}
+
+	for _, test := range tests {
+		_, err := parseUrlsFile(strings.NewReader(test.input), test.requireIds)
+
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got %v, want an error for %s", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestParseUrlsFileWithIdsForDb(t *testing.T) {
+	images, err := parseUrlsFile(strings.NewReader("# ids are needed\n5,6,http://images.example.com/a.png\n"), true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].FileId != 5 || images[0].PostId != 6 {
+		t.Errorf("got %+v, want file 5 of post 6", images)
+	}
+}
+
+func TestDbImageSourceClaimsOnWriteServer(t *testing.T) {
+	for _, claimRows := range []bool{false, true} {
+		read, readMock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		write, writeMock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows := sqlmock.NewRows(testImageColumns).
+			AddRow(1, 10, "https://example.com/a.jpg", "image", "pending", "2024-01-01 00:00:00", 0, nil, nil, nil)
+
+		// Claiming writes to the rows, so only a plain poll can use a replica
+		if claimRows {
+			writeMock.ExpectExec(regexp.QuoteMeta("SET `state` = 'pending', `worker_id` = NULL")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			writeMock.ExpectExec(regexp.QuoteMeta("SET `state` = 'processing'")).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			writeMock.ExpectQuery(regexp.QuoteMeta("FROM rss_aggregator.files")).
+				WillReturnRows(rows)
+		} else {
+			readMock.ExpectQuery(regexp.QuoteMeta("FROM rss_aggregator.files")).
+				WillReturnRows(rows)
+		}
+
+		config := AppConfig{BatchSize: 10, ClaimRows: claimRows, WorkerId: "worker-1"}
+		images, err := dbImageSource{}.loadImages(context.Background(), dbPools{read: read, write: write}, config)
+
+		if err != nil {
+			t.Fatalf("claimRows %t: %v", claimRows, err)
+		}
+
+		if len(images) != 1 {
+			t.Errorf("claimRows %t: got %d images, want 1", claimRows, len(images))
+		}
+
+		for _, mock := range []sqlmock.Sqlmock{readMock, writeMock} {
+			err = mock.ExpectationsWereMet()
+
+			if err != nil {
+				t.Errorf("claimRows %t: %v", claimRows, err)
+			}
+		}
+
+		_ = read.Close()
+		_ = write.Close()
+	}
+}
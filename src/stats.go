@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+type stateCount struct {
+	State string `json:"state"`
+	Count int64  `json:"count"`
+}
+
+type dayStateCount struct {
+	Day   string `json:"day"`
+	State string `json:"state"`
+	Count int64  `json:"count"`
+}
+
+type fileStats struct {
+	ByState []stateCount    `json:"byState"`
+	ByDay   []dayStateCount `json:"byDay"`
+}
+
+func getFileStatsFromDb(ctx context.Context, db *sql.DB, days int) (fileStats, error) {
+	var stats fileStats
+
+	stateRows, err := db.QueryContext(
+		ctx,
+		"SELECT state, COUNT(*) "+
+			"FROM rss_aggregator.files "+
+			"GROUP BY state "+
+			"ORDER BY state",
+	)
+
+	if err != nil {
+		return stats, err
+	}
+
+	defer func(stateRows *sql.Rows) {
+		_ = stateRows.Close()
+	}(stateRows)
+
+	for stateRows.Next() {
+		var count stateCount
+
+		err = stateRows.Scan(&count.State, &count.Count)
+
+		if err != nil {
+			return stats, err
+		}
+
+		stats.ByState = append(stats.ByState, count)
+	}
+
+	err = stateRows.Err()
+
+	if err != nil {
+		return stats, err
+	}
+
+	dayRows, err := db.QueryContext(
+		ctx,
+		"SELECT DATE_FORMAT(created, '%Y-%m-%d') AS day, state, COUNT(*) "+
+			"FROM rss_aggregator.files "+
+			"WHERE created >= CURDATE() - INTERVAL ? DAY "+
+			"GROUP BY day, state "+
+			"ORDER BY day DESC, state",
+		days-1,
+	)
+
+	if err != nil {
+		return stats, err
+	}
+
+	defer func(dayRows *sql.Rows) {
+		_ = dayRows.Close()
+	}(dayRows)
+
+	for dayRows.Next() {
+		var count dayStateCount
+
+		err = dayRows.Scan(&count.Day, &count.State, &count.Count)
+
+		if err != nil {
+			return stats, err
+		}
+
+		stats.ByDay = append(stats.ByDay, count)
+	}
+
+	return stats, dayRows.Err()
+}
+
+func printFileStatsTable(stats fileStats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(w, "STATE\tCOUNT")
+
+	for _, count := range stats.ByState {
+		_, _ = fmt.Fprintf(w, "%s\t%d\n", count.State, count.Count)
+	}
+
+	_, _ = fmt.Fprintln(w, "\nDAY\tSTATE\tCOUNT")
+
+	for _, count := range stats.ByDay {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\n", count.Day, count.State, count.Count)
+	}
+
+	return w.Flush()
+}
+
+// runStats prints how many files are in each state, overall and per day,
+// without processing anything.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := flags.String("format", "table", "output format, json or table")
+	days := flags.Int("days", 7, "number of days to break the counts down by")
+	configPath := flags.String("config", defaultConfigPath, "path to the config file, or - to read it from stdin")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	if *format != "json" && *format != "table" {
+		return fmt.Errorf("unknown format %q, expected json or table", *format)
+	}
+
+	if *days < 1 {
+		return fmt.Errorf("--days must be at least 1")
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		return err
+	}
+
+	// Only reads, so a replica will do
+	db, err := openDb(config, config.Db.readServer())
+
+	if err != nil {
+		return err
+	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	stats, err := getFileStatsFromDb(context.Background(), db, *days)
+
+	if err != nil {
+		return err
+	}
+
+	if *format == "table" {
+		return printFileStatsTable(stats)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(stats)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetFileStatsFromDb(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("GROUP BY state")).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "count"}).
+			AddRow("failed", 3).
+			AddRow("pending", 12).
+			AddRow("retrieved", 40))
+
+	// The current day counts as one of them, so 7 days go back 6 from today
+	mock.ExpectQuery(regexp.QuoteMeta("INTERVAL ? DAY") + ".*" + regexp.QuoteMeta("GROUP BY day, state")).
+		WithArgs(6).
+		WillReturnRows(sqlmock.NewRows([]string{"day", "state", "count"}).
+			AddRow("2024-01-02", "pending", 12).
+			AddRow("2024-01-01", "retrieved", 40))
+
+	stats, err := getFileStatsFromDb(context.Background(), db, 7)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fileStats{
+		ByState: []stateCount{{"failed", 3}, {"pending", 12}, {"retrieved", 40}},
+		ByDay:   []dayStateCount{{"2024-01-02", "pending", 12}, {"2024-01-01", "retrieved", 40}},
+	}
+
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+
+	err = mock.ExpectationsWereMet()
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunStatsRejectsBadFlags(t *testing.T) {
+	tests := [][]string{
+		{"--format", "csv"},
+		{"--days", "0"},
+	}
+
+	for _, args := range tests {
+		// Checked before the config is read, so no config or db is needed
+		if err := runStats(args); err == nil {
+			t.Errorf("runStats(%v) should have failed", args)
+		}
+	}
+}
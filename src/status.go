@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type serviceStatus struct {
+	Version   string          `json:"version"`
+	Commit    string          `json:"commit"`
+	BuildDate string          `json:"buildDate"`
+	Running   bool            `json:"running"`
+	LastRun   json.RawMessage `json:"lastRun"`
+
+	// Local files that runs since startup failed to remove, and so are
+	// taking up disk until the next startup sweep
+	LeakedFiles int   `json:"leakedFiles"`
+	LeakedBytes int64 `json:"leakedBytes"`
+}
+
+var statusMutex sync.Mutex
+var runInProgress bool
+var lastRunSummaryJson json.RawMessage
+var leakedFiles int
+var leakedBytes int64
+
+func setRunInProgress(running bool) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	runInProgress = running
+}
+
+func recordLeakedFile(fileSize int64) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	leakedFiles++
+	leakedBytes += fileSize
+}
+
+func setLastRunSummary(summaryJson []byte) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	lastRunSummaryJson = summaryJson
+}
+
+func getServiceStatus() serviceStatus {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	status := serviceStatus{
+		Version:     version,
+		Commit:      commit,
+		BuildDate:   buildDate,
+		Running:     runInProgress,
+		LastRun:     lastRunSummaryJson,
+		LeakedFiles: leakedFiles,
+		LeakedBytes: leakedBytes,
+	}
+
+	if status.LastRun == nil {
+		status.LastRun = json.RawMessage("null")
+	}
+
+	return status
+}
+
+func handleStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(getServiceStatus())
+
+	if err != nil {
+		fmt.Println("could not write status response", err)
+	}
+}
+
+// startStatusServer serves the status endpoints in the background. It's only
+// started when an address is configured.
+func startStatusServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+
+	go func() {
+		fmt.Println("serving status on", addr)
+
+		err := http.ListenAndServe(addr, mux)
+
+		if err != nil {
+			fmt.Println("status server stopped", err)
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func getStatusResponse(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handleStatus(recorder, httptest.NewRequest("GET", "/status", nil))
+
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("status served as %q", recorder.Header().Get("Content-Type"))
+	}
+
+	var status map[string]interface{}
+
+	err := json.Unmarshal(recorder.Body.Bytes(), &status)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status
+}
+
+func TestHandleStatus(t *testing.T) {
+	setLastRunSummary(nil)
+	setRunInProgress(false)
+
+	status := getStatusResponse(t)
+
+	if status["running"] != false || status["lastRun"] != nil {
+		t.Errorf("got %v before any run, want nothing running and no last run", status)
+	}
+
+	setRunInProgress(true)
+
+	summary := newRunSummary()
+	summary.recordProcessed(2)
+	summary.recordSuccess("images.example.com", 10)
+	reportRunSummary(summary, "")
+
+	status = getStatusResponse(t)
+	lastRun, ok := status["lastRun"].(map[string]interface{})
+
+	if status["running"] != true || !ok || lastRun["processed"] != float64(2) || lastRun["succeeded"] != float64(1) {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	setRunInProgress(false)
+	setLastRunSummary(nil)
+}
+
+func TestHandleStatusIncludesVersion(t *testing.T) {
+	saved := []string{version, commit, buildDate}
+	version, commit, buildDate = "1.4.0", "abc1234", "2024-01-02"
+
+	t.Cleanup(func() {
+		version, commit, buildDate = saved[0], saved[1], saved[2]
+	})
+
+	status := getStatusResponse(t)
+
+	if status["version"] != "1.4.0" || status["commit"] != "abc1234" || status["buildDate"] != "2024-01-02" {
+		t.Errorf("got %v, want the build info set at link time", status)
+	}
+
+	if versionString() != "1.4.0 (commit abc1234, built 2024-01-02)" {
+		t.Errorf("got version string %q", versionString())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type HostStats struct {
+	Ok   int `json:"ok"`
+	Fail int `json:"fail"`
+}
+
+// RunSummary tallies the outcome of a single run. It's updated concurrently by
+// the pipeline workers so all changes go through its methods.
+type RunSummary struct {
+	mutex      sync.Mutex
+	Started    time.Time `json:"started"`
+	Processed  int       `json:"processed"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	Skipped    int       `json:"skipped"`
+	TotalBytes int64     `json:"totalBytes"`
+	ElapsedMs  int64     `json:"elapsedMs"`
+	LastError  string    `json:"lastError,omitempty"`
+
+	// LeakedFiles and LeakedBytes count local files that couldn't be removed
+	// after the run
+	LeakedFiles int   `json:"leakedFiles"`
+	LeakedBytes int64 `json:"leakedBytes"`
+
+	// Hosts breaks successes and failures down by source host, to spot feeds
+	// with chronically broken media URLs
+	Hosts map[string]*HostStats `json:"hosts"`
+}
+
+func newRunSummary() *RunSummary {
+	return &RunSummary{
+		Started: time.Now(),
+		Hosts:   make(map[string]*HostStats),
+	}
+}
+
+func (s *RunSummary) hostStats(host string) *HostStats {
+	stats, ok := s.Hosts[host]
+
+	if !ok {
+		stats = &HostStats{}
+		s.Hosts[host] = stats
+	}
+
+	return stats
+}
+
+func (s *RunSummary) recordProcessed(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Processed += count
+}
+
+func (s *RunSummary) recordSuccess(host string, fileSize int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Succeeded++
+	s.hostStats(host).Ok++
+
+	if fileSize > 0 {
+		s.TotalBytes += fileSize
+	}
+}
+
+func (s *RunSummary) recordFailure(host string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Failed++
+	s.hostStats(host).Fail++
+	s.LastError = err.Error()
+}
+
+func (s *RunSummary) recordSkip() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Skipped++
+}
+
+func (s *RunSummary) recordLeak(fileSize int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.LeakedFiles++
+	s.LeakedBytes += fileSize
+}
+
+func (s *RunSummary) failureRate() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Processed == 0 {
+		return 0
+	}
+
+	return float64(s.Failed) / float64(s.Processed)
+}
+
+func (s *RunSummary) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ElapsedMs = time.Since(s.Started).Milliseconds()
+}
+
+func (s *RunSummary) toJson() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return json.Marshal(s)
+}
+
+func postRunSummary(webhookUrl string, summaryJson []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookUrl, bytes.NewBuffer(summaryJson))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("summary webhook responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func reportRunSummary(summary *RunSummary, webhookUrl string) {
+	summary.finish()
+
+	summaryJson, err := summary.toJson()
+
+	if err != nil {
+		fmt.Println("could not encode run summary", err)
+		return
+	}
+
+	fmt.Println(string(summaryJson))
+	setLastRunSummary(summaryJson)
+
+	if webhookUrl == "" {
+		return
+	}
+
+	err = postRunSummary(webhookUrl, summaryJson)
+
+	if err != nil {
+		fmt.Println("could not post run summary", err)
+	}
+}
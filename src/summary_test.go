@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunSummaryTallies(t *testing.T) {
+	summary := newRunSummary()
+	summary.recordProcessed(4)
+	summary.recordSuccess("images.example.com", 100)
+	summary.recordSuccess("images.example.com", -1)
+	summary.recordFailure("images.example.com", errors.New("unexpected http status: 500"))
+	summary.recordSkip()
+
+	if summary.Processed != 4 || summary.Succeeded != 2 || summary.Failed != 1 || summary.Skipped != 1 {
+		t.Errorf("unexpected tallies %+v", summary)
+	}
+
+	if summary.LastError != "unexpected http status: 500" {
+		t.Errorf("got last error %q", summary.LastError)
+	}
+
+	// An unknown size doesn't count against the total
+	if summary.TotalBytes != 100 {
+		t.Errorf("got %d total bytes, want 100", summary.TotalBytes)
+	}
+}
+
+func TestRunSummaryTalliesByHost(t *testing.T) {
+	summary := newRunSummary()
+	failure := errors.New("unexpected http status: 404")
+
+	summary.recordSuccess("images.example.com", 10)
+	summary.recordSuccess("images.example.com", 10)
+	summary.recordFailure("images.example.com", failure)
+	summary.recordFailure("broken.example.org", failure)
+	summary.recordFailure("broken.example.org", failure)
+	summary.recordSuccess("cdn.example.net", 10)
+
+	want := map[string]HostStats{
+		"images.example.com": {Ok: 2, Fail: 1},
+		"broken.example.org": {Ok: 0, Fail: 2},
+		"cdn.example.net":    {Ok: 1, Fail: 0},
+	}
+
+	if len(summary.Hosts) != len(want) {
+		t.Errorf("got stats for %d hosts, want %d", len(summary.Hosts), len(want))
+	}
+
+	for host, stats := range want {
+		got, ok := summary.Hosts[host]
+
+		if !ok || *got != stats {
+			t.Errorf("%s: got %+v, want %+v", host, got, stats)
+		}
+	}
+
+	summaryJson, err := summary.toJson()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Hosts map[string]HostStats `json:"hosts"`
+	}
+
+	err = json.Unmarshal(summaryJson, &decoded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Hosts["broken.example.org"].Fail != 2 {
+		t.Errorf("expected the host stats in the summary json, got %s", summaryJson)
+	}
+}
+
+func TestReportRunSummaryPostsJson(t *testing.T) {
+	var contentType string
+	var received map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	summary := newRunSummary()
+	summary.recordProcessed(3)
+	summary.recordSuccess("images.example.com", 2048)
+	summary.recordFailure("images.example.com", errors.New("unexpected http status: 500"))
+	summary.recordSkip()
+
+	reportRunSummary(summary, server.URL)
+
+	if contentType != "application/json" {
+		t.Errorf("posted as %q, want application/json", contentType)
+	}
+
+	want := map[string]float64{"processed": 3, "succeeded": 1, "failed": 1, "skipped": 1, "totalBytes": 2048}
+
+	for field, value := range want {
+		if received[field] != value {
+			t.Errorf("%s = %v, want %v", field, received[field], value)
+		}
+	}
+
+	if _, ok := received["started"]; !ok {
+		t.Error("expected the start time in the summary")
+	}
+
+	if _, ok := received["elapsedMs"]; !ok {
+		t.Error("expected the elapsed time in the summary")
+	}
+}
+
+func TestPostRunSummaryFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := postRunSummary(server.URL, []byte("{}"))
+
+	if err == nil {
+		t.Error("expected an error for a 502 from the webhook")
+	}
+}
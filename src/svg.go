@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const svgMimeType = "image/svg+xml"
+
+// svgDroppedElements can run script or pull in other documents, so they're
+// removed along with everything inside them.
+var svgDroppedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
+
+// compactSvgValue lowercases a value and drops the whitespace and control
+// characters browsers ignore inside a URL scheme, so "jav&#x09;ascript:" is
+// caught too.
+func compactSvgValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToLower(value))
+}
+
+// isUnsafeSvgAttr reports whether an attribute can run script or reference
+// something outside the document. Links are only kept when they point within
+// the document, and animations can't target links or event handlers.
+func isUnsafeSvgAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := compactSvgValue(attr.Value)
+
+	if strings.HasPrefix(name, "on") {
+		return true
+	}
+
+	if name == "href" && !strings.HasPrefix(value, "#") {
+		return true
+	}
+
+	if name == "attributename" && (strings.HasSuffix(value, "href") || strings.HasPrefix(value, "on")) {
+		return true
+	}
+
+	return isUnsafeSvgStyle(value)
+}
+
+// isUnsafeSvgStyle reports whether CSS, or an attribute value, can run script
+// or load something from outside the document. CSS escapes could spell out
+// either, so any backslash counts too.
+func isUnsafeSvgStyle(css string) bool {
+	css = compactSvgValue(css)
+
+	return strings.Contains(css, "@import") ||
+		strings.Contains(css, "javascript:") ||
+		strings.Contains(css, "expression(") ||
+		strings.Contains(css, "\\") ||
+		strings.Contains(strings.ReplaceAll(css, "url(#", ""), "url(")
+}
+
+// sanitizeSvg rewrites an SVG without script elements, event handler
+// attributes, DTDs or references to anything outside the document, so it can
+// be served from our own domain without becoming an XSS vector.
+func sanitizeSvg(in io.Reader, out io.Writer) error {
+	decoder := xml.NewDecoder(in)
+	var buf bytes.Buffer
+
+	// Depth inside an element that's being dropped, 0 when not in one
+	dropDepth := 0
+	inStyle := false
+	// RawToken doesn't check that elements are closed in order, so the open
+	// ones are tracked here
+	var open []string
+
+	for {
+		token, err := decoder.RawToken()
+
+		if err == io.EOF {
+			if len(open) > 0 {
+				return fmt.Errorf("svg ends inside <%s>", open[len(open)-1])
+			}
+
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, qualifiedName(t.Name))
+
+			if dropDepth > 0 || svgDroppedElements[strings.ToLower(t.Name.Local)] {
+				dropDepth++
+				continue
+			}
+
+			inStyle = strings.ToLower(t.Name.Local) == "style"
+
+			buf.WriteString("<" + qualifiedName(t.Name))
+
+			for _, attr := range t.Attr {
+				if isUnsafeSvgAttr(attr) {
+					continue
+				}
+
+				buf.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				_ = xml.EscapeText(&buf, []byte(attr.Value))
+				buf.WriteString(`"`)
+			}
+
+			buf.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != qualifiedName(t.Name) {
+				return fmt.Errorf("unexpected </%s> in svg", qualifiedName(t.Name))
+			}
+
+			open = open[:len(open)-1]
+
+			if dropDepth > 0 {
+				dropDepth--
+				continue
+			}
+
+			inStyle = false
+			buf.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if dropDepth > 0 || (inStyle && isUnsafeSvgStyle(string(t))) {
+				continue
+			}
+
+			_ = xml.EscapeText(&buf, t)
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				buf.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+
+	_, err := out.Write(buf.Bytes())
+
+	return err
+}
+
+func sanitizeSvgFile(filename string) (int64, error) {
+	in, err := os.Open(filename)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var out bytes.Buffer
+
+	err = sanitizeSvg(in, &out)
+	_ = in.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.WriteFile(filename, out.Bytes(), 0644)
+
+	return int64(out.Len()), err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sanitizedSvg(t *testing.T, svg string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	err := sanitizeSvg(strings.NewReader(svg), &out)
+
+	if err != nil {
+		t.Fatalf("could not sanitize %s: %v", svg, err)
+	}
+
+	return out.String()
+}
+
+func TestSanitizeSvgRemovesScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		svg    string
+		banned []string
+	}{
+		{"script element", `<svg><script>alert(1)</script><rect/></svg>`, []string{"script", "alert"}},
+		{"uppercase script", `<svg><SCRIPT>alert(1)</SCRIPT></svg>`, []string{"script", "alert"}},
+		{"namespaced script", `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:script>alert(1)</svg:script></svg:svg>`, []string{"script", "alert"}},
+		{"cdata script", `<svg><script><![CDATA[alert(1)]]></script></svg>`, []string{"script", "alert"}},
+		{"event handler", `<svg onload="alert(1)"><rect onclick="alert(2)"/></svg>`, []string{"onload", "onclick", "alert"}},
+		{"uppercase event handler", `<svg ONLOAD="alert(1)"></svg>`, []string{"onload", "alert"}},
+		{"javascript link", `<svg><a href="javascript:alert(1)"><rect/></a></svg>`, []string{"javascript", "alert"}},
+		{"xlink javascript link", `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href="javascript:alert(1)"/></svg>`, []string{"javascript", "alert"}},
+		{"tab in scheme", `<svg><a href="jav&#x09;ascript:alert(1)"/></svg>`, []string{"ascript", "alert"}},
+		{"animated link", `<svg><a><animate attributeName="href" values="jav&#x09;ascript:alert(1)"/></a></svg>`, []string{"attributeName", "alert"}},
+		{"set link", `<svg><a><set attributeName="xlink:href" to="javascript:alert(1)"/></a></svg>`, []string{"attributeName", "alert"}},
+		{"animated handler", `<svg><set attributeName="onmouseover" to="alert(1)"/></svg>`, []string{"attributeName", "onmouseover"}},
+		{"foreign object", `<svg><foreignObject><iframe src="https://evil.example"></iframe></foreignObject></svg>`, []string{"foreignObject", "iframe", "evil"}},
+		{"embed and object", `<svg><embed src="https://evil.example/a"/><object data="https://evil.example/b"/></svg>`, []string{"embed", "object", "evil"}},
+		{"handler element", `<svg><handler type="application/ecmascript">alert(1)</handler></svg>`, []string{"handler", "alert"}},
+		{"external image", `<svg><image href="https://evil.example/track.png"/></svg>`, []string{"evil"}},
+		{"data uri", `<svg><image href="data:image/svg+xml;base64,PHN2Zz4="/></svg>`, []string{"data:"}},
+		{"external use", `<svg><use href="https://evil.example/sprite.svg#a"/></svg>`, []string{"evil"}},
+		{"style url", `<svg><rect style="fill: url(https://evil.example/track)"/></svg>`, []string{"evil"}},
+		{"style url after local url", `<svg><rect style="fill: url(#a); stroke: url(https://evil.example/t)"/></svg>`, []string{"evil"}},
+		{"style import", `<svg><style>@import url(https://evil.example/a.css);</style></svg>`, []string{"import", "evil"}},
+		{"style escape", `<svg><style>rect { background: \75rl(https://evil.example/t) }</style></svg>`, []string{"evil"}},
+		{"style expression", `<svg><rect style="width: expression(alert(1))"/></svg>`, []string{"expression", "alert"}},
+		{"entity expansion", `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY x "boom">]><svg><text>hi</text></svg>`, []string{"DOCTYPE", "ENTITY", "boom"}},
+		{"processing instruction", `<?xml-stylesheet href="https://evil.example/a.xsl"?><svg/>`, []string{"stylesheet", "evil"}},
+	}
+
+	for _, test := range tests {
+		got := sanitizedSvg(t, test.svg)
+
+		for _, banned := range test.banned {
+			if strings.Contains(strings.ToLower(got), strings.ToLower(banned)) {
+				t.Errorf("%s: sanitized %s to %s, which still contains %q", test.name, test.svg, got, banned)
+			}
+		}
+	}
+}
+
+func TestSanitizeSvgKeepsDrawing(t *testing.T) {
+	svg := `<?xml version="1.0"?>` +
+		`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">` +
+		`<defs><linearGradient id="g"><stop offset="0" stop-color="red"/></linearGradient></defs>` +
+		`<rect width="10" height="10" fill="url(#g)"/>` +
+		`<a href="#top"><text x="1" y="5">a &amp; b</text></a>` +
+		`<animate attributeName="opacity" from="0" to="1" dur="1s"/>` +
+		`</svg>`
+
+	got := sanitizedSvg(t, svg)
+
+	for _, kept := range []string{`<?xml version="1.0"?>`, `width="10"`, `fill="url(#g)"`, `href="#top"`, `a &amp; b`, `attributeName="opacity"`, `<stop offset="0" stop-color="red">`} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("sanitized svg %s is missing %s", got, kept)
+		}
+	}
+}
+
+func TestSanitizeSvgRejectsMalformedXml(t *testing.T) {
+	var out bytes.Buffer
+
+	err := sanitizeSvg(strings.NewReader(`<svg><rect></svg>`), &out)
+
+	if err == nil {
+		t.Errorf("malformed svg was sanitized to %s", out.String())
+	}
+}
+
+func TestFetchStoreImageFromUrlRejectsSvgUnlessSanitized(t *testing.T) {
+	chdirTemp(t)
+
+	malicious := `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><rect width="1" height="1" onload="alert(2)"/></svg>`
+
+	for _, sanitize := range []bool{false, true} {
+		config := AppConfig{
+			MediaTypes:  map[string]MediaType{"image/svg+xml": {Ext: ".svg"}},
+			SanitizeSvg: sanitize,
+		}
+
+		client := newProxiedClient(t, &config, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "image/svg+xml")
+			_, _ = w.Write([]byte(malicious))
+		})
+
+		image := AbtImage{FileId: 1, PostId: 2, ExternalUrl: testUrl(t, "http://images.example.com/a.svg")}
+
+		err := fetchStoreImageFromUrl(context.Background(), client, config, nil, &image)
+
+		if !sanitize {
+			if !errors.Is(err, ErrDisallowedMime) {
+				t.Errorf("got %v, want svgs rejected by default", err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(image.LocalFilename)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(data), "alert") || image.FileSize != int64(len(data)) {
+			t.Errorf("stored %q with size %d, want it sanitized", data, image.FileSize)
+		}
+	}
+}
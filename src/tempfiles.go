@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// tempFilePattern matches the files a run leaves in the temp dir: partial
+// downloads (<fileId>.part), downloaded files
+// (<unix>.<fileId>.<postId>.<random>.<ext>) and their thumbnails
+// (<unix>.<fileId>.<postId>.<random>.thumb.jpg). Files named before the random
+// part was added are matched too.
+var tempFilePattern = regexp.MustCompile(`^\d+(\.part|\.\d+\.\d+(\.[0-9a-f]{8})?(\.thumb)?\.[A-Za-z0-9]+)$`)
+
+// sweepStaleTempFiles removes files matching tempFilePattern that haven't been
+// touched for olderThan, which are left over from runs that crashed before
+// cleaning up. Anything newer is kept as it may be a download that can still
+// be resumed.
+func sweepStaleTempFiles(tempDir string, olderThan time.Duration) (int, int64, error) {
+	entries, err := os.ReadDir(tempDir)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	var removedBytes int64
+
+	for _, entry := range entries {
+		if entry.IsDir() || !tempFilePattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(tempDir, entry.Name()))
+
+		if err != nil {
+			fmt.Println("could not remove stale temp file", entry.Name(), err)
+			continue
+		}
+
+		removed++
+		removedBytes += info.Size()
+	}
+
+	return removed, removedBytes, nil
+}
+
+// prepareTempDir creates the temp dir if needed and clears out stale files.
+func prepareTempDir(config AppConfig) error {
+	err := os.MkdirAll(config.TempDir, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	removed, removedBytes, err := sweepStaleTempFiles(config.TempDir, time.Duration(config.StaleTempFileAge))
+
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		fmt.Println("removed", removed, "stale temp files totalling", removedBytes, "bytes from", config.TempDir)
+	}
+
+	return nil
+}
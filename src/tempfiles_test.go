@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepStaleTempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	stale := time.Now().Add(-7 * time.Hour)
+
+	files := []struct {
+		name     string
+		modTime  time.Time
+		wantKept bool
+	}{
+		{"12.part", stale, false},
+		{"1700000000.12.34.jpg", stale, false},
+		{"1700000000.12.34.thumb.jpg", stale, false},
+		{"1700000000.12.34.0a1b2c3d.jpg", stale, false},
+		{"1700000000.12.34.0a1b2c3d.thumb.jpg", stale, false},
+		// Recent files may belong to a download that can still be resumed
+		{"13.part", time.Now(), true},
+		{"1700000000.13.34.png", time.Now(), true},
+		// Files that aren't ours are never touched, however old
+		{"notes.txt", stale, true},
+		{"12.part.bak", stale, true},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(tempDir, file.name)
+
+		err := os.WriteFile(path, []byte("data"), 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Chtimes(path, file.modTime, file.modTime)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, removedBytes, err := sweepStaleTempFiles(tempDir, 6*time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 5 || removedBytes != 20 {
+		t.Errorf("removed %d files totalling %d bytes, want 5 and 20", removed, removedBytes)
+	}
+
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(tempDir, file.name))
+
+		if kept := err == nil; kept != file.wantKept {
+			t.Errorf("%s kept %v, want %v", file.name, kept, file.wantKept)
+		}
+	}
+}
+
+func TestRemoveStoredImagesCountsLeaks(t *testing.T) {
+	tempDir := t.TempDir()
+	removable := filepath.Join(tempDir, "1700000000.1.2.png")
+
+	err := os.WriteFile(removable, testPng, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-empty directory can't be removed like a file, standing in for a
+	// file the cloner doesn't have permission to delete
+	stuck := filepath.Join(tempDir, "1700000000.3.4.png")
+
+	err = os.MkdirAll(filepath.Join(stuck, "child"), 0755)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newMediaCloner(AppConfig{}, nil, nil, nil, nil)
+	c.storedImages = []AbtImage{{LocalFilename: removable}, {LocalFilename: stuck}}
+
+	statusBefore := getServiceStatus()
+
+	c.removeStoredImages()
+
+	if _, err := os.Stat(removable); !os.IsNotExist(err) {
+		t.Errorf("%s should have been removed", removable)
+	}
+
+	if c.summary.LeakedFiles != 1 {
+		t.Errorf("got %d leaked files in the summary, want 1", c.summary.LeakedFiles)
+	}
+
+	if leaked := getServiceStatus().LeakedFiles - statusBefore.LeakedFiles; leaked != 1 {
+		t.Errorf("status counted %d more leaked files, want 1", leaked)
+	}
+}
+
+func TestRemoveStoredImagesKeepsMirrorCopies(t *testing.T) {
+	tempDir := t.TempDir()
+	mirrorDir := filepath.Join(t.TempDir(), "mirror")
+	localFilename := filepath.Join(tempDir, "1700000000.1.2.0a1b2c3d.png")
+
+	err := os.WriteFile(localFilename, testPng, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newMediaCloner(AppConfig{KeepLocalCopies: true, LocalMirrorDir: mirrorDir}, nil, nil, nil, nil)
+	c.storedImages = []AbtImage{{LocalFilename: localFilename}}
+
+	c.removeStoredImages()
+
+	if _, err := os.Stat(localFilename); !os.IsNotExist(err) {
+		t.Errorf("%s should have been moved out of the temp dir", localFilename)
+	}
+
+	mirrorFilename := filepath.Join(mirrorDir, time.Now().Format(dateFolderLayout), filepath.Base(localFilename))
+	data, err := os.ReadFile(mirrorFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(testPng) {
+		t.Errorf("mirrored copy has %d bytes, want %d", len(data), len(testPng))
+	}
+
+	if c.summary.LeakedFiles != 0 {
+		t.Errorf("got %d leaked files, want none", c.summary.LeakedFiles)
+	}
+}
+
+func TestValidateNeedsMirrorDirToKeepLocalCopies(t *testing.T) {
+	config := AppConfig{KeepLocalCopies: true}
+	setConfigDefaults(&config)
+
+	if config.Validate() == nil {
+		t.Error("expected an error for keepLocalCopies without a localMirrorDir")
+	}
+}
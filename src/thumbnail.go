@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+func thumbnailSize(width int, height int, maxEdge int) (int, int) {
+	if width <= maxEdge && height <= maxEdge {
+		return width, height
+	}
+
+	thumbWidth, thumbHeight := maxEdge, maxEdge
+
+	if width >= height {
+		thumbHeight = height * maxEdge / width
+	} else {
+		thumbWidth = width * maxEdge / height
+	}
+
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+
+	return thumbWidth, thumbHeight
+}
+
+// createThumbnail writes a JPEG thumbnail of the downloaded file next to it,
+// scaled so its long edge is at most MaxEdge. GIFs are thumbnailed from their
+// first frame. The EXIF orientation is applied, as the thumbnail has none, and
+// transparent areas are put on white since JPEGs can't keep them.
+func createThumbnail(abtImage *AbtImage, config ThumbnailConfig) error {
+	data, err := os.ReadFile(abtImage.LocalFilename)
+
+	if err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	src = applyOrientation(src, readExifOrientation(data))
+
+	bounds := src.Bounds()
+	width, height := thumbnailSize(bounds.Dx(), bounds.Dy(), config.MaxEdge)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	thumbFilename := strings.TrimSuffix(abtImage.LocalFilename, abtImage.FileExt) + ".thumb.jpg"
+
+	out, err := os.Create(thumbFilename)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(out *os.File) {
+		_ = out.Close()
+	}(out)
+
+	abtImage.ThumbFilename = thumbFilename
+
+	return jpeg.Encode(out, dst, &jpeg.Options{Quality: config.Quality})
+}
+
+// uploadThumbnailToCloud stores the thumbnail in a thumbs folder alongside the
+// image it was made from, named after it, so it must be called after the image
+// is uploaded.
+func uploadThumbnailToCloud(ctx context.Context, s3Client S3API, awsConfig AwsConfig, abtImage *AbtImage) (string, error) {
+	imageName := strings.TrimSuffix(path.Base(abtImage.S3Url), path.Ext(abtImage.S3Url))
+	s3ObjectKey := path.Join(path.Dir(abtImage.S3Url), "thumbs", imageName+".thumb.jpg")
+
+	storageClass := awsConfig.ThumbStorageClass
+
+	if storageClass == "" {
+		storageClass = awsConfig.StorageClass
+	}
+
+	err := putFileToCloud(ctx, s3Client, awsConfig, s3ObjectKey, abtImage.ThumbFilename, putOptions{
+		ContentType:  "image/jpeg",
+		Tagging:      objectTagging(awsConfig, *abtImage),
+		StorageClass: storageClass,
+	})
+
+	return s3ObjectKey, err
+}
+
+// storeThumbnail creates and uploads the thumbnail for an already uploaded
+// image. The local thumbnail is removed straight away as nothing else reads it.
+func storeThumbnail(ctx context.Context, s3Client S3API, config AppConfig, abtImage *AbtImage) error {
+	err := createThumbnail(abtImage, config.Thumbnails)
+
+	if abtImage.ThumbFilename != "" {
+		defer func(thumbFilename string) {
+			_ = os.Remove(thumbFilename)
+		}(abtImage.ThumbFilename)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	abtImage.ThumbS3Url, err = uploadThumbnailToCloud(ctx, s3Client, config.Aws, abtImage)
+
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxEdge int
+		wantWidth, wantHeight  int
+	}{
+		{100, 50, 200, 100, 50},
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{300, 300, 100, 100, 100},
+		{5000, 10, 100, 100, 1},
+	}
+
+	for _, test := range tests {
+		width, height := thumbnailSize(test.width, test.height, test.maxEdge)
+
+		if width != test.wantWidth || height != test.wantHeight {
+			t.Errorf("thumbnailSize(%d, %d, %d) = %dx%d, want %dx%d", test.width, test.height, test.maxEdge, width, height, test.wantWidth, test.wantHeight)
+		}
+	}
+}
+
+func readThumbnail(t *testing.T, abtImage AbtImage) image.Image {
+	t.Helper()
+
+	file, err := os.Open(abtImage.ThumbFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	img, err := jpeg.Decode(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+}
+
+func TestCreateThumbnailScalesAndFillsTransparency(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	localFilename := filepath.Join(t.TempDir(), "1.png")
+	file, err := os.Create(localFilename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = png.Encode(file, src)
+	closeErr := file.Close()
+
+	if err != nil || closeErr != nil {
+		t.Fatal(err, closeErr)
+	}
+
+	abtImage := AbtImage{LocalFilename: localFilename, FileExt: ".png"}
+
+	err = createThumbnail(&abtImage, ThumbnailConfig{MaxEdge: 100, Quality: 80})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if abtImage.ThumbFilename != filepath.Join(filepath.Dir(localFilename), "1.thumb.jpg") {
+		t.Errorf("unexpected thumbnail filename %s", abtImage.ThumbFilename)
+	}
+
+	thumb := readThumbnail(t, abtImage)
+
+	if thumb.Bounds().Dx() != 100 || thumb.Bounds().Dy() != 50 {
+		t.Fatalf("got %dx%d, want 100x50", thumb.Bounds().Dx(), thumb.Bounds().Dy())
+	}
+
+	r, g, b, _ := thumb.At(50, 25).RGBA()
+
+	if r < 0xf000 || g < 0xf000 || b < 0xf000 {
+		t.Errorf("expected the transparent image to be white, got %v", color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff})
+	}
+}
+
+func TestCreateThumbnailAppliesOrientation(t *testing.T) {
+	localFilename := filepath.Join(t.TempDir(), "1.jpg")
+
+	err := os.WriteFile(localFilename, exifJpeg(t, 6), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abtImage := AbtImage{LocalFilename: localFilename, FileExt: ".jpg"}
+
+	err = createThumbnail(&abtImage, ThumbnailConfig{MaxEdge: 100, Quality: 80})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumb := readThumbnail(t, abtImage)
+
+	if thumb.Bounds().Dx() != 2 || thumb.Bounds().Dy() != 4 {
+		t.Errorf("got %dx%d, want the 4x2 image turned to 2x4", thumb.Bounds().Dx(), thumb.Bounds().Dy())
+	}
+}
+
+func TestUploadThumbnailToCloudNamesItAfterTheImage(t *testing.T) {
+	bucket := &fakeBucket{objects: map[string][]byte{}}
+	s3Client := newTestS3Client(t, bucket.ServeHTTP)
+
+	thumbFilename := filepath.Join(t.TempDir(), "1700000000.12.34.thumb.jpg")
+
+	err := os.WriteFile(thumbFilename, []byte("thumb"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the deterministic key strategy the uploaded name no longer matches
+	// the local one, and the thumbnail has to follow the uploaded name
+	abtImage := AbtImage{S3Url: "/media/20230506/12.34.jpg", ThumbFilename: thumbFilename}
+	awsConfig := AwsConfig{Bucket: "bucket", RequestTimeout: Duration(time.Minute)}
+
+	key, err := uploadThumbnailToCloud(context.Background(), s3Client, awsConfig, &abtImage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "/media/20230506/thumbs/12.34.thumb.jpg" {
+		t.Errorf("got key %q, want /media/20230506/thumbs/12.34.thumb.jpg", key)
+	}
+
+	if _, ok := bucket.objects["/bucket/media/20230506/thumbs/12.34.thumb.jpg"]; !ok {
+		t.Errorf("thumbnail not stored, got %v", bucket.objects)
+	}
+}
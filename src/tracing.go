@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "abt-media-cloner"
+
+// OtelConfig sends traces of each file's processing to an OpenTelemetry
+// collector over OTLP/HTTP, e.g. http://otel-collector:4318. Tracing is off
+// when Endpoint is empty.
+type OtelConfig struct {
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"serviceName"`
+}
+
+// setupTracing installs the global tracer provider. The returned function
+// flushes any buffered spans and must be called before exiting. Without an
+// endpoint the default no-op provider is left in place.
+func setupTracing(ctx context.Context, config OtelConfig) (func(context.Context) error, error) {
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Endpoint))
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+
+	if serviceName == "" {
+		serviceName = tracerName
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// startImageSpan starts the span covering everything done for a file, from
+// fetching it to recording the result.
+func startImageSpan(ctx context.Context, image AbtImage) trace.Span {
+	_, span := otel.Tracer(tracerName).Start(
+		ctx,
+		"process_file",
+		trace.WithAttributes(
+			attribute.Int64("file.id", image.FileId),
+			attribute.Int64("post.id", image.PostId),
+			attribute.String("server.address", image.ExternalUrl.Hostname()),
+		),
+	)
+
+	return span
+}
+
+// endImageSpan records what became of a file on its span and ends it.
+func endImageSpan(image AbtImage) {
+	if image.span == nil {
+		return
+	}
+
+	image.span.SetAttributes(
+		attribute.String("file.state", image.State),
+		attribute.String("file.mime_type", image.MimeType),
+		attribute.Int64("file.size", image.FileSize),
+	)
+
+	if image.ErrorCode != "" {
+		image.span.SetStatus(codes.Error, image.ErrorCode+": "+image.LastError)
+	}
+
+	image.span.End()
+}
+
+// startStageSpan starts a span for one stage of a file's processing, such as
+// the upload, as a child of the file's span. Rows sharing another's URL have
+// no span of their own, so their stages aren't traced.
+func startStageSpan(ctx context.Context, image AbtImage, name string) trace.Span {
+	if image.span == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	_, span := otel.Tracer(tracerName).Start(trace.ContextWithSpan(ctx, image.span), name)
+
+	return span
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording every span ended for the
+// rest of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	return recorder
+}
+
+func TestProcessImagesTracesEachStage(t *testing.T) {
+	recorder := recordSpans(t)
+	tc := newTestCloner(t, nil)
+
+	expectFileUpdate(tc.mock, 1, nonEmptyString{}, nil, "retrieved")
+	expectFileUpdate(tc.mock, 2, nil, errorCodeHttp4xx, "failed")
+
+	tc.cloner.processImages(context.Background(), []AbtImage{
+		tc.image(t, 1, 100, "/a.png", 0),
+		tc.image(t, 2, 200, "/missing.png", 0),
+	})
+
+	fileSpans := map[int64]sdktrace.ReadOnlySpan{}
+	stages := map[string][]sdktrace.ReadOnlySpan{}
+
+	for _, span := range recorder.Ended() {
+		if span.Name() != "process_file" {
+			stages[span.Name()] = append(stages[span.Name()], span)
+			continue
+		}
+
+		for _, attr := range span.Attributes() {
+			if attr.Key == "file.id" {
+				fileSpans[attr.Value.AsInt64()] = span
+			}
+		}
+	}
+
+	if len(fileSpans) != 2 {
+		t.Fatalf("got spans for files %v, want 1 and 2", fileSpans)
+	}
+
+	// Only the file that was fetched goes on to be uploaded and recorded
+	wantStages := map[string]int{"fetch": 2, "upload": 1, "db_update": 1, "solr_update": 1}
+
+	for name, want := range wantStages {
+		if len(stages[name]) != want {
+			t.Errorf("got %d %s spans, want %d", len(stages[name]), name, want)
+		}
+	}
+
+	stored := fileSpans[1]
+
+	for _, name := range []string{"upload", "db_update", "solr_update"} {
+		for _, span := range stages[name] {
+			if span.Parent().SpanID() != stored.SpanContext().SpanID() {
+				t.Errorf("%s span isn't a child of file 1's span", name)
+			}
+		}
+	}
+
+	if stored.Status().Code == codes.Error {
+		t.Errorf("stored file's span has error status %q", stored.Status().Description)
+	}
+
+	failed := fileSpans[2]
+
+	if failed.Status().Code != codes.Error {
+		t.Errorf("failed file's span has status %v, want an error", failed.Status().Code)
+	}
+
+	for _, attr := range failed.Attributes() {
+		if attr.Key == "file.state" && attr.Value.AsString() != "failed" {
+			t.Errorf("failed file's span has state %s", attr.Value.AsString())
+		}
+	}
+}
+
+func TestSetupTracingWithoutEndpoint(t *testing.T) {
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := setupTracing(context.Background(), OtelConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if otel.GetTracerProvider() != previous {
+		t.Error("tracer provider replaced without an endpoint")
+	}
+
+	err = shutdown(context.Background())
+
+	if err != nil {
+		t.Error(err)
+	}
+}
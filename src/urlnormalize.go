@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var defaultStripQueryParams = []string{"utm_*", "fbclid", "gclid", "mc_cid", "mc_eid"}
+
+// isStrippedParam reports whether a query parameter is in the strip list. An
+// entry ending in * matches any parameter with that prefix.
+func isStrippedParam(param string, stripParams []string) bool {
+	param = strings.ToLower(param)
+
+	for _, stripParam := range stripParams {
+		stripParam = strings.ToLower(stripParam)
+
+		if strings.HasSuffix(stripParam, "*") {
+			if strings.HasPrefix(param, strings.TrimSuffix(stripParam, "*")) {
+				return true
+			}
+		} else if param == stripParam {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeUrl returns the form of a source URL used to recognise duplicates:
+// scheme and host lowercased, the fragment and any tracking parameters in
+// stripParams removed and the remaining parameters sorted. It's only used as a
+// key; requests are still made to the original URL.
+func normalizeUrl(u *url.URL, stripParams []string) string {
+	normalized := *u
+	normalized.Scheme = strings.ToLower(normalized.Scheme)
+	normalized.Host = strings.ToLower(normalized.Host)
+	normalized.Fragment = ""
+	normalized.RawFragment = ""
+
+	query := normalized.Query()
+
+	for param := range query {
+		if isStrippedParam(param, stripParams) {
+			delete(query, param)
+		}
+	}
+
+	for _, values := range query {
+		sort.Strings(values)
+	}
+
+	// Encode sorts by key
+	normalized.RawQuery = query.Encode()
+	normalized.ForceQuery = false
+
+	return normalized.String()
+}
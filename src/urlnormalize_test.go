@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		rawUrl      string
+		stripParams []string
+		want        string
+	}{
+		{"http://images.example.com/a.png", nil, "http://images.example.com/a.png"},
+		{"HTTP://Images.Example.COM/a.png", nil, "http://images.example.com/a.png"},
+		// The path is case sensitive so it's left alone
+		{"http://images.example.com/A.png", nil, "http://images.example.com/A.png"},
+		{"http://images.example.com/a.png#gallery", nil, "http://images.example.com/a.png"},
+		{"http://images.example.com/a.png?", nil, "http://images.example.com/a.png"},
+		{"http://images.example.com/a.png?w=640&h=480", nil, "http://images.example.com/a.png?h=480&w=640"},
+		{"http://images.example.com/a.png?size=l&size=m", nil, "http://images.example.com/a.png?size=l&size=m"},
+		{"http://images.example.com/a.png?size=m&size=l", nil, "http://images.example.com/a.png?size=l&size=m"},
+		{"http://images.example.com/a.png?utm_source=rss&utm_medium=feed&w=640", defaultStripQueryParams, "http://images.example.com/a.png?w=640"},
+		{"http://images.example.com/a.png?UTM_Source=rss&fbclid=abc", defaultStripQueryParams, "http://images.example.com/a.png"},
+		// Without a strip list tracking params are kept
+		{"http://images.example.com/a.png?utm_source=rss", []string{}, "http://images.example.com/a.png?utm_source=rss"},
+		{"http://images.example.com/a.png?ref=home&id=3", []string{"ref"}, "http://images.example.com/a.png?id=3"},
+	}
+
+	for _, test := range tests {
+		got := normalizeUrl(testUrl(t, test.rawUrl), test.stripParams)
+
+		if got != test.want {
+			t.Errorf("normalizeUrl(%s, %v) = %s, want %s", test.rawUrl, test.stripParams, got, test.want)
+		}
+	}
+}
+
+func TestIsStrippedParam(t *testing.T) {
+	tests := []struct {
+		param string
+		want  bool
+	}{
+		{"utm_source", true},
+		{"utm_", true},
+		{"UTM_CAMPAIGN", true},
+		{"fbclid", true},
+		{"fbclid2", false},
+		{"utm", false},
+		{"w", false},
+	}
+
+	for _, test := range tests {
+		if got := isStrippedParam(test.param, defaultStripQueryParams); got != test.want {
+			t.Errorf("isStrippedParam(%s) = %t, want %t", test.param, got, test.want)
+		}
+	}
+}